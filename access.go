@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// roleAttribute is the certificate attribute that carries a caller's role
+const roleAttribute = "role"
+
+// Roles a caller can hold. Operators initialise, configure and clear the
+// market, participants trade their own assets and auditors read everything.
+const (
+	RoleOperator    = "operator"
+	RoleParticipant = "participant"
+	RoleAuditor     = "auditor"
+)
+
+// legacyAdminRole is the role value administrators carried before there were
+// roles, which still grants the operator role
+const legacyAdminRole = "admin"
+
+// mspRoleObjectType holds the role granted to every member of an MSP whose
+// certificates carry no role attribute
+const mspRoleObjectType = "MSPRole"
+
+// MSPRole is the role granted to the members of an MSP
+type MSPRole struct {
+	MSPID string `json:"mspId"`
+	Role  string `json:"role"`
+}
+
+// anyRole lets every role call a transaction
+var anyRole = []string{RoleOperator, RoleParticipant, RoleAuditor}
+
+// transactionRoles lists the roles allowed to call each transaction. A
+// transaction that is not listed cannot be called by anyone.
+var transactionRoles = map[string][]string{
+	// Market operation
+	"InitMarket":                {RoleOperator},
+	"InitLedger":                {RoleOperator},
+	"InitLedgerWithConfig":      {RoleOperator},
+	"ClearLedger":               {RoleOperator},
+	"UpdateMarket":              {RoleOperator},
+	"RunMarketUntilConvergence": {RoleOperator},
+	"ClearMarketExact":          {RoleOperator},
+	"CompareClearingMethods":    {RoleOperator},
+	"StartAdmmClearing":         {RoleOperator},
+	"AdvanceAdmmRound":          {RoleOperator},
+	"SetTradingMode":            {RoleOperator},
+	"ClearAuction":              {RoleOperator},
+	"MatchOrders":               {RoleOperator},
+	"PurgeExpiredOrders":        {RoleOperator},
+	"SetMarketConfig":           {RoleOperator},
+	"ClearDayAhead":             {RoleOperator},
+	"SetNetwork":                {RoleOperator},
+	"SetProducerBus":            {RoleOperator},
+	"SetConsumerBus":            {RoleOperator},
+	"ClearMarketWithNetwork":    {RoleOperator},
+	"RegisterIdentity":          {RoleOperator},
+	"RevokeIdentity":            {RoleOperator},
+	"SetMSPRole":                {RoleOperator},
+	"Mint":                      {RoleOperator},
+	"ApproveFundsRequest":       {RoleOperator},
+	"SettleFundsRequest":        {RoleOperator},
+	"RejectFundsRequest":        {RoleOperator},
+
+	// Trading, each method checks the caller acts for the participant
+	"CreateConsumer":            {RoleParticipant},
+	"CreateConsumerWithUtility": {RoleParticipant},
+	"CreateProducer":            {RoleParticipant},
+	"CreateProducerWithCurve":   {RoleParticipant},
+	"TransferProducerOwnership": {RoleParticipant},
+	"SetProducerConstraints":    {RoleParticipant},
+	"SetProducerSchedule":       {RoleParticipant},
+	"SetConsumerSchedule":       {RoleParticipant},
+	"SubmitLocalUpdate":         {RoleParticipant},
+	"PlaceOrder":                {RoleParticipant},
+	"SubmitOrder":               {RoleParticipant},
+	"CancelOrder":               {RoleParticipant},
+	"AmendOrder":                {RoleParticipant},
+	"CreateStorage":             {RoleParticipant},
+	"SetStoragePrices":          {RoleParticipant},
+	"Burn":                      {RoleParticipant},
+	"Transfer":                  {RoleParticipant},
+	"Approve":                   {RoleParticipant},
+	"TransferFrom":              {RoleParticipant},
+	"RequestDeposit":            {RoleParticipant},
+	"RequestWithdrawal":         {RoleParticipant},
+
+	// Reads of a participant's own data, which each method checks
+	"GetUserBalance":   anyRole,
+	"GetBalance":       anyRole,
+	"GetUserTrades":    anyRole,
+	"BalanceOf":        anyRole,
+	"Allowance":        anyRole,
+	"GetFundsRequest":  anyRole,
+	"GetFundsHistory":  anyRole,
+	"GetPrivateInputs": anyRole,
+
+	// Market-wide reads
+	"GetMarketState":         anyRole,
+	"GetOrderBook":           anyRole,
+	"GetTradeHistory":        anyRole,
+	"GetCurrentPrice":        anyRole,
+	"GetMarketStatistics":    anyRole,
+	"GetRecentTrades":        anyRole,
+	"GetProducerDetails":     anyRole,
+	"GetMarketConfig":        anyRole,
+	"GetMarketConfigVersion": anyRole,
+	"GetAdmmSession":         anyRole,
+	"GetAuctionResult":       anyRole,
+	"GetMarketResults":       anyRole,
+	"GetNetwork":             anyRole,
+	"GetNetworkResult":       anyRole,
+	"GetStorage":             anyRole,
+	"GetCallerIdentity":      anyRole,
+	"GetCallerRole":          anyRole,
+	"TotalSupply":            anyRole,
+	"CheckTokenSupply":       {RoleOperator, RoleAuditor},
+}
+
+// authorizeTransaction runs before every transaction and rejects callers
+// whose role may not call it
+func authorizeTransaction(ctx contractapi.TransactionContextInterface) error {
+	function, _ := ctx.GetStub().GetFunctionAndParameters()
+	// The function may be qualified with the contract name
+	if i := strings.LastIndex(function, ":"); i >= 0 {
+		function = function[i+1:]
+	}
+
+	roles, ok := transactionRoles[function]
+	if !ok {
+		return fmt.Errorf("transaction %s is not permitted to any role", function)
+	}
+	role, err := callerRole(ctx)
+	if err != nil {
+		return err
+	}
+	for _, allowed := range roles {
+		if role == allowed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("role %s may not call %s", role, function)
+}
+
+// SetMSPRole grants a role to every member of an MSP whose certificate
+// carries no role attribute. An empty role withdraws it. Only a market
+// operator may call it.
+func (s *EnergyMarket) SetMSPRole(ctx contractapi.TransactionContextInterface, mspID string, role string) error {
+	if mspID == "" {
+		return fmt.Errorf("MSP ID is required")
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(mspRoleObjectType, []string{mspID})
+	if err != nil {
+		return fmt.Errorf("failed to create MSP role key: %v", err)
+	}
+	if role == "" {
+		if err := ctx.GetStub().DelState(key); err != nil {
+			return fmt.Errorf("failed to delete MSP role: %v", err)
+		}
+		return nil
+	}
+	if !validRole(role) {
+		return fmt.Errorf("invalid role %q, expected %q, %q or %q", role, RoleOperator, RoleParticipant, RoleAuditor)
+	}
+
+	return putObject(ctx, mspRoleObjectType, mspID, MSPRole{MSPID: mspID, Role: role})
+}
+
+// GetCallerRole retrieves the role the caller holds
+func (s *EnergyMarket) GetCallerRole(ctx contractapi.TransactionContextInterface) (string, error) {
+	return callerRole(ctx)
+}
+
+// callerRole returns the role in the caller's certificate, or the role of its
+// MSP when the certificate carries none
+func callerRole(ctx contractapi.TransactionContextInterface) (string, error) {
+	role, found, err := ctx.GetClientIdentity().GetAttributeValue(roleAttribute)
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller role: %v", err)
+	}
+	if found {
+		if role == legacyAdminRole {
+			return RoleOperator, nil
+		}
+		if !validRole(role) {
+			return "", fmt.Errorf("caller certificate carries unknown role %q", role)
+		}
+		return role, nil
+	}
+
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	var mspRole MSPRole
+	found, err = getObject(ctx, mspRoleObjectType, mspID, &mspRole)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("caller of %s holds no market role", mspID)
+	}
+
+	return mspRole.Role, nil
+}
+
+// hasRole reports whether the caller holds a role
+func hasRole(ctx contractapi.TransactionContextInterface, role string) bool {
+	callerRole, err := callerRole(ctx)
+	return err == nil && callerRole == role
+}
+
+// validRole reports whether a role is one of the market roles
+func validRole(role string) bool {
+	return role == RoleOperator || role == RoleParticipant || role == RoleAuditor
+}
+
+// enrollmentIDAttribute is the certificate attribute Fabric CA puts the
+// enrolment ID in
+const enrollmentIDAttribute = "hf.EnrollmentID"
+
+// Identity binds the enrolment ID of a certificate issued by an MSP to the
+// market participant its holder acts for
+type Identity struct {
+	MSPID         string `json:"mspId"`         // MSP that issued the certificate
+	EnrollmentID  string `json:"enrollmentId"`  // Enrolment ID in the certificate
+	ParticipantID string `json:"participantId"` // Consumer the holder acts for
+	RegisteredAt  string `json:"registeredAt"`  // When the identity was registered
+	RegisteredBy  string `json:"registeredBy"`  // Operator that registered it
+}
+
+// RegisterIdentity maps an enrolment ID of an MSP to a market participant,
+// who need not have been created yet. An enrolment ID acts for one
+// participant only; it must be revoked before it can be mapped to another.
+// Only a market operator may call it.
+func (s *EnergyMarket) RegisterIdentity(ctx contractapi.TransactionContextInterface, mspID string, enrollmentID string, participantID string) (*Identity, error) {
+	if mspID == "" || enrollmentID == "" || participantID == "" {
+		return nil, fmt.Errorf("MSP ID, enrolment ID and participant ID are required")
+	}
+
+	existing, err := readIdentity(ctx, mspID, enrollmentID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.ParticipantID != participantID {
+		return nil, fmt.Errorf("enrolment ID %s of %s is already registered to participant %s", enrollmentID, mspID, existing.ParticipantID)
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	registeredBy, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller identity: %v", err)
+	}
+
+	identity := Identity{
+		MSPID:         mspID,
+		EnrollmentID:  enrollmentID,
+		ParticipantID: participantID,
+		RegisteredAt:  timestamp.Format(orderTimestampLayout),
+		RegisteredBy:  registeredBy,
+	}
+	if err := putObject(ctx, identityObjectType, identityID(mspID, enrollmentID), identity); err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// RevokeIdentity removes the mapping of an enrolment ID, after which its
+// holder can no longer act for any participant. Only a market operator may
+// call it.
+func (s *EnergyMarket) RevokeIdentity(ctx contractapi.TransactionContextInterface, mspID string, enrollmentID string) error {
+	existing, err := readIdentity(ctx, mspID, enrollmentID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("enrolment ID %s of %s is not registered", enrollmentID, mspID)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(identityObjectType, []string{identityID(mspID, enrollmentID)})
+	if err != nil {
+		return fmt.Errorf("failed to create identity key: %v", err)
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return fmt.Errorf("failed to delete identity: %v", err)
+	}
+
+	return nil
+}
+
+// GetCallerIdentity retrieves the registration of the caller's certificate,
+// which names the participant the caller acts for
+func (s *EnergyMarket) GetCallerIdentity(ctx contractapi.TransactionContextInterface) (*Identity, error) {
+	return callerIdentity(ctx)
+}
+
+// assertCaller checks that the caller's certificate is registered to the
+// participant a transaction acts for
+func assertCaller(ctx contractapi.TransactionContextInterface, participantID string) error {
+	identity, err := callerIdentity(ctx)
+	if err != nil {
+		return err
+	}
+	if identity.ParticipantID != participantID {
+		return fmt.Errorf("caller acts for participant %s, not %s", identity.ParticipantID, participantID)
+	}
+
+	return nil
+}
+
+// assertCanRead checks that the caller acts for a participant or is an
+// operator or auditor, who may read every participant's data
+func assertCanRead(ctx contractapi.TransactionContextInterface, participantID string) error {
+	if hasRole(ctx, RoleOperator) || hasRole(ctx, RoleAuditor) {
+		return nil
+	}
+
+	return assertCaller(ctx, participantID)
+}
+
+// callerIdentity looks up the registration of the caller's MSP and enrolment ID
+func callerIdentity(ctx contractapi.TransactionContextInterface) (*Identity, error) {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	enrollmentID, found, err := ctx.GetClientIdentity().GetAttributeValue(enrollmentIDAttribute)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller enrolment ID: %v", err)
+	}
+	if !found {
+		return nil, fmt.Errorf("caller certificate carries no enrolment ID")
+	}
+
+	identity, err := readIdentity(ctx, mspID, enrollmentID)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, fmt.Errorf("enrolment ID %s of %s is not registered to a market participant", enrollmentID, mspID)
+	}
+
+	return identity, nil
+}
+
+// readIdentity reads the registration of an enrolment ID, returning nil if it
+// is not registered
+func readIdentity(ctx contractapi.TransactionContextInterface, mspID string, enrollmentID string) (*Identity, error) {
+	var identity Identity
+	found, err := getObject(ctx, identityObjectType, identityID(mspID, enrollmentID), &identity)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+// identityID is the key of an enrolment ID, which is only unique within its MSP
+func identityID(mspID string, enrollmentID string) string {
+	return mspID + ":" + enrollmentID
+}
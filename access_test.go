@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestEveryTransactionHasRoles(t *testing.T) {
+	inherited := map[string]bool{}
+	contract := reflect.TypeOf(&contractapi.Contract{})
+	for i := 0; i < contract.NumMethod(); i++ {
+		inherited[contract.Method(i).Name] = true
+	}
+
+	market := reflect.TypeOf(&EnergyMarket{})
+	for i := 0; i < market.NumMethod(); i++ {
+		name := market.Method(i).Name
+		if _, listed := transactionRoles[name]; !listed && !inherited[name] {
+			t.Errorf("transaction %s is not listed in transactionRoles", name)
+		}
+	}
+	for name := range transactionRoles {
+		if _, exists := market.MethodByName(name); !exists {
+			t.Errorf("transactionRoles lists %s, which is not a transaction", name)
+		}
+	}
+}
+
+func TestAuthorizeTransactionChecksTheRole(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.SetMSPRole(market.operator(), "Org3MSP", RoleAuditor); err != nil {
+		t.Fatalf("SetMSPRole failed: %v", err)
+	}
+
+	operator := testIdentity{mspID: testMSPID, role: RoleOperator, enrollmentID: "admin"}
+	participant := testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer1"}
+	auditor := testIdentity{mspID: testMSPID, role: RoleAuditor, enrollmentID: "auditor"}
+	tests := []struct {
+		function string
+		identity testIdentity
+		ok       bool
+	}{
+		{"InitMarket", operator, true},
+		{"InitMarket", participant, false},
+		{"InitMarket", auditor, false},
+		{"EnergyMarket:ClearMarketExact", operator, true},
+		{"EnergyMarket:ClearMarketExact", participant, false},
+		{"PlaceOrder", participant, true},
+		{"PlaceOrder", operator, false},
+		{"PlaceOrder", auditor, false},
+		{"Mint", testIdentity{mspID: testMSPID, role: legacyAdminRole, enrollmentID: "admin"}, true},
+		{"CheckTokenSupply", auditor, true},
+		{"CheckTokenSupply", participant, false},
+		{"GetMarketState", participant, true},
+		{"GetMarketState", auditor, true},
+		{"GetMarketState", testIdentity{mspID: testMSPID, role: "superuser", enrollmentID: "consumer1"}, false},
+		{"deleteMarketObjects", operator, false},
+		// Without a role attribute the caller holds the role of its MSP, if any
+		{"GetTradeHistory", testIdentity{mspID: "Org3MSP", enrollmentID: "auditor"}, true},
+		{"Mint", testIdentity{mspID: "Org3MSP", enrollmentID: "auditor"}, false},
+		{"GetTradeHistory", testIdentity{mspID: "Org2MSP", enrollmentID: "auditor"}, false},
+	}
+	for _, test := range tests {
+		ctx := market.as(test.identity)
+		market.stub.function = test.function
+		err := authorizeTransaction(ctx)
+		if (err == nil) != test.ok {
+			t.Errorf("%s called by %s of %s with role %q returned %v, want success %v", test.function, test.identity.enrollmentID, test.identity.mspID, test.identity.role, err, test.ok)
+		}
+	}
+}
+
+func TestAssertCallerRejectsOtherParticipants(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.RevokeIdentity(market.operator(), testMSPID, "consumer3"); err != nil {
+		t.Fatalf("RevokeIdentity failed: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		identity      testIdentity
+		participantID string
+		ok            bool
+	}{
+		{"own participant", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer1"}, "consumer1", true},
+		{"another participant", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer1"}, "consumer2", false},
+		{"same enrolment ID of another MSP", testIdentity{mspID: "Org2MSP", role: RoleParticipant, enrollmentID: "consumer1"}, "consumer1", false},
+		{"unregistered enrolment ID", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "mallory"}, "consumer1", false},
+		{"revoked enrolment ID", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer3"}, "consumer3", false},
+		{"operator acting for a participant", testIdentity{mspID: testMSPID, role: RoleOperator, enrollmentID: "admin"}, "consumer1", false},
+	}
+	for _, test := range tests {
+		err := assertCaller(market.as(test.identity), test.participantID)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: assertCaller returned %v, want success %v", test.name, err, test.ok)
+		}
+	}
+
+	// An enrolment ID cannot be moved to another participant while registered
+	if _, err := market.contract.RegisterIdentity(market.operator(), testMSPID, "consumer1", "consumer2"); err == nil {
+		t.Errorf("consumer1's enrolment ID was registered to consumer2")
+	}
+
+	// A transaction acting for another participant leaves the ledger untouched
+	if err := market.contract.Transfer(market.participant("consumer2"), "consumer1", "consumer2", 100); err == nil {
+		t.Errorf("consumer2 transferred consumer1's credits")
+	}
+	if balance := market.consumer("consumer1").Balance; balance != 10000000000 {
+		t.Errorf("consumer1 has %s, want 10000.000000", balance)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// admmSessionID is the ID of the single ADMM session under admmObjectType
+const admmSessionID = "current"
+
+// AdmmSession is the public state of a distributed clearing run with the
+// exchange form of ADMM. Participants are producers and consumers; a
+// participant's net injection is its output for a producer and minus its
+// demand and the network losses it causes for a consumer, and the market
+// clears when the injections sum to zero.
+//
+// In every round each participant solves its own problem with the cost or
+// utility curve it keeps to itself, using only the public values below.
+// With v = x - MeanInjection - ScaledDual, where x is the participant's
+// injection from the last closed round, and a consumer's Fee and Loss its
+// entries in Fees and LossFactors:
+//
+//	producer:  minimise A*p^2 + B*p + Rho/2*(p - v)^2 over its production limits,
+//	           p = clamp((Rho*v - B) / (2*A + Rho), ProductionMin, ProductionMax)
+//	consumer:  maximise Beta*d - Theta/2*d^2 - Fee*d - Rho/2*((1+Loss)*d + v)^2 over its demand limits,
+//	           d = clamp((Beta - Fee - Rho*(1+Loss)*v) / (Theta + Rho*(1+Loss)^2), DemandMin, DemandMax)
+//
+// and submits p or d through SubmitLocalUpdate. AdvanceAdmmRound then
+// averages the injections and updates the scaled dual variable u. The market
+// price is -Rho*u: at convergence every producer inside its limits produces
+// where its marginal cost equals it, and every consumer inside its limits
+// consumes where its marginal utility equals the price delivered to it,
+// Price*(1+Loss) + Fee.
+//
+// The session reads only the participants' production and demand limits, so
+// participants that clear through ADMM alone can register with zero cost and
+// utility coefficients.
+type AdmmSession struct {
+	Round           int       `json:"round"`           // Round participants are submitting for
+	Rho             float64   `json:"rho"`             // ADMM penalty parameter
+	PrimalTolerance float64   `json:"primalTolerance"` // Largest supply-demand imbalance accepted at convergence, in MW
+	DualTolerance   float64   `json:"dualTolerance"`   // Largest dual residual accepted at convergence
+	ParticipantIDs  []string  `json:"participantIds"`  // Producers in ID order, then consumers in ID order
+	Producers       int       `json:"producers"`       // Number of leading participants that are producers
+	Injections      []float64 `json:"injections"`      // Net injection of each participant in the last closed round, in MW
+	MeanInjection   float64   `json:"meanInjection"`   // Average net injection in the last closed round
+	Fees            []float64 `json:"fees"`            // Network fee per MWh of each consumer, in participant order
+	LossFactors     []float64 `json:"lossFactors"`     // Network losses per MWh of each consumer, in participant order
+	ScaledDual      float64   `json:"scaledDual"`      // Scaled dual variable u
+	Price           float64   `json:"price"`           // Market price -Rho * u
+	PrimalResidual  float64   `json:"primalResidual"`  // Supply-demand imbalance of the last closed round, in MW
+	DualResidual    float64   `json:"dualResidual"`    // Dual residual of the last closed round
+	Converged       bool      `json:"converged"`       // Whether both residuals are within tolerance
+}
+
+// AdmmUpdate is a participant's local primal update for one round. Each
+// participant has one key, which a new round's submission overwrites.
+type AdmmUpdate struct {
+	ParticipantID string  `json:"participantId"`
+	Round         int     `json:"round"`
+	Quantity      float64 `json:"quantity"` // Output of a producer or demand of a consumer, in MW
+}
+
+// StartAdmmClearing opens a new distributed clearing session over the current
+// producers and consumers. The initial price is a warm start for the dual
+// variable. Each consumer's grid tariffs are blended by the producers' shares
+// of the last dispatch, which is how the session splits its demand. The
+// market is no longer converged until the session is, so its dispatch is
+// settled when it converges. Only the public profiles are read, so no
+// participant's cost or utility curve is needed. Only a market operator may
+// start a session.
+func (s *EnergyMarket) StartAdmmClearing(ctx contractapi.TransactionContextInterface, rho float64, primalTolerance float64, dualTolerance float64, initialPrice float64) (*AdmmSession, error) {
+	if rho <= 0 {
+		return nil, fmt.Errorf("rho must be positive")
+	}
+	if primalTolerance <= 0 || dualTolerance <= 0 {
+		return nil, fmt.Errorf("tolerances must be positive")
+	}
+
+	marketState, err := loadMarketProfiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &AdmmSession{
+		Round:           1,
+		Rho:             rho,
+		PrimalTolerance: primalTolerance,
+		DualTolerance:   dualTolerance,
+		ParticipantIDs:  []string{},
+		Producers:       len(marketState.Producers),
+		ScaledDual:      -initialPrice / rho,
+		Price:           initialPrice,
+	}
+	for _, producer := range marketState.Producers {
+		session.ParticipantIDs = append(session.ParticipantIDs, producer.ID)
+	}
+	consumerIDs := []string{}
+	consumerIndex := make(map[string]int)
+	for j, consumer := range marketState.Consumers {
+		consumerIDs = append(consumerIDs, consumer.ID)
+		consumerIndex[consumer.ID] = j
+	}
+	sort.Strings(consumerIDs)
+	session.ParticipantIDs = append(session.ParticipantIDs, consumerIDs...)
+	session.Injections = make([]float64, len(session.ParticipantIDs))
+
+	charges := config.gridCharges(marketState)
+	shares := outputShares(marketState)
+	for _, consumerID := range consumerIDs {
+		charge := blendedCharge(charges, consumerIndex[consumerID], shares)
+		session.Fees = append(session.Fees, charge.fee)
+		session.LossFactors = append(session.LossFactors, charge.loss)
+	}
+
+	if err := putObject(ctx, admmObjectType, admmSessionID, session); err != nil {
+		return nil, err
+	}
+
+	marketState.Converged = false
+	if err := putMarketHeader(ctx, headerOf(marketState)); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// SubmitLocalUpdate records a participant's local primal update for the
+// current round: the output it will produce or the demand it will consume at
+// the published price. Only the quantity is revealed, never the cost or
+// utility curve behind it. It must lie within the participant's limits.
+func (s *EnergyMarket) SubmitLocalUpdate(ctx contractapi.TransactionContextInterface, participantID string, round int, quantity float64) error {
+	session, err := getAdmmSession(ctx)
+	if err != nil {
+		return err
+	}
+	if session.Converged {
+		return fmt.Errorf("ADMM session has already converged")
+	}
+	if round != session.Round {
+		return fmt.Errorf("ADMM session is in round %d, not %d", session.Round, round)
+	}
+	if math.IsNaN(quantity) || math.IsInf(quantity, 0) {
+		return fmt.Errorf("invalid quantity %v", quantity)
+	}
+
+	index := admmParticipantIndex(session, participantID)
+	if index < 0 {
+		return fmt.Errorf("%s is not a participant of the ADMM session", participantID)
+	}
+	if index < session.Producers {
+		producer, err := getProducerProfile(ctx, participantID)
+		if err != nil {
+			return err
+		}
+		if err := assertCaller(ctx, producer.OwnerID); err != nil {
+			return err
+		}
+		if quantity < producer.ProductionMin || quantity > producer.ProductionMax {
+			return fmt.Errorf("output %.4f of producer %s is outside its limits [%.4f, %.4f]", quantity, participantID, producer.ProductionMin, producer.ProductionMax)
+		}
+	} else {
+		consumer, err := getConsumerProfile(ctx, participantID)
+		if err != nil {
+			return err
+		}
+		if err := assertCaller(ctx, consumer.ID); err != nil {
+			return err
+		}
+		if quantity < consumer.DemandMin || quantity > consumer.DemandMax {
+			return fmt.Errorf("demand %.4f of consumer %s is outside its limits [%.4f, %.4f]", quantity, participantID, consumer.DemandMin, consumer.DemandMax)
+		}
+	}
+
+	update := AdmmUpdate{ParticipantID: participantID, Round: round, Quantity: quantity}
+
+	return putObject(ctx, admmUpdateType, participantID, update)
+}
+
+// AdvanceAdmmRound closes the current round once every participant has
+// submitted. It averages the net injections, updates the scaled dual variable
+// by the average and computes the residuals. When both residuals are within
+// tolerance the dispatch and price are written to the market state and the
+// optimized trades are recorded; the cost and utility fields are left alone,
+// since the chaincode never learns the curves behind them.
+func (s *EnergyMarket) AdvanceAdmmRound(ctx contractapi.TransactionContextInterface) (*AdmmSession, error) {
+	session, err := getAdmmSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if session.Converged {
+		return nil, fmt.Errorf("ADMM session has already converged")
+	}
+
+	injections := make([]float64, len(session.ParticipantIDs))
+	submitted := make([]bool, len(session.ParticipantIDs))
+	err = scanObjects(ctx, admmUpdateType, func(value []byte) error {
+		var update AdmmUpdate
+		if err := json.Unmarshal(value, &update); err != nil {
+			return fmt.Errorf("failed to unmarshal ADMM update: %v", err)
+		}
+		index := admmParticipantIndex(session, update.ParticipantID)
+		if index < 0 || update.Round != session.Round {
+			return nil
+		}
+		injections[index] = update.Quantity
+		if index >= session.Producers {
+			injections[index] = -update.Quantity * (1 + admmCharge(session, index).loss)
+		}
+		submitted[index] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for i, id := range session.ParticipantIDs {
+		if !submitted[i] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("round %d is still waiting for %v", session.Round, missing)
+	}
+
+	// Consensus and dual update
+	count := float64(len(injections))
+	mean := 0.0
+	for _, x := range injections {
+		mean += x
+	}
+	mean /= count
+
+	dualResidual := 0.0
+	for i, x := range injections {
+		change := (x - mean) - (session.Injections[i] - session.MeanInjection)
+		dualResidual += change * change
+	}
+
+	session.ScaledDual += mean
+	session.Price = -session.Rho * session.ScaledDual
+	session.PrimalResidual = math.Abs(mean) * count
+	session.DualResidual = session.Rho * math.Sqrt(dualResidual)
+	session.Injections = injections
+	session.MeanInjection = mean
+	session.Converged = session.PrimalResidual <= session.PrimalTolerance && session.DualResidual <= session.DualTolerance
+
+	if session.Converged {
+		if err := s.applyAdmmDispatch(ctx, session); err != nil {
+			return nil, err
+		}
+	} else {
+		session.Round++
+	}
+
+	if err := putObject(ctx, admmObjectType, admmSessionID, session); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetAdmmSession retrieves the public state of the ADMM session, which
+// participants need to compute their next local update
+func (s *EnergyMarket) GetAdmmSession(ctx contractapi.TransactionContextInterface) (*AdmmSession, error) {
+	return getAdmmSession(ctx)
+}
+
+// applyAdmmDispatch writes a converged ADMM dispatch to the market state and
+// records the optimized trades at the ADMM price. It reads the public
+// profiles and the balances it settles, never the private cost and utility
+// details, so a peer only needs the accounts of other organisations passed
+// as transient data.
+func (s *EnergyMarket) applyAdmmDispatch(ctx contractapi.TransactionContextInterface, session *AdmmSession) error {
+	marketState, err := loadMarketProfiles(ctx)
+	if err != nil {
+		return err
+	}
+	for j := range marketState.Consumers {
+		if err := readConsumerAccount(ctx, &marketState.Consumers[j]); err != nil {
+			return err
+		}
+	}
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	quantities := make(map[string]float64)
+	for i, id := range session.ParticipantIDs {
+		quantities[id] = math.Abs(session.Injections[i])
+		if i >= session.Producers {
+			quantities[id] /= 1 + admmCharge(session, i).loss
+		}
+	}
+
+	totalGeneration := 0.0
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		producer.Production = quantities[producer.ID]
+		producer.Lambda = session.Price
+		totalGeneration += producer.Production
+	}
+
+	totalDemand := 0.0
+	totalLosses := 0.0
+	charges := config.gridCharges(marketState)
+	shares := outputShares(marketState)
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		consumer.TotalDemand = quantities[consumer.ID]
+		for i, share := range shares {
+			consumer.Demands[i] = consumer.TotalDemand * share
+		}
+		totalDemand += consumer.TotalDemand
+		totalLosses += consumer.TotalDemand * blendedCharge(charges, j, shares).loss
+	}
+
+	marketState.TotalGeneration = totalGeneration
+	marketState.TotalDemand = totalDemand
+	marketState.TotalLosses = totalLosses
+	marketState.IterationCount = session.Round
+
+	if !marketState.Converged {
+		_, err = s.recordOptimizedTrades(ctx, marketState, config, nil, 1)
+		if err != nil {
+			return fmt.Errorf("failed to record optimized trades: %v", err)
+		}
+	}
+	marketState.Converged = true
+
+	return putMarketProfiles(ctx, marketState)
+}
+
+// admmCharge returns the blended grid tariff of the consumer at a participant
+// index of the session
+func admmCharge(session *AdmmSession, index int) gridCharge {
+	j := index - session.Producers
+	if j < 0 || j >= len(session.Fees) || j >= len(session.LossFactors) {
+		return gridCharge{}
+	}
+	return gridCharge{fee: session.Fees[j], loss: session.LossFactors[j]}
+}
+
+// getAdmmSession reads the ADMM session
+func getAdmmSession(ctx contractapi.TransactionContextInterface) (*AdmmSession, error) {
+	var session AdmmSession
+	found, err := getObject(ctx, admmObjectType, admmSessionID, &session)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no ADMM session has been started")
+	}
+
+	return &session, nil
+}
+
+// admmParticipantIndex returns the index of a participant in the session, or -1
+func admmParticipantIndex(session *AdmmSession, participantID string) int {
+	for i, id := range session.ParticipantIDs {
+		if id == participantID {
+			return i
+		}
+	}
+	return -1
+}
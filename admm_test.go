@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// localAdmmUpdate is the update a participant computes with its own curve,
+// as AdmmSession describes
+func localAdmmUpdate(session *AdmmSession, index int, seed MarketSeed) float64 {
+	v := session.Injections[index] - session.MeanInjection - session.ScaledDual
+	if index < session.Producers {
+		for _, producer := range seed.Producers {
+			if producer.ID == session.ParticipantIDs[index] {
+				p := (session.Rho*v - producer.B) / (2*producer.A + session.Rho)
+				return math.Min(math.Max(p, producer.ProductionMin), producer.ProductionMax)
+			}
+		}
+	}
+	charge := admmCharge(session, index)
+	for _, consumer := range seed.Consumers {
+		if consumer.ID == session.ParticipantIDs[index] {
+			loss := 1 + charge.loss
+			d := (consumer.Beta - charge.fee - session.Rho*loss*v) / (consumer.Theta + session.Rho*loss*loss)
+			return math.Min(math.Max(d, consumer.DemandMin), consumer.DemandMax)
+		}
+	}
+	return 0
+}
+
+// ownerOf returns the consumer who acts for a participant of the default market
+func ownerOf(participantID string) string {
+	for _, producer := range defaultMarketSeed().Producers {
+		if producer.ID == participantID {
+			return producer.OwnerID
+		}
+	}
+	return participantID
+}
+
+func TestAdmmClearingNeedsNoPrivateDetails(t *testing.T) {
+	market := newTestMarket(t)
+	seed := defaultMarketSeed()
+	before := market.producer("producer1")
+
+	// The peer belongs to another organisation and is passed the accounts
+	// it settles, but no cost or utility details
+	accounts := PrivateInputs{accountObjectType: market.privateInputs()[accountObjectType]}
+	t.Setenv("CORE_PEER_LOCALMSPID", "Org2MSP")
+
+	session, err := market.contract.StartAdmmClearing(market.operator(), 0.05, 0.5, 0.5, 5)
+	if err != nil {
+		t.Fatalf("StartAdmmClearing failed: %v", err)
+	}
+
+	for session.Round < 2000 && !session.Converged {
+		for i, id := range session.ParticipantIDs {
+			quantity := localAdmmUpdate(session, i, seed)
+			if err := market.contract.SubmitLocalUpdate(market.participant(ownerOf(id)), id, session.Round, quantity); err != nil {
+				t.Fatalf("SubmitLocalUpdate of %s failed: %v", id, err)
+			}
+		}
+		ctx := market.operator()
+		market.passPrivateInputs(accounts)
+		session, err = market.contract.AdvanceAdmmRound(ctx)
+		if err != nil {
+			t.Fatalf("AdvanceAdmmRound failed: %v", err)
+		}
+	}
+	if !session.Converged {
+		t.Fatalf("ADMM did not converge in %d rounds", session.Round)
+	}
+
+	// The dispatch is settled at the ADMM price
+	trades, err := market.contract.GetTradeHistory(market.operator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trades) == 0 {
+		t.Fatalf("the converged dispatch recorded no trades")
+	}
+	price, err := toAmount(session.Price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, trade := range trades {
+		if trade.Price != price {
+			t.Errorf("trade %s is at %s, want the ADMM price %s", trade.ID, trade.Price, price)
+		}
+	}
+
+	// The private details are left as they were
+	t.Setenv("CORE_PEER_LOCALMSPID", testMSPID)
+	after := market.producer("producer1")
+	if after.A != before.A || after.B != before.B || after.Lambda != before.Lambda {
+		t.Errorf("producer1 has a=%v b=%v lambda=%v after settlement, want a=%v b=%v lambda=%v", after.A, after.B, after.Lambda, before.A, before.B, before.Lambda)
+	}
+	market.assertSupplyConsistent()
+}
+
+func TestSubmitLocalUpdateChecksTheParticipant(t *testing.T) {
+	market := newTestMarket(t)
+	if _, err := market.contract.StartAdmmClearing(market.operator(), 0.05, 0.5, 0.5, 5); err != nil {
+		t.Fatalf("StartAdmmClearing failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		caller   string
+		id       string
+		round    int
+		quantity float64
+	}{
+		{"another owner's producer", "consumer2", "producer1", 1, 100},
+		{"another consumer", "consumer2", "consumer1", 1, 100},
+		{"output above the limit", "consumer1", "producer1", 1, 351},
+		{"demand below the limit", "consumer1", "consumer1", 1, 59},
+		{"wrong round", "consumer1", "consumer1", 2, 100},
+		{"not a participant", "consumer1", "producer9", 1, 100},
+	}
+	for _, test := range tests {
+		if err := market.contract.SubmitLocalUpdate(market.participant(test.caller), test.id, test.round, test.quantity); err == nil {
+			t.Errorf("%s: SubmitLocalUpdate was accepted", test.name)
+		}
+	}
+	if err := market.contract.SubmitLocalUpdate(market.participant("consumer1"), "producer1", 1, 100); err != nil {
+		t.Errorf("SubmitLocalUpdate of the owner failed: %v", err)
+	}
+}
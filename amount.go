@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+// Money and energy are stored as fixed-point integers so that every peer, on
+// every architecture, settles trades to exactly the same balances.
+//
+// Conversion rules:
+//   - Amount is currency in micro-units: 1 USD = 1,000,000. Balances, escrow,
+//     trade values and prices use it. A price is the Amount paid per MWh.
+//   - Energy is energy in Wh: 1 MWh = 1,000,000. Order, trade and traded
+//     quantities use it, and are quoted in MWh at the transaction boundary.
+//   - Transaction arguments arrive as decimal USD and MWh and are converted by
+//     rounding half away from zero to the nearest micro-unit or Wh. Values in
+//     the ledger and in JSON results are the integer micro-units and Wh.
+//   - The value of a quantity at a price is price * energy / 1,000,000,
+//     computed in 128 bits and rounded half up to the nearest micro-unit.
+//   - The clearing algorithm in UpdateMarket works in float64 USD and MW; its
+//     prices and demands are converted with the same rounding when trades are
+//     recorded.
+type Amount int64
+
+// Energy is a quantity of energy in Wh, see Amount for the conversion rules
+type Energy int64
+
+// fixedPointScale is the number of micro-units per USD and of Wh per MWh
+const fixedPointScale = 1000000
+
+// maxFixedPointInput bounds transaction arguments so that conversion cannot overflow
+const maxFixedPointInput = float64(math.MaxInt64 / fixedPointScale)
+
+// toAmount converts a USD value to micro-units
+func toAmount(usd float64) (Amount, error) {
+	micro, err := toFixedPoint(usd)
+	return Amount(micro), err
+}
+
+// toEnergy converts a MWh quantity to Wh
+func toEnergy(mwh float64) (Energy, error) {
+	wh, err := toFixedPoint(mwh)
+	return Energy(wh), err
+}
+
+// toFixedPoint scales a decimal value by fixedPointScale, rounding half away from zero
+func toFixedPoint(value float64) (int64, error) {
+	if math.IsNaN(value) || math.IsInf(value, 0) || math.Abs(value) > maxFixedPointInput {
+		return 0, fmt.Errorf("value %v is out of range", value)
+	}
+	return int64(math.Round(value * fixedPointScale)), nil
+}
+
+// Float returns the amount in USD, for display and for the clearing algorithm
+func (a Amount) Float() float64 {
+	return float64(a) / fixedPointScale
+}
+
+// Float returns the energy in MWh, for display and for the clearing algorithm
+func (e Energy) Float() float64 {
+	return float64(e) / fixedPointScale
+}
+
+// String formats the amount as exact decimal USD
+func (a Amount) String() string {
+	return formatFixedPoint(int64(a))
+}
+
+// String formats the energy as exact decimal MWh
+func (e Energy) String() string {
+	return formatFixedPoint(int64(e))
+}
+
+// formatFixedPoint formats a fixed-point value with six decimals without going
+// through float64
+func formatFixedPoint(value int64) string {
+	sign := ""
+	magnitude := uint64(value)
+	if value < 0 {
+		sign = "-"
+		magnitude = uint64(-value)
+	}
+	return fmt.Sprintf("%s%d.%06d", sign, magnitude/fixedPointScale, magnitude%fixedPointScale)
+}
+
+// valueOf returns the value of a quantity of energy at a price per MWh. A
+// value too large for an Amount saturates, so it fails any balance check
+// instead of wrapping around.
+func valueOf(price Amount, quantity Energy) Amount {
+	negative := (price < 0) != (quantity < 0)
+	hi, lo := bits.Mul64(absUint64(int64(price)), absUint64(int64(quantity)))
+
+	// Round half up before dividing by the scale
+	lo, carry := bits.Add64(lo, fixedPointScale/2, 0)
+	hi += carry
+	if hi >= fixedPointScale {
+		hi = fixedPointScale - 1
+		lo = math.MaxUint64
+	}
+	quotient, _ := bits.Div64(hi, lo, fixedPointScale)
+	if quotient > math.MaxInt64 {
+		quotient = math.MaxInt64
+	}
+
+	if negative {
+		return -Amount(quotient)
+	}
+	return Amount(quotient)
+}
+
+// affordableEnergy returns the most energy a budget pays for at a price per
+// MWh, rounded down so that its value never exceeds the budget
+func affordableEnergy(budget Amount, price Amount) Energy {
+	if budget <= 0 || price <= 0 {
+		return 0
+	}
+	hi, lo := bits.Mul64(uint64(budget), fixedPointScale)
+	if hi >= uint64(price) {
+		return Energy(math.MaxInt64)
+	}
+	quotient, _ := bits.Div64(hi, lo, uint64(price))
+	if quotient > math.MaxInt64 {
+		return Energy(math.MaxInt64)
+	}
+	return Energy(quotient)
+}
+
+// absUint64 returns the magnitude of a signed value
+func absUint64(value int64) uint64 {
+	if value < 0 {
+		return uint64(-value)
+	}
+	return uint64(value)
+}
+
+// minEnergy returns the smaller of two quantities
+func minEnergy(a Energy, b Energy) Energy {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestToAmountRoundsHalfAwayFromZero(t *testing.T) {
+	tests := []struct {
+		usd  float64
+		want Amount
+	}{
+		{0, 0},
+		{1, 1000000},
+		{0.1 + 0.2, 300000},
+		{0.0000025, 3},
+		{-0.0000025, -3},
+		{1.0000004, 1000000},
+		{1.0000006, 1000001},
+		{-1.0000006, -1000001},
+	}
+	for _, test := range tests {
+		got, err := toAmount(test.usd)
+		if err != nil {
+			t.Errorf("toAmount(%v) failed: %v", test.usd, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("toAmount(%v) = %d, want %d", test.usd, got, test.want)
+		}
+	}
+}
+
+func TestToEnergyRejectsValuesOutOfRange(t *testing.T) {
+	for _, mwh := range []float64{math.NaN(), math.Inf(1), math.Inf(-1), 1e13, -1e13} {
+		if _, err := toEnergy(mwh); err == nil {
+			t.Errorf("toEnergy(%v) succeeded, want an error", mwh)
+		}
+	}
+}
+
+func TestValueOfRoundsHalfUp(t *testing.T) {
+	tests := []struct {
+		price    Amount
+		quantity Energy
+		want     Amount
+	}{
+		{50000000, 2000000, 100000000}, // 50 USD/MWh for 2 MWh
+		{1500000, 1, 2},                // 1.5 micro-USD rounds up
+		{1400000, 1, 1},
+		{1000001, 500000, 500001}, // 500000.5 micro-USD rounds up
+		{-1500000, 1, -2},         // Magnitudes round the same way
+		{0, 1000000, 0},
+	}
+	for _, test := range tests {
+		if got := valueOf(test.price, test.quantity); got != test.want {
+			t.Errorf("valueOf(%d, %d) = %d, want %d", test.price, test.quantity, got, test.want)
+		}
+	}
+}
+
+func TestValueOfSaturates(t *testing.T) {
+	max := Amount(math.MaxInt64)
+	if got := valueOf(max, Energy(math.MaxInt64)); got != max {
+		t.Errorf("valueOf of the largest price and quantity = %d, want %d", got, max)
+	}
+	if got := valueOf(-max, Energy(math.MaxInt64)); got != -max {
+		t.Errorf("valueOf of the smallest price and largest quantity = %d, want %d", got, -max)
+	}
+}
+
+func TestAffordableEnergyNeverExceedsBudget(t *testing.T) {
+	tests := []struct {
+		budget Amount
+		price  Amount
+		want   Energy
+	}{
+		{100000000, 30000000, 3333333}, // 100 USD at 30 USD/MWh
+		{100000000, 50000000, 2000000},
+		{1, 3000000, 0},
+		{0, 30000000, 0},
+		{-1, 30000000, 0},
+		{100000000, 0, 0},
+		{Amount(math.MaxInt64), 1, Energy(math.MaxInt64)},
+	}
+	for _, test := range tests {
+		got := affordableEnergy(test.budget, test.price)
+		if got != test.want {
+			t.Errorf("affordableEnergy(%d, %d) = %d, want %d", test.budget, test.price, got, test.want)
+			continue
+		}
+		if got > 0 && got < Energy(math.MaxInt64) {
+			if value := valueOf(test.price, got); value > test.budget {
+				t.Errorf("%d Wh at %d costs %d, more than the budget %d", got, test.price, value, test.budget)
+			}
+			if value := valueOf(test.price, got+1); value <= test.budget {
+				t.Errorf("%d Wh at %d costs %d, within the budget %d", got+1, test.price, value, test.budget)
+			}
+		}
+	}
+}
+
+func TestFixedPointString(t *testing.T) {
+	tests := []struct {
+		value int64
+		want  string
+	}{
+		{0, "0.000000"},
+		{1, "0.000001"},
+		{1500000, "1.500000"},
+		{-1500000, "-1.500000"},
+		{math.MaxInt64, "9223372036854.775807"},
+	}
+	for _, test := range tests {
+		if got := Amount(test.value).String(); got != test.want {
+			t.Errorf("Amount(%d).String() = %q, want %q", test.value, got, test.want)
+		}
+		if got := Energy(test.value).String(); got != test.want {
+			t.Errorf("Energy(%d).String() = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Trading modes supported on MarketState.TradingMode
+const (
+	TradingModeContinuous = "continuous"
+	TradingModeAuction    = "auction"
+)
+
+// AuctionResult is the outcome of one call auction, published under
+// AUCTION_<intervalID>
+type AuctionResult struct {
+	IntervalID    string `json:"intervalId"`    // Settlement interval the auction cleared
+	ClearingPrice Amount `json:"clearingPrice"` // Uniform price paid and received by every fill
+	Volume        Energy `json:"volume"`        // Matched volume at the clearing price
+	Demand        Energy `json:"demand"`        // Aggregate demand at the clearing price
+	Supply        Energy `json:"supply"`        // Aggregate supply at the clearing price
+	TradeCount    int    `json:"tradeCount"`    // Number of trades recorded
+	Timestamp     string `json:"timestamp"`     // When the auction was cleared
+}
+
+// SetTradingMode switches the order book between continuous matching and a
+// periodic call auction. In auction mode orders only rest in the book until
+// ClearAuction fills them at a single clearing price.
+func (s *EnergyMarket) SetTradingMode(ctx contractapi.TransactionContextInterface, mode string) error {
+	if mode != TradingModeContinuous && mode != TradingModeAuction {
+		return fmt.Errorf("invalid trading mode %q, expected %q or %q", mode, TradingModeContinuous, TradingModeAuction)
+	}
+
+	header, err := getMarketHeader(ctx)
+	if err != nil {
+		return err
+	}
+
+	header.TradingMode = mode
+
+	return putMarketHeader(ctx, header)
+}
+
+// ClearAuction runs a uniform-price double auction over the resting orders for
+// one settlement interval. The aggregate demand and supply curves are built
+// from the order book, the clearing price is the one that maximises matched
+// volume, and every crossing order is filled at that price through the same
+// settlement path as continuous matching. The clearing price and volume are
+// published as an AuctionResult and an AuctionCleared event.
+func (s *EnergyMarket) ClearAuction(ctx contractapi.TransactionContextInterface, intervalID string) (*AuctionResult, error) {
+	if intervalID == "" {
+		return nil, fmt.Errorf("interval ID is required")
+	}
+
+	resultKey := "AUCTION_" + intervalID
+	existing, err := ctx.GetStub().GetState(resultKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auction result: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("auction for interval %s has already been cleared", intervalID)
+	}
+
+	header, err := getMarketHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if header.TradingMode != TradingModeAuction {
+		return nil, fmt.Errorf("market is not in auction mode")
+	}
+
+	orderBook, err := s.GetOrderBook(ctx)
+	if err != nil {
+		return nil, err
+	}
+	buys := orderBook["buy"]
+	sells := orderBook["sell"]
+
+	userIDs, producerIDs := orderParticipants(buys, sells)
+	marketState, err := loadParticipants(ctx, userIDs, producerIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &AuctionResult{
+		IntervalID: intervalID,
+		Timestamp:  timestamp.Format(orderTimestampLayout),
+	}
+	result.ClearingPrice, result.Demand, result.Supply = findClearingPrice(buys, sells)
+	volume := minEnergy(result.Demand, result.Supply)
+
+	// Fill the crossing orders in priority order until the volume is used up.
+	// Both sides are already sorted by price-time priority, so the marginal
+	// orders on the long side are rationed by time.
+	touchedBuys := make([]bool, len(buys))
+	touchedSells := make([]bool, len(sells))
+	for bi := range buys {
+		bid := &buys[bi]
+		if bid.Price < result.ClearingPrice {
+			break
+		}
+
+		for si := range sells {
+			if volume-result.Volume <= 0 || bid.Quantity <= 0 {
+				break
+			}
+
+			ask := &sells[si]
+			if ask.Price > result.ClearingPrice {
+				break
+			}
+			if ask.Quantity <= 0 || !canCross(bid, ask) {
+				continue
+			}
+
+			quantity := minEnergy(minEnergy(bid.Quantity, ask.Quantity), volume-result.Volume)
+			if _, err := s.fillOrders(ctx, marketState, bid, ask, result.ClearingPrice, quantity); err != nil {
+				return nil, err
+			}
+			result.Volume += quantity
+			result.TradeCount++
+			touchedBuys[bi] = true
+			touchedSells[si] = true
+		}
+	}
+
+	for i := range buys {
+		if touchedBuys[i] {
+			if err := s.storeOrRemoveOrder(ctx, marketState, &buys[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := range sells {
+		if touchedSells[i] {
+			if err := s.storeOrRemoveOrder(ctx, marketState, &sells[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if result.TradeCount > 0 {
+		if err := putParticipants(ctx, marketState); err != nil {
+			return nil, err
+		}
+	}
+
+	// Publish the interval result
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal auction result: %v", err)
+	}
+	err = ctx.GetStub().PutState(resultKey, resultJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save auction result: %v", err)
+	}
+	err = ctx.GetStub().SetEvent("AuctionCleared", resultJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to emit auction event: %v", err)
+	}
+
+	return result, nil
+}
+
+// GetAuctionResult retrieves the published result of a cleared call auction
+func (s *EnergyMarket) GetAuctionResult(ctx contractapi.TransactionContextInterface, intervalID string) (*AuctionResult, error) {
+	resultJSON, err := ctx.GetStub().GetState("AUCTION_" + intervalID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read auction result: %v", err)
+	}
+	if resultJSON == nil {
+		return nil, fmt.Errorf("auction for interval %s has not been cleared", intervalID)
+	}
+
+	var result AuctionResult
+	err = json.Unmarshal(resultJSON, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal auction result: %v", err)
+	}
+
+	return &result, nil
+}
+
+// findClearingPrice evaluates the aggregate demand and supply curves at every
+// submitted limit price and returns the price with the largest matched volume,
+// together with the demand and supply at that price. Ties are broken by the
+// smallest demand/supply imbalance and then by the middle of the remaining
+// price range, rounded down to a whole micro-unit, so every peer picks the
+// same price.
+func findClearingPrice(buys []Order, sells []Order) (Amount, Energy, Energy) {
+	var prices []Amount
+	for _, order := range buys {
+		prices = append(prices, order.Price)
+	}
+	for _, order := range sells {
+		prices = append(prices, order.Price)
+	}
+	sort.Slice(prices, func(i, j int) bool {
+		return prices[i] < prices[j]
+	})
+
+	var bestVolume Energy
+	bestImbalance := Energy(math.MaxInt64)
+	var candidates []Amount
+	for i, price := range prices {
+		if i > 0 && price == prices[i-1] {
+			continue
+		}
+
+		demand, supply := curvesAt(buys, sells, price)
+		volume := minEnergy(demand, supply)
+		imbalance := demand - supply
+		if imbalance < 0 {
+			imbalance = -imbalance
+		}
+
+		switch {
+		case volume > bestVolume:
+			bestVolume, bestImbalance = volume, imbalance
+			candidates = []Amount{price}
+		case volume == bestVolume && imbalance < bestImbalance:
+			bestImbalance = imbalance
+			candidates = []Amount{price}
+		case volume == bestVolume && imbalance == bestImbalance:
+			candidates = append(candidates, price)
+		}
+	}
+
+	if bestVolume <= 0 {
+		return 0, 0, 0
+	}
+
+	price := candidates[0] + (candidates[len(candidates)-1]-candidates[0])/2
+	demand, supply := curvesAt(buys, sells, price)
+	return price, demand, supply
+}
+
+// curvesAt returns the aggregate demand of the buy orders willing to pay the
+// price and the aggregate supply of the sell orders willing to accept it
+func curvesAt(buys []Order, sells []Order, price Amount) (Energy, Energy) {
+	var demand, supply Energy
+	for _, order := range buys {
+		if order.Price >= price {
+			demand += order.Quantity
+		}
+	}
+	for _, order := range sells {
+		if order.Price <= price {
+			supply += order.Quantity
+		}
+	}
+	return demand, supply
+}
@@ -0,0 +1,80 @@
+package main
+
+import "testing"
+
+// bookOrders builds resting orders of one side from price and quantity pairs
+// in USD per MWh and MWh
+func bookOrders(side string, levels ...float64) []Order {
+	orders := []Order{}
+	for i := 0; i+1 < len(levels); i += 2 {
+		price, _ := toAmount(levels[i])
+		quantity, _ := toEnergy(levels[i+1])
+		orders = append(orders, Order{OrderType: side, Price: price, Quantity: quantity})
+	}
+	return orders
+}
+
+func TestFindClearingPriceBreaksTies(t *testing.T) {
+	tests := []struct {
+		name   string
+		buys   []Order
+		sells  []Order
+		price  Amount
+		demand Energy
+		supply Energy
+	}{
+		{"no crossing orders", bookOrders("buy", 10, 5), bookOrders("sell", 20, 5), 0, 0, 0},
+		{"largest volume", bookOrders("buy", 30, 10, 22, 5), bookOrders("sell", 20, 12, 25, 5), 21000000, 15000000, 12000000},
+		{"smallest imbalance", bookOrders("buy", 30, 5, 25, 3), bookOrders("sell", 20, 4), 30000000, 5000000, 4000000},
+		{"middle of the tied range", bookOrders("buy", 30, 5), bookOrders("sell", 20, 5), 25000000, 5000000, 5000000},
+		{"middle rounded down", bookOrders("buy", 20.000002, 5), bookOrders("sell", 20.000001, 5), 20000001, 5000000, 5000000},
+	}
+	for _, test := range tests {
+		price, demand, supply := findClearingPrice(test.buys, test.sells)
+		if price != test.price || demand != test.demand || supply != test.supply {
+			t.Errorf("%s: cleared at %s with demand %s and supply %s, want %s, %s and %s", test.name, price, demand, supply, test.price, test.demand, test.supply)
+		}
+	}
+}
+
+func TestClearAuctionFillsAtOnePriceOncePerInterval(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.SetTradingMode(market.operator(), TradingModeAuction); err != nil {
+		t.Fatalf("SetTradingMode failed: %v", err)
+	}
+	market.placeOrder("sell", 20, 5, "consumer1", "producer1")
+	market.placeOrder("sell", 24, 5, "consumer2", "producer2")
+	market.placeOrder("buy", 30, 6, "consumer3", "")
+	market.placeOrder("buy", 26, 2, "consumer4", "")
+
+	// Orders only rest until the auction clears them
+	if trades, err := market.contract.GetTradeHistory(market.operator()); err != nil || len(trades) != 0 {
+		t.Fatalf("%d trades before the auction, %v", len(trades), err)
+	}
+	market.placeOrder("buy", 19, 1, "consumer5", "")
+
+	result, err := market.contract.ClearAuction(market.operator(), "2024-06-01T10")
+	if err != nil {
+		t.Fatalf("ClearAuction failed: %v", err)
+	}
+	if result.ClearingPrice != 25000000 || result.Volume != 8000000 {
+		t.Errorf("auction cleared %s at %s, want 8.000000 at 25.000000", result.Volume, result.ClearingPrice)
+	}
+	trades, err := market.contract.GetTradeHistory(market.operator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, trade := range trades {
+		if trade.Price != result.ClearingPrice {
+			t.Errorf("trade %s is at %s, want the clearing price %s", trade.ID, trade.Price, result.ClearingPrice)
+		}
+	}
+	if len(trades) != result.TradeCount {
+		t.Errorf("recorded %d trades, the result reports %d", len(trades), result.TradeCount)
+	}
+
+	if _, err := market.contract.ClearAuction(market.operator(), "2024-06-01T10"); err == nil {
+		t.Errorf("the interval was cleared twice")
+	}
+	market.assertSupplyConsistent()
+}
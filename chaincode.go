@@ -18,161 +18,348 @@ type EnergyMarket struct {
 
 // Producer represents an energy producer/generator
 type Producer struct {
-	ID            string  `json:"id"`
-	A             float64 `json:"a"`             // Quadratic cost coefficient
-	B             float64 `json:"b"`             // Linear cost coefficient
-	ProductionMin float64 `json:"productionMin"` // Minimum production limit
-	ProductionMax float64 `json:"productionMax"` // Maximum production limit
-	Production    float64 `json:"production"`    // Current production quantity
-	Lambda        float64 `json:"lambda"`        // Current price/marginal cost
-	Cost          float64 `json:"cost"`          // Total production cost
-	OwnerID       string  `json:"ownerId"`       // ID of the consumer who owns this producer
-	TradedVolume  float64 `json:"tradedVolume"`  // Total volume traded by this producer
+	ID                string       `json:"id"`
+	A                 float64      `json:"a"`                       // Quadratic cost coefficient
+	B                 float64      `json:"b"`                       // Linear cost coefficient
+	ProductionMin     float64      `json:"productionMin"`           // Minimum production limit
+	ProductionMax     float64      `json:"productionMax"`           // Maximum production limit
+	Production        float64      `json:"production"`              // Current production quantity
+	Lambda            float64      `json:"lambda"`                  // Current price/marginal cost
+	Cost              float64      `json:"cost"`                    // Total production cost
+	OwnerID           string       `json:"ownerId"`                 // ID of the consumer who owns this producer
+	TradedVolume      Energy       `json:"tradedVolume"`            // Total volume traded by this producer
+	CommittedCapacity Energy       `json:"committedCapacity"`       // Capacity locked by resting sell orders or sold through them
+	RampUp            float64      `json:"rampUp,omitempty"`        // Largest output increase between consecutive intervals, 0 for no limit
+	RampDown          float64      `json:"rampDown,omitempty"`      // Largest output decrease between consecutive intervals, 0 for no limit
+	MinUpTime         int          `json:"minUpTime,omitempty"`     // Intervals the unit stays online once started
+	MinDownTime       int          `json:"minDownTime,omitempty"`   // Intervals the unit stays offline once shut down
+	StartupCost       float64      `json:"startupCost,omitempty"`   // Cost of starting the unit up
+	Offline           bool         `json:"offline,omitempty"`       // Whether the unit was offline in the last cleared interval
+	StatusPeriods     int          `json:"statusPeriods,omitempty"` // Intervals the unit has been online or offline, 0 before any interval is cleared
+	LastOutput        float64      `json:"lastOutput,omitempty"`    // Output in the last cleared interval
+	CostCurve         []CostPoint  `json:"costCurve,omitempty"`     // Piecewise-linear cost curve, used instead of A and B when set
+	OfferBlocks       []OfferBlock `json:"offerBlocks,omitempty"`   // Block offer, used instead of A and B when set
+	Bus               string       `json:"bus,omitempty"`           // Network bus the producer injects at, the slack bus when not set
+	MSPID             string       `json:"mspId"`                   // Organisation of the owner, whose collection holds the private details
 }
 
 // Consumer represents an energy consumer
 type Consumer struct {
-	ID          string    `json:"id"`
-	Beta        float64   `json:"beta"`        // Utility function parameter
-	Theta       float64   `json:"theta"`       // Utility function parameter
-	DemandMin   float64   `json:"demandMin"`   // Minimum demand limit
-	DemandMax   float64   `json:"demandMax"`   // Maximum demand limit
-	UMin        float64   `json:"uMin"`        // Lower multiplier (Lagrangian)
-	UMax        float64   `json:"uMax"`        // Upper multiplier (Lagrangian)
-	Demands     []float64 `json:"demands"`     // Demand for each producer's energy
-	Utilities   []float64 `json:"utilities"`   // Utility derived from each producer
-	TotalDemand float64   `json:"totalDemand"` // Sum of demands
-	Balance     float64   `json:"balance"`     // Consumer's balance in USD
-	ProducerIDs []string  `json:"producerIds"` // IDs of producers owned by this consumer
+	ID            string         `json:"id"`
+	Beta          float64        `json:"beta"`                   // Utility function parameter of the quadratic and log models
+	Theta         float64        `json:"theta"`                  // Utility function parameter of the quadratic and log models
+	DemandMin     float64        `json:"demandMin"`              // Minimum demand limit
+	DemandMax     float64        `json:"demandMax"`              // Maximum demand limit
+	UMin          float64        `json:"uMin"`                   // Lower multiplier (Lagrangian)
+	UMax          float64        `json:"uMax"`                   // Upper multiplier (Lagrangian)
+	Demands       []float64      `json:"demands"`                // Demand for each producer's energy
+	Utilities     []float64      `json:"utilities"`              // Utility derived from each producer
+	TotalDemand   float64        `json:"totalDemand"`            // Sum of demands
+	Balance       Amount         `json:"balance"`                // Available energy credits in micro-USD
+	ProducerIDs   []string       `json:"producerIds"`            // IDs of producers owned by this consumer
+	EscrowBalance Amount         `json:"escrowBalance"`          // Funds locked by resting buy orders, not included in Balance
+	LockedBalance Amount         `json:"lockedBalance"`          // Funds locked by pending withdrawals, not included in Balance
+	UtilityModel  string         `json:"utilityModel,omitempty"` // "quadratic" (default), "log", "piecewise" or "block"
+	UtilityCurve  []UtilityPoint `json:"utilityCurve,omitempty"` // Breakpoints of the piecewise utility model
+	DemandBlocks  []DemandBlock  `json:"demandBlocks,omitempty"` // Blocks of the block utility model
+	Bus           string         `json:"bus,omitempty"`          // Network bus the consumer withdraws at, the slack bus when not set
+	MSPID         string         `json:"mspId"`                  // Organisation whose collection holds the private details and balance
+	accountSalt   string         // Salt of the balance record, set when it is read
+	accountID     string         // Account that pays for the consumer's trades when not its own, as for a storage unit's charging
 }
 
 // MarketStatistics represents various statistics about the market
 type MarketStatistics struct {
-	TradeCount int     `json:"tradeCount"` // Total number of trades
-	Volume24h  float64 `json:"volume24h"`  // Total trading volume in the last 24 hours
+	TradeCount int    `json:"tradeCount"` // Total number of trades
+	Volume24h  Amount `json:"volume24h"`  // Total trading volume in the last 24 hours
 }
 
 // MarketState represents the current state of the energy market
 type MarketState struct {
-	Producers       []Producer        `json:"producers"`
-	Consumers       []Consumer        `json:"consumers"`
-	TotalGeneration float64           `json:"totalGeneration"`
-	TotalDemand     float64           `json:"totalDemand"`
-	SocialWelfare   float64           `json:"socialWelfare"`
-	IterationCount  int               `json:"iterationCount"`
-	Converged       bool              `json:"converged"`
-	Statistics      MarketStatistics  `json:"statistics"`
+	Producers       []Producer       `json:"producers"`
+	Consumers       []Consumer       `json:"consumers"`
+	TotalGeneration float64          `json:"totalGeneration"`
+	TotalDemand     float64          `json:"totalDemand"`
+	TotalLosses     float64          `json:"totalLosses"` // Network losses the generation covers on top of the demand
+	SocialWelfare   float64          `json:"socialWelfare"`
+	IterationCount  int              `json:"iterationCount"`
+	Converged       bool             `json:"converged"`
+	Statistics      MarketStatistics `json:"statistics"`
+	TradingMode     string           `json:"tradingMode"`   // "continuous" (default) or "auction"
+	StepScale       float64          `json:"stepScale"`     // Step scale the adaptive schedule settled on
+	ConfigVersion   int              `json:"configVersion"` // Version of the MarketConfig in effect when the clearing result was produced
 }
 
 // Order represents an energy buy or sell order
 type Order struct {
-	UserID     string  `json:"userId"`     // ID of the consumer placing the order
-	Price      float64 `json:"price"`      // Price per unit of energy
-	Quantity   float64 `json:"quantity"`   // Quantity of energy to buy/sell
-	OrderType  string  `json:"orderType"`  // "buy" or "sell"
-	Timestamp  string  `json:"timestamp"`  // When the order was placed
-	ProducerID string  `json:"producerId"` // ID of the producer whose energy is being sold/bought
+	ID            string `json:"id"`            // Ledger key of the order, ORDER_<txID>
+	UserID        string `json:"userId"`        // ID of the consumer placing the order
+	Price         Amount `json:"price"`         // Price per MWh, 0 for market orders
+	Quantity      Energy `json:"quantity"`      // Quantity of energy to buy/sell
+	OrderType     string `json:"orderType"`     // "buy" or "sell"
+	Timestamp     string `json:"timestamp"`     // When the order was placed
+	ProducerID    string `json:"producerId"`    // ID of the producer whose energy is being sold/bought
+	EscrowAmount  Amount `json:"escrowAmount"`  // Funds still locked for a buy order
+	ExecutionType string `json:"executionType"` // "limit" or "market"
+	TimeInForce   string `json:"timeInForce"`   // "GTC", "IOC" or "FOK"
+	PostOnly      bool   `json:"postOnly"`      // Order may only add liquidity
+	ExpiresAt     string `json:"expiresAt"`     // When a good-till-time order expires, empty if it never does
 }
 
 // Trade represents a completed energy trade
 type Trade struct {
-	ID         string  `json:"id"`
-	BuyerID    string  `json:"buyerId"`
-	SellerID   string  `json:"sellerId"`
-	ProducerID string  `json:"producerId"`    // The producer whose energy was traded
-	Price      float64 `json:"price"`         // Price per unit of energy
-	Quantity   float64 `json:"quantity"`      // Quantity of energy traded
-	TotalValue float64 `json:"totalValue"`    // Total value of the trade (price * quantity)
-	Timestamp  string  `json:"timestamp"`     // When the trade was completed
+	ID             string `json:"id"`
+	BuyerID        string `json:"buyerId"`
+	SellerID       string `json:"sellerId"`
+	ProducerID     string `json:"producerId"`               // The producer whose energy was traded
+	Price          Amount `json:"price"`                    // Price per MWh
+	Quantity       Energy `json:"quantity"`                 // Quantity of energy traded
+	TotalValue     Amount `json:"totalValue"`               // Total paid by the buyer: energy, losses and network fee
+	NetworkFee     Amount `json:"networkFee"`               // Network fee included in the total value
+	LossCharge     Amount `json:"lossCharge"`               // Network losses included in the total value, at the price
+	LossQuantity   Energy `json:"lossQuantity"`             // Energy lost in the network on top of the quantity
+	CongestionRent Amount `json:"congestionRent,omitempty"` // Buyer's minus seller's bus price on the energy and losses, included in the total value
+	Timestamp      string `json:"timestamp"`                // When the trade was completed
 }
 
-// InitMarket initializes the energy market with producers and consumers
+// InitMarket initializes the energy market with producers and consumers,
+// cancelling the orders resting in a previous market and minting the seeded
+// balances. The accounts are salted with random bytes passed as transient
+// data under "salt".
 func (s *EnergyMarket) InitMarket(ctx contractapi.TransactionContextInterface) error {
-	// Initialize producers with owners
-	producers := []Producer{
-		{ID: "producer1", A: 0.0080, B: 2.25, ProductionMin: 10, ProductionMax: 350, OwnerID: "consumer1"},
-		{ID: "producer2", A: 0.0062, B: 4.20, ProductionMin: 20, ProductionMax: 290, OwnerID: "consumer2"},
-		{ID: "producer3", A: 0.0075, B: 3.25, ProductionMin: 15, ProductionMax: 400, OwnerID: "consumer3"},
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
 	}
 
-	// Initialize consumers with their owned producers
-	consumers := []Consumer{
-		{ID: "consumer1", Beta: 8.25, Theta: 0.0720, DemandMin: 60, DemandMax: 150, ProducerIDs: []string{"producer1"}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
-		{ID: "consumer2", Beta: 7.90, Theta: 0.0660, DemandMin: 50, DemandMax: 100, ProducerIDs: []string{"producer2"}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
-		{ID: "consumer3", Beta: 7.55, Theta: 0.0700, DemandMin: 90, DemandMax: 145, ProducerIDs: []string{"producer3"}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
-		{ID: "consumer4", Beta: 8.00, Theta: 0.0550, DemandMin: 60, DemandMax: 140, ProducerIDs: []string{}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
-		{ID: "consumer5", Beta: 7.75, Theta: 0.0750, DemandMin: 50, DemandMax: 150, ProducerIDs: []string{}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
-		{ID: "consumer6", Beta: 8.05, Theta: 0.0450, DemandMin: 70, DemandMax: 170, ProducerIDs: []string{}, Demands: make([]float64, len(producers)), Utilities: make([]float64, len(producers)), Balance: 10000},
+	marketState, err := newMarketState(defaultMarketSeed(), config)
+	if err != nil {
+		return err
 	}
 
-	// Initialize production values for producers
-	for i := range producers {
-		producers[i].Lambda = 2*producers[i].A*producers[i].ProductionMin + producers[i].B
-		producers[i].Production = (producers[i].Lambda - producers[i].B) / (2 * producers[i].A)
-		producers[i].Cost = producers[i].A*math.Pow(producers[i].Production, 2) + producers[i].B*producers[i].Production
+	// Drop the producers, consumers, balances and statistics of a previous market
+	err = deleteMarketObjects(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Resting orders hold escrow and capacity of the market being replaced
+	err = deleteKeyRange(ctx, "ORDER_", "ORDER_~")
+	if err != nil {
+		return err
+	}
+
+	return putSeededMarket(ctx, marketState)
+}
+
+// defaultMarketSeed returns the producers and consumers the market starts with
+func defaultMarketSeed() MarketSeed {
+	return MarketSeed{
+		// Initialize producers with owners
+		Producers: []ProducerSeed{
+			{ID: "producer1", A: 0.0080, B: 2.25, ProductionMin: 10, ProductionMax: 350, OwnerID: "consumer1"},
+			{ID: "producer2", A: 0.0062, B: 4.20, ProductionMin: 20, ProductionMax: 290, OwnerID: "consumer2"},
+			{ID: "producer3", A: 0.0075, B: 3.25, ProductionMin: 15, ProductionMax: 400, OwnerID: "consumer3"},
+		},
+		Consumers: []ConsumerSeed{
+			{ID: "consumer1", Beta: 8.25, Theta: 0.0720, DemandMin: 60, DemandMax: 150, Balance: 10000},
+			{ID: "consumer2", Beta: 7.90, Theta: 0.0660, DemandMin: 50, DemandMax: 100, Balance: 10000},
+			{ID: "consumer3", Beta: 7.55, Theta: 0.0700, DemandMin: 90, DemandMax: 145, Balance: 10000},
+			{ID: "consumer4", Beta: 8.00, Theta: 0.0550, DemandMin: 60, DemandMax: 140, Balance: 10000},
+			{ID: "consumer5", Beta: 7.75, Theta: 0.0750, DemandMin: 50, DemandMax: 150, Balance: 10000},
+			{ID: "consumer6", Beta: 8.05, Theta: 0.0450, DemandMin: 70, DemandMax: 170, Balance: 10000},
+		},
+	}
+}
+
+// newMarketState builds a fresh market state from a seed, linking each
+// producer to its owner and starting producers at the configured initial lambda
+func newMarketState(seed MarketSeed, config *MarketConfig) (*MarketState, error) {
+	if len(seed.Producers) == 0 || len(seed.Consumers) == 0 {
+		return nil, fmt.Errorf("market seed needs at least one producer and one consumer")
+	}
+
+	tradingMode := seed.TradingMode
+	if tradingMode == "" {
+		tradingMode = TradingModeContinuous
+	}
+	if tradingMode != TradingModeContinuous && tradingMode != TradingModeAuction {
+		return nil, fmt.Errorf("invalid trading mode %q", tradingMode)
+	}
+
+	// Initialize consumers with their owned producers
+	consumers := make([]Consumer, 0, len(seed.Consumers))
+	consumerIndex := make(map[string]int)
+	for _, c := range seed.Consumers {
+		if _, exists := consumerIndex[c.ID]; exists {
+			return nil, fmt.Errorf("consumer with ID %s already exists", c.ID)
+		}
+		consumerIndex[c.ID] = len(consumers)
+		utilityModel := c.UtilityModel
+		if utilityModel == "" {
+			utilityModel = UtilityQuadratic
+		}
+		consumer := Consumer{
+			ID:           c.ID,
+			UtilityModel: utilityModel,
+			Beta:         c.Beta,
+			Theta:        c.Theta,
+			UtilityCurve: c.UtilityCurve,
+			DemandBlocks: c.DemandBlocks,
+			DemandMin:    c.DemandMin,
+			DemandMax:    c.DemandMax,
+			ProducerIDs:  []string{},
+			Demands:      make([]float64, len(seed.Producers)),
+			Utilities:    make([]float64, len(seed.Producers)),
+		}
+		if err := validateUtility(&consumer); err != nil {
+			return nil, err
+		}
+		balance, err := toAmount(c.Balance)
+		if err != nil {
+			return nil, fmt.Errorf("consumer %s has an invalid balance: %v", c.ID, err)
+		}
+		consumer.Balance = balance
+		consumers = append(consumers, consumer)
 	}
 
-	marketState := MarketState{
+	// Initialize producers with owners
+	producers := make([]Producer, 0, len(seed.Producers))
+	producerIDs := make(map[string]bool)
+	for _, p := range seed.Producers {
+		if producerIDs[p.ID] {
+			return nil, fmt.Errorf("producer with ID %s already exists", p.ID)
+		}
+		producerIDs[p.ID] = true
+		if err := validateCostCurve(p.CostCurve, p.OfferBlocks, p.ProductionMax); err != nil {
+			return nil, fmt.Errorf("producer %s: %v", p.ID, err)
+		}
+		if p.A <= 0 && len(p.CostCurve) == 0 && len(p.OfferBlocks) == 0 {
+			return nil, fmt.Errorf("producer %s must have a positive quadratic cost coefficient", p.ID)
+		}
+		if p.ProductionMin < 0 || p.ProductionMax < p.ProductionMin {
+			return nil, fmt.Errorf("producer %s has invalid production limits", p.ID)
+		}
+		ownerIndex, ownerExists := consumerIndex[p.OwnerID]
+		if !ownerExists {
+			return nil, fmt.Errorf("owner %s of producer %s not found", p.OwnerID, p.ID)
+		}
+		consumers[ownerIndex].ProducerIDs = append(consumers[ownerIndex].ProducerIDs, p.ID)
+		producers = append(producers, Producer{
+			ID:            p.ID,
+			A:             p.A,
+			B:             p.B,
+			ProductionMin: p.ProductionMin,
+			ProductionMax: p.ProductionMax,
+			OwnerID:       p.OwnerID,
+			CostCurve:     p.CostCurve,
+			OfferBlocks:   p.OfferBlocks,
+		})
+	}
+
+	// Producers are stored in ID order, which is the order consumer demands are indexed in
+	sort.Slice(producers, func(i, j int) bool {
+		return producers[i].ID < producers[j].ID
+	})
+
+	marketState := &MarketState{
 		Producers:      producers,
 		Consumers:      consumers,
 		IterationCount: 0,
 		Converged:      false,
 		Statistics:     MarketStatistics{TradeCount: 0, Volume24h: 0},
+		TradingMode:    tradingMode,
 	}
 
-	marketStateJSON, err := json.Marshal(marketState)
-	if err != nil {
-		return fmt.Errorf("failed to marshal market state: %v", err)
-	}
+	// Initialize production values for producers
+	resetClearing(marketState, config)
+
+	return marketState, nil
+}
 
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
+// GetMarketState retrieves the current market state, assembled from the
+// per-entity producer, consumer, balance and statistics keys. A participant
+// only sees its own private details and balance, and only those the peer's
+// organisation holds are filled in.
+func (s *EnergyMarket) GetMarketState(ctx contractapi.TransactionContextInterface) (*MarketState, error) {
+	marketState, err := loadMarketProfiles(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to put market state: %v", err)
+		return nil, err
+	}
+	if err := loadVisibleDetails(ctx, marketState); err != nil {
+		return nil, err
 	}
 
-	return nil
+	redactMarketState(ctx, marketState)
+	return marketState, nil
 }
 
-// GetMarketState retrieves the current market state
-func (s *EnergyMarket) GetMarketState(ctx contractapi.TransactionContextInterface) (*MarketState, error) {
-	marketStateJSON, err := ctx.GetStub().GetState("MarketState")
+// UpdateMarket runs one iteration of the market clearing algorithm
+func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface) error {
+	marketState, err := loadMarketState(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read market state: %v", err)
+		return err
 	}
-	if marketStateJSON == nil {
-		return nil, fmt.Errorf("market state does not exist")
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
 	}
 
-	var marketState MarketState
-	err = json.Unmarshal(marketStateJSON, &marketState)
+	err = s.iterateMarket(ctx, marketState, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal market state: %v", err)
+		return err
 	}
 
-	return &marketState, nil
+	// Store updated market state
+	return putMarketState(ctx, marketState)
 }
 
-// UpdateMarket runs one iteration of the market clearing algorithm
-func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface) error {
-	marketState, err := s.GetMarketState(ctx)
-	if err != nil {
-		return err
+// iterateMarket runs one iteration on the given market state and records the
+// optimized trades the first time it converges. The state is not stored, so
+// several iterations can run in one transaction.
+func (s *EnergyMarket) iterateMarket(ctx contractapi.TransactionContextInterface, marketState *MarketState, config *MarketConfig) error {
+	converged := clearingStep(marketState, config)
+	marketState.ConfigVersion = config.Version
+
+	// If converged, record trades between consumers and producers
+	if converged && !marketState.Converged {
+		_, err := s.recordOptimizedTrades(ctx, marketState, config, nil, 1)
+		if err != nil {
+			return fmt.Errorf("failed to record optimized trades: %v", err)
+		}
 	}
 
+	marketState.Converged = converged
+
+	// Increment iteration counter
+	marketState.IterationCount++
+
+	return nil
+}
+
+// subgradientStep updates prices, production and demands by one dual
+// subgradient step with the configured step sizes and reports whether the
+// market has converged. It only changes the in-memory state.
+func subgradientStep(marketState *MarketState, config *MarketConfig) bool {
 	// Create arrays to hold total demand for each producer
 	producerDemands := make([]float64, len(marketState.Producers))
 
+	// Network fees and losses between each consumer and producer
+	charges := config.gridCharges(marketState)
+
 	// Step 1: Initialize or update consumer demands
 	if marketState.IterationCount == 0 {
-		initializeConsumerDemands(marketState, producerDemands)
+		initializeConsumerDemands(marketState, producerDemands, charges)
 	} else {
-		// Calculate current producer demands from existing consumer demands
+		// Calculate current producer demands from existing consumer demands,
+		// including the losses the producer must cover
 		for j := range marketState.Consumers {
 			consumer := &marketState.Consumers[j]
 			consumer.TotalDemand = 0
 
 			for i := range marketState.Producers {
-				producerDemands[i] += consumer.Demands[i]
+				producerDemands[i] += consumer.Demands[i] * (1 + chargeAt(charges, j, i).loss)
 				consumer.TotalDemand += consumer.Demands[i]
 			}
 		}
@@ -191,28 +378,36 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 
 		// Update lambda (price) based on supply-demand difference
 		// Using a dynamic step size that decreases as we get closer to equilibrium
-		stepSize := 0.005 / math.Sqrt(float64(marketState.IterationCount+1))
+		stepSize := config.stepSize(config.PriceStepSize, marketState.IterationCount, marketState.StepScale)
 		producer.Lambda = producer.Lambda - (stepSize * (producer.Production - producerDemands[i]))
 		if producer.Lambda < 0 {
 			producer.Lambda = 0
 		}
 
 		// Update production based on new lambda
-		producer.Production = (producer.Lambda - producer.B) / (2 * producer.A)
+		if hasCostCurve(producer) {
+			producer.Production = producerOutput(producer, producer.Lambda)
+
+			// Keep lambda within the marginal costs at the production limits
+			producer.Lambda = math.Max(producer.Lambda, marginalCost(producer, producer.ProductionMin))
+			producer.Lambda = math.Min(producer.Lambda, marginalCostBelow(producer, producer.ProductionMax))
+		} else {
+			producer.Production = (producer.Lambda - producer.B) / (2 * producer.A)
+		}
 
 		// Apply production constraints
 		if producer.Production < producer.ProductionMin {
 			producer.Production = producer.ProductionMin
 			// Recalculate lambda for constrained production
-			producer.Lambda = 2*producer.A*producer.Production + producer.B
+			producer.Lambda = marginalCost(producer, producer.Production)
 		} else if producer.Production > producer.ProductionMax {
 			producer.Production = producer.ProductionMax
 			// Recalculate lambda for constrained production
-			producer.Lambda = 2*producer.A*producer.Production + producer.B
+			producer.Lambda = marginalCost(producer, producer.Production)
 		}
 
 		// Calculate cost
-		producer.Cost = producer.A*math.Pow(producer.Production, 2) + producer.B*producer.Production
+		producer.Cost = productionCost(producer, producer.Production)
 		totalCost += producer.Cost
 	}
 
@@ -226,6 +421,7 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 	// Step 3: Update consumers (demand side)
 	totalUtility := 0.0
 	totalDemand := 0.0
+	totalLosses := 0.0
 
 	for j := range marketState.Consumers {
 		consumer := &marketState.Consumers[j]
@@ -234,7 +430,7 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 		consumer.TotalDemand = 0
 
 		// Update multipliers with dynamic step size
-		stepSize := 0.0001 / math.Sqrt(float64(marketState.IterationCount+1))
+		stepSize := config.stepSize(config.MultiplierStepSize, marketState.IterationCount, marketState.StepScale)
 
 		// Update lower multiplier (for minimum demand constraint)
 		consumer.UMin = consumer.UMin + (stepSize * (consumer.DemandMin - consumer.TotalDemand))
@@ -249,22 +445,26 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 		}
 
 		// Update demands for each producer
+		utilityModel := utilityOf(consumer)
 		for i := range marketState.Producers {
 			producer := marketState.Producers[i]
 
-			// Calculate new demand
-			demand := (consumer.Beta + consumer.UMin - consumer.UMax - producer.Lambda) / consumer.Theta
+			// Calculate new demand where marginal utility meets the delivered
+			// price adjusted by the multipliers
+			demand := utilityModel.Demand(chargeAt(charges, j, i).deliveredPrice(producer.Lambda) - consumer.UMin + consumer.UMax)
 
 			// Apply demand constraints
 			if demand < 0 {
 				demand = 0
+			} else if math.IsInf(demand, 1) {
+				demand = consumer.DemandMax
 			}
 
 			consumer.Demands[i] = demand
 			consumer.TotalDemand += demand
 
 			// Calculate utility
-			utility := consumer.Beta*demand - 0.5*consumer.Theta*math.Pow(demand, 2)
+			utility := utilityModel.Utility(demand)
 			consumer.Utilities[i] = utility
 			totalUtility += utility
 		}
@@ -276,7 +476,7 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 			for i := range consumer.Demands {
 				consumer.Demands[i] *= scale
 				// Recalculate utility with scaled demand
-				consumer.Utilities[i] = consumer.Beta*consumer.Demands[i] - 0.5*consumer.Theta*math.Pow(consumer.Demands[i], 2)
+				consumer.Utilities[i] = utilityModel.Utility(consumer.Demands[i])
 			}
 			consumer.TotalDemand = consumer.DemandMin
 		} else if consumer.TotalDemand > consumer.DemandMax {
@@ -285,22 +485,26 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 			for i := range consumer.Demands {
 				consumer.Demands[i] *= scale
 				// Recalculate utility with scaled demand
-				consumer.Utilities[i] = consumer.Beta*consumer.Demands[i] - 0.5*consumer.Theta*math.Pow(consumer.Demands[i], 2)
+				consumer.Utilities[i] = utilityModel.Utility(consumer.Demands[i])
 			}
 			consumer.TotalDemand = consumer.DemandMax
 		}
 
 		totalDemand += consumer.TotalDemand
+		for i, demand := range consumer.Demands {
+			totalLosses += demand * chargeAt(charges, j, i).loss
+		}
 	}
 
 	marketState.TotalDemand = totalDemand
+	marketState.TotalLosses = totalLosses
 
 	// Step 4: Calculate social welfare (objective function)
 	marketState.SocialWelfare = totalUtility - totalCost
 
 	// Step 5: Check for convergence
-	convergenceThreshold := 0.00009
-	supplyDemandGap := math.Abs(marketState.TotalGeneration - marketState.TotalDemand)
+	convergenceThreshold := config.PriceTolerance
+	supplyDemandGap := math.Abs(marketState.TotalGeneration - marketState.TotalDemand - marketState.TotalLosses)
 
 	// Check if all lambdas have converged and supply-demand is balanced
 	converged := true
@@ -311,52 +515,31 @@ func (s *EnergyMarket) UpdateMarket(ctx contractapi.TransactionContextInterface)
 		}
 	}
 
-	if supplyDemandGap > 1.0 { // 1 MW tolerance
+	if supplyDemandGap > config.BalanceTolerance {
 		converged = false
 	}
 
-	// If converged, record trades between consumers and producers
-	if converged && !marketState.Converged {
-		err := s.recordOptimizedTrades(ctx, marketState)
-		if err != nil {
-			return fmt.Errorf("failed to record optimized trades: %v", err)
-		}
-	}
-
-	marketState.Converged = converged
-
-	// Step 6: Increment iteration counter
-	marketState.IterationCount++
-
-	// Step 7: Store updated market state
-	marketStateJSON, err := json.Marshal(marketState)
-	if err != nil {
-		return fmt.Errorf("failed to marshal updated market state: %v", err)
-	}
-
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update market state: %v", err)
-	}
-
-	return nil
+	return converged
 }
 
 // Helper function to initialize consumer demands
-func initializeConsumerDemands(marketState *MarketState, producerDemands []float64) {
+func initializeConsumerDemands(marketState *MarketState, producerDemands []float64, charges [][]gridCharge) {
 	for j := range marketState.Consumers {
 		consumer := &marketState.Consumers[j]
 		consumer.TotalDemand = 0
+		utilityModel := utilityOf(consumer)
 
 		// First calculate unconstrained demands
 		for i := range marketState.Producers {
 			producer := marketState.Producers[i]
 			// Calculate initial demand using the utility maximization formula
-			demand := (consumer.Beta - producer.Lambda) / consumer.Theta
+			demand := utilityModel.Demand(chargeAt(charges, j, i).deliveredPrice(producer.Lambda))
 
 			// Apply individual demand constraints
 			if demand < 0 {
 				demand = 0
+			} else if math.IsInf(demand, 1) {
+				demand = consumer.DemandMax
 			}
 
 			consumer.Demands[i] = demand
@@ -384,154 +567,311 @@ func initializeConsumerDemands(marketState *MarketState, producerDemands []float
 		for i := range marketState.Producers {
 			// Calculate utility
 			demand := consumer.Demands[i]
-			consumer.Utilities[i] = consumer.Beta*demand - 0.5*consumer.Theta*math.Pow(demand, 2)
+			consumer.Utilities[i] = utilityModel.Utility(demand)
 
 			// Update total demand for this producer
-			producerDemands[i] += demand
+			producerDemands[i] += demand * (1 + chargeAt(charges, j, i).loss)
 		}
 	}
 }
 
-// RunMarketUntilConvergence runs the market clearing algorithm until convergence
+// RunMarketUntilConvergence runs the market clearing algorithm until convergence.
+// The iterations run on one in-memory state, because a transaction does not
+// see its own writes, and the result is stored once at the end. An empty
+// maxIterations uses the configured maximum.
 func (s *EnergyMarket) RunMarketUntilConvergence(ctx contractapi.TransactionContextInterface, maxIterations string) error {
-	maxIter, err := strconv.Atoi(maxIterations)
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	maxIter, err := parseMaxIterations(maxIterations, config)
 	if err != nil {
-		return fmt.Errorf("invalid maximum iterations: %v", err)
+		return err
+	}
+
+	marketState, err := loadMarketState(ctx)
+	if err != nil {
+		return err
 	}
 
 	for i := 0; i < maxIter; i++ {
 		// Run one iteration
-		err = s.UpdateMarket(ctx)
+		err = s.iterateMarket(ctx, marketState, config)
 		if err != nil {
 			return err
 		}
 
 		// Check for convergence
-		marketState, err := s.GetMarketState(ctx)
-		if err != nil {
-			return err
-		}
-
 		if marketState.Converged {
-			return nil
+			return putMarketState(ctx, marketState)
 		}
 	}
 
 	return fmt.Errorf("market did not converge after %d iterations", maxIter)
 }
 
-// GetMarketResults retrieves the final results of the market clearing
-func (s *EnergyMarket) GetMarketResults(ctx contractapi.TransactionContextInterface) (*MarketState, error) {
-	return s.GetMarketState(ctx)
-}
+// recordOptimizedTrades records trades between consumers and producers based on the market clearing results.
+// The buyer also pays the configured grid tariff: the network fee, which is
+// paid into the DSO's fee account and not to the seller, and the network losses
+// at the producer's price, which are. Every clearing dispatches around the
+// tariff, so consumers only buy what is worth the delivered price to them.
+// The dispatch is a rate in MW held for the given number of hours, so the
+// energy traded is the rate times the hours.
+//
+// Each buyer pays its entry of buyerPrices, the price at its bus, or the
+// seller's price when buyerPrices is nil. The seller is paid its own price,
+// and the difference, the congestion rent, is paid into the fee account; the
+// fee account pays out a negative rent once every buyer has paid.
+//
+// A consumer whose balance cannot pay for all it was dispatched buys the part
+// of it the balance covers, so one short account does not fail the clearing
+// for everyone; its demands on the market state are cut to match, and the
+// producers keep the rest unsold.
+func (s *EnergyMarket) recordOptimizedTrades(ctx contractapi.TransactionContextInterface, marketState *MarketState, config *MarketConfig, buyerPrices []float64, hours float64) ([]Trade, error) {
+	trades := []Trade{}
+	charges := config.gridCharges(marketState)
+	owed := []optimizedTrade{}
 
-// recordOptimizedTrades records trades between consumers and producers based on the market clearing results
-func (s *EnergyMarket) recordOptimizedTrades(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
 	// When the market clearing algorithm converges, record trades between consumers and producers
-	for j, consumer := range marketState.Consumers {
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
 		// Check if this consumer has any energy demand
 		if consumer.TotalDemand <= 0 {
 			continue
 		}
 
-		for i, producer := range marketState.Producers {
-			demand := consumer.Demands[i]
-			if demand > 0 {
-				// Get the owner of this producer
-				sellerID := producer.OwnerID
+		planned, total, err := planOptimizedTrades(marketState, charges, buyerPrices, j, hours)
+		if err != nil {
+			return nil, err
+		}
 
-				// Skip if the consumer is buying from their own producer
-				if sellerID == consumer.ID {
-					continue
-				}
+		// Each trade's value rounds separately, so a cut can still come out a
+		// few micro-units over the balance and is repeated until it does not.
+		// After the last pass the consumer buys nothing.
+		payer := findConsumer(marketState, consumer.account())
+		if payer < 0 {
+			return nil, fmt.Errorf("account %s of consumer %s not found", consumer.account(), consumer.ID)
+		}
+		balance := marketState.Consumers[payer].Balance
+		for pass := 1; total > balance; pass++ {
+			scale := 0.0
+			if pass < maxAffordablePasses {
+				scale = float64(balance) / float64(total) * affordableScale
+			}
+			for _, trade := range planned {
+				consumer.TotalDemand -= consumer.Demands[trade.producer] * (1 - scale)
+				marketState.TotalDemand -= consumer.Demands[trade.producer] * (1 - scale)
+				consumer.Demands[trade.producer] *= scale
+			}
+			planned, total, err = planOptimizedTrades(marketState, charges, buyerPrices, j, hours)
+			if err != nil {
+				return nil, err
+			}
+		}
 
-				// Create a trade for each non-zero demand
-				err := s.recordTrade(ctx, consumer.ID, sellerID, producer.ID, producer.Lambda, demand)
-				if err != nil {
-					return fmt.Errorf("failed to record optimized trade: %v", err)
-				}
-				
-				// Update consumer balance
-				marketState.Consumers[j].Balance -= producer.Lambda * demand
-
-				// Find the seller index and update their balance
-				for k, seller := range marketState.Consumers {
-					if seller.ID == sellerID {
-						marketState.Consumers[k].Balance += producer.Lambda * demand
-						break
-					}
+		for _, line := range planned {
+			producer := marketState.Producers[line.producer]
+
+			// Create a trade for each non-zero demand
+			trade, err := s.recordTrade(ctx, marketState, consumer.account(), line.sellerID, producer.ID, line.price, line.quantity, line.value, line.network)
+			if err != nil {
+				return nil, fmt.Errorf("failed to record optimized trade: %v", err)
+			}
+			trades = append(trades, *trade)
+
+			// Pay the seller in credits and the network fee and congestion
+			// rent to the DSO
+			rent := line.network.congestionRent
+			if rent != 0 && config.FeeAccountID == "" {
+				return nil, fmt.Errorf("a congestion rent needs a fee account to be paid into")
+			}
+			fee := line.network.networkFee
+			if rent > 0 {
+				fee += rent
+			} else if rent < 0 {
+				owed = append(owed, line)
+			}
+			if err := transferCredits(marketState, consumer.account(), line.sellerID, line.value-fee); err != nil {
+				return nil, err
+			}
+			if fee > 0 {
+				if err := transferCredits(marketState, consumer.account(), config.FeeAccountID, fee); err != nil {
+					return nil, err
 				}
 			}
 		}
 	}
-	return nil
+
+	for _, line := range owed {
+		if err := transferCredits(marketState, config.FeeAccountID, line.sellerID, -line.network.congestionRent); err != nil {
+			return nil, fmt.Errorf("failed to pay out the congestion rent: %v", err)
+		}
+	}
+	return trades, nil
 }
 
-// recordTrade records a completed trade in the ledger
-func (s *EnergyMarket) recordTrade(ctx contractapi.TransactionContextInterface, buyerID string, sellerID string, producerID string, price float64, quantity float64) error {
-	marketState, err := s.GetMarketState(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to get market state: %v", err)
+// Cutting a dispatch the buyer cannot afford aims just below its balance and
+// gives up after a few passes
+const (
+	affordableScale     = 0.999999
+	maxAffordablePasses = 4
+)
+
+// optimizedTrade is a trade of a cleared dispatch before it is recorded
+type optimizedTrade struct {
+	producer int
+	sellerID string
+	price    Amount
+	quantity Energy
+	value    Amount
+	network  tradeCharges
+}
+
+// planOptimizedTrades prices consumer j's cleared demand from each producer it
+// does not own at the buyer's price and returns the trades with their total
+// value
+func planOptimizedTrades(marketState *MarketState, charges [][]gridCharge, buyerPrices []float64, j int, hours float64) ([]optimizedTrade, Amount, error) {
+	consumer := &marketState.Consumers[j]
+	planned := []optimizedTrade{}
+	var total Amount
+
+	for i, producer := range marketState.Producers {
+		demand := consumer.Demands[i]
+		if demand <= 0 {
+			continue
+		}
+
+		// Get the owner of this producer
+		sellerID := producer.OwnerID
+
+		// Skip if the consumer is buying from their own producer
+		if sellerID == consumer.account() {
+			continue
+		}
+
+		// The clearing result is in floating point, settlement is in fixed point
+		sellerPrice, err := toAmount(producer.Lambda)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid clearing price for producer %s: %v", producer.ID, err)
+		}
+		price := sellerPrice
+		if buyerPrices != nil {
+			if price, err = toAmount(buyerPrices[j]); err != nil {
+				return nil, 0, fmt.Errorf("invalid bus price for consumer %s: %v", consumer.ID, err)
+			}
+		}
+		quantity, err := toEnergy(demand * hours)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid demand of consumer %s: %v", consumer.ID, err)
+		}
+		if quantity == 0 {
+			continue
+		}
+		charge := chargeAt(charges, j, i)
+		lossQuantity, err := toEnergy(demand * hours * charge.loss)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid network losses of consumer %s: %v", consumer.ID, err)
+		}
+		fee, err := toAmount(charge.fee)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid network fee of consumer %s: %v", consumer.ID, err)
+		}
+		network := tradeCharges{
+			networkFee:   valueOf(fee, quantity),
+			lossCharge:   valueOf(price, lossQuantity),
+			lossQuantity: lossQuantity,
+		}
+		value := valueOf(price, quantity) + network.lossCharge + network.networkFee
+		network.congestionRent = value - network.networkFee - valueOf(sellerPrice, quantity) - valueOf(sellerPrice, lossQuantity)
+
+		planned = append(planned, optimizedTrade{producer: i, sellerID: sellerID, price: price, quantity: quantity, value: value, network: network})
+		if total > maxAmount-value {
+			total = maxAmount
+		} else {
+			total += value
+		}
 	}
+	return planned, total, nil
+}
 
-	// Create trade record with timestamp and trade count
-	trade := Trade{
-		ID:         fmt.Sprintf("TRADE_%d_%s", marketState.Statistics.TradeCount+1, time.Now().Format("20060102150405")),
-		BuyerID:    buyerID,
-		SellerID:   sellerID,
-		ProducerID: producerID,
-		Price:      price,
-		Quantity:   quantity,
-		TotalValue: price * quantity,
-		Timestamp:  time.Now().Format(time.RFC3339),
+// account returns the ID of the account that pays for a consumer's trades
+func (consumer *Consumer) account() string {
+	if consumer.accountID != "" {
+		return consumer.accountID
 	}
+	return consumer.ID
+}
 
-	// Update producer's traded volume
-	for i := range marketState.Producers {
-		if marketState.Producers[i].ID == producerID {
-			marketState.Producers[i].TradedVolume += quantity
-			break
-		}
+// recordTrade records a completed trade in the ledger together with its
+// statistics delta. The producer volume is updated on the given market state,
+// which the caller must store afterwards: Fabric does not let a transaction
+// read its own writes, so re-reading the producer here would lose the updates
+// of earlier trades. The value is what the buyer actually paid, which can
+// differ from valueOf(price, quantity) by the rounding left on a final fill,
+// and which includes the network charges of a cleared trade.
+func (s *EnergyMarket) recordTrade(ctx contractapi.TransactionContextInterface, marketState *MarketState, buyerID string, sellerID string, producerID string, price Amount, quantity Energy, value Amount, network tradeCharges) (*Trade, error) {
+	// Both the ID and the timestamp come from the transaction itself, so every
+	// endorsing peer produces the same trade record
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
 	}
 
-	// Update consumer's total demand
-	for i := range marketState.Consumers {
-		if marketState.Consumers[i].ID == buyerID {
-			marketState.Consumers[i].TotalDemand += quantity
+	// Create trade record with timestamp, transaction ID and the trade's
+	// sequence number within the transaction
+	trade := Trade{
+		ID:             fmt.Sprintf("TRADE_%s_%s_%d", timestamp.Format("20060102150405"), ctx.GetStub().GetTxID(), marketState.Statistics.TradeCount+1),
+		BuyerID:        buyerID,
+		SellerID:       sellerID,
+		ProducerID:     producerID,
+		Price:          price,
+		Quantity:       quantity,
+		TotalValue:     value,
+		NetworkFee:     network.networkFee,
+		LossCharge:     network.lossCharge,
+		LossQuantity:   network.lossQuantity,
+		CongestionRent: network.congestionRent,
+		Timestamp:      timestamp.Format(time.RFC3339),
+	}
+
+	// Update producer's traded volume, which includes the losses it covered
+	for i := range marketState.Producers {
+		if marketState.Producers[i].ID == producerID {
+			marketState.Producers[i].TradedVolume += quantity + network.lossQuantity
 			break
 		}
 	}
 
 	// Update market statistics
-	marketState.Statistics.TradeCount++
-	marketState.Statistics.Volume24h += trade.TotalValue
-
-	// Save the updated market state
-	marketStateJSON, err := json.Marshal(marketState)
-	if err != nil {
-		return fmt.Errorf("failed to marshal market state: %v", err)
-	}
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update market state: %v", err)
+	delta := MarketStatistics{TradeCount: 1, Volume24h: trade.TotalValue}
+	marketState.Statistics.TradeCount += delta.TradeCount
+	marketState.Statistics.Volume24h += delta.Volume24h
+	if err := putStatsDelta(ctx, trade.ID, delta); err != nil {
+		return nil, err
 	}
 
 	// Save the trade record
 	tradeJSON, err := json.Marshal(trade)
 	if err != nil {
-		return fmt.Errorf("failed to marshal trade: %v", err)
+		return nil, fmt.Errorf("failed to marshal trade: %v", err)
 	}
 	err = ctx.GetStub().PutState(trade.ID, tradeJSON)
 	if err != nil {
-		return fmt.Errorf("failed to save trade: %v", err)
+		return nil, fmt.Errorf("failed to save trade: %v", err)
 	}
 
-	return nil
+	return &trade, nil
 }
 
 // GetOrderBook, GetTradeHistory, and GetCurrentPrice remain largely the same,
 // though you may add additional fields to the returned objects if desired.
 func (s *EnergyMarket) GetOrderBook(ctx contractapi.TransactionContextInterface) (map[string][]Order, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	orderIterator, err := ctx.GetStub().GetStateByRange("ORDER_", "ORDER_~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get orders: %v", err)
@@ -552,17 +892,34 @@ func (s *EnergyMarket) GetOrderBook(ctx contractapi.TransactionContextInterface)
 		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal order: %v", err)
 		}
+		// Market, IOC and FOK orders execute on arrival and never rest
+		if !isRestingOrder(&order) {
+			continue
+		}
+		// Expired orders wait for PurgeExpiredOrders to release their escrow
+		if orderExpired(&order, now) {
+			continue
+		}
 		if order.OrderType == "buy" {
 			orderBook["buy"] = append(orderBook["buy"], order)
 		} else if order.OrderType == "sell" {
 			orderBook["sell"] = append(orderBook["sell"], order)
 		}
 	}
+	// Price-time priority: best price first, then oldest order first
 	sort.Slice(orderBook["buy"], func(i, j int) bool {
-		return orderBook["buy"][i].Price > orderBook["buy"][j].Price
+		a, b := orderBook["buy"][i], orderBook["buy"][j]
+		if a.Price != b.Price {
+			return a.Price > b.Price
+		}
+		return placedBefore(a, b)
 	})
 	sort.Slice(orderBook["sell"], func(i, j int) bool {
-		return orderBook["sell"][i].Price < orderBook["sell"][j].Price
+		a, b := orderBook["sell"][i], orderBook["sell"][j]
+		if a.Price != b.Price {
+			return a.Price < b.Price
+		}
+		return placedBefore(a, b)
 	})
 	return orderBook, nil
 }
@@ -588,7 +945,10 @@ func (s *EnergyMarket) GetTradeHistory(ctx contractapi.TransactionContextInterfa
 		trades = append(trades, trade)
 	}
 	sort.Slice(trades, func(i, j int) bool {
-		return trades[i].Timestamp > trades[j].Timestamp
+		if trades[i].Timestamp != trades[j].Timestamp {
+			return trades[i].Timestamp > trades[j].Timestamp
+		}
+		return trades[i].ID > trades[j].ID
 	})
 	return trades, nil
 }
@@ -607,8 +967,12 @@ func (s *EnergyMarket) GetCurrentPrice(ctx contractapi.TransactionContextInterfa
 	latestTrade := trades[0]
 	currentPrice := latestTrade.Price
 
-	oneDayAgo := time.Now().Add(-24 * time.Hour)
-	var oldPrice float64
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	oneDayAgo := now.Add(-24 * time.Hour)
+	var oldPrice Amount
 	var priceChange float64
 	for i := len(trades) - 1; i >= 0; i-- {
 		tradeTime, err := time.Parse(time.RFC3339, trades[i].Timestamp)
@@ -621,7 +985,7 @@ func (s *EnergyMarket) GetCurrentPrice(ctx contractapi.TransactionContextInterfa
 		}
 	}
 	if oldPrice != 0 {
-		priceChange = ((currentPrice - oldPrice) / oldPrice) * 100
+		priceChange = (float64(currentPrice-oldPrice) / float64(oldPrice)) * 100
 	}
 	return map[string]interface{}{
 		"currentPrice": currentPrice,
@@ -629,26 +993,28 @@ func (s *EnergyMarket) GetCurrentPrice(ctx contractapi.TransactionContextInterfa
 	}, nil
 }
 
-//EXTRA FUNCTIONS 
+//EXTRA FUNCTIONS
 
-//GetUserBalance retrieves a user's current balance
-func (s *EnergyMarket) GetUserBalance(ctx contractapi.TransactionContextInterface, userID string) (float64, error) {
-	marketState, err := s.GetMarketState(ctx)
-	if err != nil {
+// GetUserBalance retrieves a user's current balance
+func (s *EnergyMarket) GetUserBalance(ctx contractapi.TransactionContextInterface, userID string) (Amount, error) {
+	if err := assertCanRead(ctx, userID); err != nil {
 		return 0, err
 	}
 
-	for _, consumer := range marketState.Consumers {
-		if consumer.ID == userID {
-			return consumer.Balance, nil
-		}
+	consumer, err := getConsumer(ctx, userID)
+	if err != nil {
+		return 0, err
 	}
 
-	return 0, fmt.Errorf("user %s not found", userID)
+	return consumer.Balance, nil
 }
 
 // GetUserTrades retrieves trades for a specific user
 func (s *EnergyMarket) GetUserTrades(ctx contractapi.TransactionContextInterface, userID string) ([]Trade, error) {
+	if err := assertCanRead(ctx, userID); err != nil {
+		return nil, err
+	}
+
 	tradeIterator, err := ctx.GetStub().GetStateByRange("TRADE_", "TRADE_~")
 	if err != nil {
 		return nil, fmt.Errorf("failed to get trades: %v", err)
@@ -676,109 +1042,143 @@ func (s *EnergyMarket) GetUserTrades(ctx contractapi.TransactionContextInterface
 
 	// Sort trades by timestamp (newest first)
 	sort.Slice(userTrades, func(i, j int) bool {
-		return userTrades[i].Timestamp > userTrades[j].Timestamp
+		if userTrades[i].Timestamp != userTrades[j].Timestamp {
+			return userTrades[i].Timestamp > userTrades[j].Timestamp
+		}
+		return userTrades[i].ID > userTrades[j].ID
 	})
 
 	return userTrades, nil
 }
 
-// GetProducerDetails retrieves details for a specific producer
+// GetProducerDetails retrieves details for a specific producer. Its cost
+// parameters are only returned to its owner, operators and auditors, from a
+// peer of the owner's organisation.
 func (s *EnergyMarket) GetProducerDetails(ctx contractapi.TransactionContextInterface, producerID string) (*Producer, error) {
-	marketState, err := s.GetMarketState(ctx)
+	producer, err := getProducerProfile(ctx, producerID)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, producer := range marketState.Producers {
-		if producer.ID == producerID {
-			return &producer, nil
-		}
+	marketState := &MarketState{Producers: []Producer{*producer}}
+	if err := loadVisibleDetails(ctx, marketState); err != nil {
+		return nil, err
 	}
-
-	return nil, fmt.Errorf("producer %s not found", producerID)
+	redactMarketState(ctx, marketState)
+	return &marketState.Producers[0], nil
 }
 
-// TransferProducerOwnership transfers ownership of a producer to another consumer
+// TransferProducerOwnership transfers ownership of a producer to another
+// consumer. The current owner's sell orders for the producer are cancelled
+// and their capacity released, so fills after the transfer cannot pay the
+// previous owner for the new owner's energy. The producer's private details
+// and day-ahead offers move to the new owner's collection.
 func (s *EnergyMarket) TransferProducerOwnership(ctx contractapi.TransactionContextInterface, producerID string, currentOwnerID string, newOwnerID string) error {
-	marketState, err := s.GetMarketState(ctx)
-	if err != nil {
+	if err := assertCaller(ctx, currentOwnerID); err != nil {
 		return err
 	}
 
 	// Validate current owner
-	var producerFound bool
-	var producerIndex int
-	for i, producer := range marketState.Producers {
-		if producer.ID == producerID {
-			producerFound = true
-			producerIndex = i
-			if producer.OwnerID != currentOwnerID {
-				return fmt.Errorf("user %s is not the current owner of producer %s", currentOwnerID, producerID)
-			}
-			break
-		}
+	producer, err := getProducer(ctx, producerID)
+	if err != nil {
+		return err
 	}
-
-	if !producerFound {
-		return fmt.Errorf("producer %s not found", producerID)
+	if producer.OwnerID != currentOwnerID {
+		return fmt.Errorf("user %s is not the current owner of producer %s", currentOwnerID, producerID)
 	}
 
 	// Validate new owner
-	var newOwnerFound bool
-	var newOwnerIndex int
-	var currentOwnerIndex int
-	for i, consumer := range marketState.Consumers {
-		if consumer.ID == newOwnerID {
-			newOwnerFound = true
-			newOwnerIndex = i
+	newOwner, err := readConsumerProfile(ctx, newOwnerID)
+	if err != nil {
+		return err
+	}
+	if newOwner == nil {
+		return fmt.Errorf("new owner %s not found", newOwnerID)
+	}
+
+	currentOwner, err := getConsumerProfile(ctx, currentOwnerID)
+	if err != nil {
+		return err
+	}
+
+	var schedule ProducerSchedule
+	hasSchedule, err := getPrivateObject(ctx, producer.MSPID, offerObjectType, producerID, &schedule)
+	if err != nil {
+		return err
+	}
+
+	// Cancel the sell orders placed under the current owner
+	orderIterator, err := ctx.GetStub().GetStateByRange("ORDER_", "ORDER_~")
+	if err != nil {
+		return fmt.Errorf("failed to get orders: %v", err)
+	}
+	defer orderIterator.Close()
+
+	for orderIterator.HasNext() {
+		queryResponse, err := orderIterator.Next()
+		if err != nil {
+			return fmt.Errorf("error iterating orders: %v", err)
+		}
+		var order Order
+		err = json.Unmarshal(queryResponse.Value, &order)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal order: %v", err)
+		}
+		if order.OrderType != "sell" || order.ProducerID != producerID {
+			continue
 		}
-		if consumer.ID == currentOwnerID {
-			currentOwnerIndex = i
+		producer.CommittedCapacity -= order.Quantity
+		if err := deleteOrder(ctx, &order); err != nil {
+			return err
 		}
 	}
 
-	if !newOwnerFound {
-		return fmt.Errorf("new owner %s not found", newOwnerID)
+	// Update producer ownership, moving its private records to the new
+	// owner's organisation
+	if newOwner.MSPID != producer.MSPID {
+		for _, objectType := range producerPrivateTypes {
+			if err := deletePrivateObject(ctx, producer.MSPID, objectType, producerID); err != nil {
+				return err
+			}
+		}
+	}
+	producer.OwnerID = newOwnerID
+	producer.MSPID = newOwner.MSPID
+	if err := putProducerDetails(ctx, producer); err != nil {
+		return err
+	}
+	if hasSchedule {
+		if err := putPrivateObject(ctx, producer.MSPID, offerObjectType, producerID, schedule); err != nil {
+			return err
+		}
 	}
-
-	// Update producer ownership
-	marketState.Producers[producerIndex].OwnerID = newOwnerID
 
 	// Update consumer producer lists
 	// Remove from current owner
-	for i, id := range marketState.Consumers[currentOwnerIndex].ProducerIDs {
+	for i, id := range currentOwner.ProducerIDs {
 		if id == producerID {
-			marketState.Consumers[currentOwnerIndex].ProducerIDs = append(
-				marketState.Consumers[currentOwnerIndex].ProducerIDs[:i],
-				marketState.Consumers[currentOwnerIndex].ProducerIDs[i+1:]...
-			)
+			currentOwner.ProducerIDs = append(currentOwner.ProducerIDs[:i], currentOwner.ProducerIDs[i+1:]...)
 			break
 		}
 	}
 
 	// Add to new owner
-	marketState.Consumers[newOwnerIndex].ProducerIDs = append(
-		marketState.Consumers[newOwnerIndex].ProducerIDs,
-		producerID,
-	)
+	newOwner.ProducerIDs = append(newOwner.ProducerIDs, producerID)
 
-	// Save updated market state
-	marketStateJSON, err := json.Marshal(marketState)
-	if err != nil {
-		return fmt.Errorf("failed to marshal market state: %v", err)
+	// Save the producer and both owners
+	if err := putProducer(ctx, producer); err != nil {
+		return err
 	}
-
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
-	if err != nil {
-		return fmt.Errorf("failed to update market state: %v", err)
+	if err := putConsumer(ctx, currentOwner); err != nil {
+		return err
 	}
 
-	return nil
+	return putConsumer(ctx, newOwner)
 }
 
 // GetMarketStatistics retrieves various statistics about the market
 func (s *EnergyMarket) GetMarketStatistics(ctx contractapi.TransactionContextInterface) (map[string]interface{}, error) {
-	marketState, err := s.GetMarketState(ctx)
+	marketState, err := loadMarketProfiles(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -789,7 +1189,11 @@ func (s *EnergyMarket) GetMarketStatistics(ctx contractapi.TransactionContextInt
 	}
 
 	// Calculate trade count in the last 24 hours
-	oneDayAgo := time.Now().Add(-24 * time.Hour)
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	oneDayAgo := now.Add(-24 * time.Hour)
 	var tradeCount24h int
 
 	for _, trade := range trades {
@@ -803,7 +1207,7 @@ func (s *EnergyMarket) GetMarketStatistics(ctx contractapi.TransactionContextInt
 	}
 
 	// Calculate average price in the last 24 hours
-	var totalPrice24h float64
+	var totalPrice24h Amount
 	for _, trade := range trades {
 		tradeTime, err := time.Parse(time.RFC3339, trade.Timestamp)
 		if err != nil {
@@ -814,9 +1218,9 @@ func (s *EnergyMarket) GetMarketStatistics(ctx contractapi.TransactionContextInt
 		}
 	}
 
-	var avgPrice24h float64
+	var avgPrice24h Amount
 	if tradeCount24h > 0 {
-		avgPrice24h = totalPrice24h / float64(tradeCount24h)
+		avgPrice24h = totalPrice24h / Amount(tradeCount24h)
 	}
 
 	// Get current price
@@ -831,7 +1235,7 @@ func (s *EnergyMarket) GetMarketStatistics(ctx contractapi.TransactionContextInt
 		return nil, err
 	}
 
-	var totalBuyVolume, totalSellVolume float64
+	var totalBuyVolume, totalSellVolume Energy
 	for _, order := range orderBook["buy"] {
 		totalBuyVolume += order.Quantity
 	}
@@ -875,125 +1279,211 @@ func (s *EnergyMarket) GetRecentTrades(ctx contractapi.TransactionContextInterfa
 	return trades, nil
 }
 
-// CreateConsumer creates a new consumer in the market
-func (s *EnergyMarket) CreateConsumer(ctx contractapi.TransactionContextInterface, id string, beta float64, theta float64, demandMin float64, demandMax float64, initialBalance float64) error {
-	marketState, err := s.GetMarketState(ctx)
+// CreateConsumer creates a new consumer in the market. Beta and Theta are
+// private and passed as transient data under "consumer", as
+// {"beta": ..., "theta": ...}. The consumer's account starts without
+// credits until an operator mints some, and is salted with random bytes
+// passed as transient data under "salt".
+func (s *EnergyMarket) CreateConsumer(ctx contractapi.TransactionContextInterface, id string, demandMin float64, demandMax float64) error {
+	input, err := getConsumerInput(ctx)
 	if err != nil {
 		return err
 	}
-
-	// Check if consumer ID already exists
-	for _, consumer := range marketState.Consumers {
-		if consumer.ID == id {
-			return fmt.Errorf("consumer with ID %s already exists", id)
-		}
+	if len(input.UtilityCurve) > 0 || len(input.DemandBlocks) > 0 {
+		return fmt.Errorf("use CreateConsumerWithUtility for a utility curve or demand blocks")
 	}
 
 	// Create new consumer
 	newConsumer := Consumer{
-		ID:          id,
-		Beta:        beta,
-		Theta:       theta,
-		DemandMin:   demandMin,
-		DemandMax:   demandMax,
-		UMin:        0,
-		UMax:        0,
-		Demands:     make([]float64, len(marketState.Producers)),
-		Utilities:   make([]float64, len(marketState.Producers)),
-		TotalDemand: 0,
-		Balance:     initialBalance,
-		ProducerIDs: []string{},
+		ID:           id,
+		UtilityModel: UtilityQuadratic,
+		Beta:         input.Beta,
+		Theta:        input.Theta,
+		DemandMin:    demandMin,
+		DemandMax:    demandMax,
+	}
+	if err := validateUtility(&newConsumer); err != nil {
+		return err
 	}
 
-	// Add new consumer to market state
-	marketState.Consumers = append(marketState.Consumers, newConsumer)
+	return s.addConsumer(ctx, newConsumer)
+}
 
-	// Save updated market state
-	marketStateJSON, err := json.Marshal(marketState)
-	if err != nil {
-		return fmt.Errorf("failed to marshal market state: %v", err)
+// addConsumer adds a new consumer to the market with an empty token account.
+// The caller must be registered to the new consumer's ID, and the consumer's
+// private details and balance are kept in the caller's organisation.
+func (s *EnergyMarket) addConsumer(ctx contractapi.TransactionContextInterface, newConsumer Consumer) error {
+	if err := assertCaller(ctx, newConsumer.ID); err != nil {
+		return err
 	}
+	if _, err := getMarketHeader(ctx); err != nil {
+		return err
+	}
+	id := newConsumer.ID
 
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
+	// Check if consumer ID already exists
+	existing, err := readConsumerProfile(ctx, id)
 	if err != nil {
-		return fmt.Errorf("failed to update market state: %v", err)
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("consumer with ID %s already exists", id)
 	}
 
-	return nil
-}
+	// A storage unit charges under its own ID as a consumer in the day-ahead market
+	storage, err := readStorage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if storage != nil {
+		return fmt.Errorf("storage with ID %s already exists", id)
+	}
 
-// CreateProducer creates a new producer in the market
-func (s *EnergyMarket) CreateProducer(ctx contractapi.TransactionContextInterface, id string, a float64, b float64, productionMin float64, productionMax float64, ownerID string) error {
-	marketState, err := s.GetMarketState(ctx)
+	// Demands and utilities hold one entry per producer
+	producerCount := 0
+	err = scanObjects(ctx, producerObjectType, func(value []byte) error {
+		producerCount++
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	// Check if producer ID already exists
-	for _, producer := range marketState.Producers {
-		if producer.ID == id {
-			return fmt.Errorf("producer with ID %s already exists", id)
-		}
+	newConsumer.UMin = 0
+	newConsumer.UMax = 0
+	newConsumer.Demands = make([]float64, producerCount)
+	newConsumer.Utilities = make([]float64, producerCount)
+	newConsumer.TotalDemand = 0
+	newConsumer.Balance = 0
+	newConsumer.EscrowBalance = 0
+	newConsumer.LockedBalance = 0
+	newConsumer.ProducerIDs = []string{}
+	newConsumer.MSPID, err = ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	newConsumer.accountSalt, err = newSalt(ctx, accountObjectType, id)
+	if err != nil {
+		return err
 	}
 
-	// Validate owner
-	var ownerExists bool
-	var ownerIndex int
-	for i, consumer := range marketState.Consumers {
-		if consumer.ID == ownerID {
-			ownerExists = true
-			ownerIndex = i
-			break
-		}
+	// Save the consumer profile, its private details and its balance
+	if err := putConsumer(ctx, &newConsumer); err != nil {
+		return err
+	}
+	if err := putConsumerDetails(ctx, &newConsumer); err != nil {
+		return err
 	}
 
-	if !ownerExists {
-		return fmt.Errorf("owner %s not found", ownerID)
+	return putAccount(ctx, &newConsumer)
+}
+
+// CreateProducer creates a new producer in the market. Its cost coefficients
+// are private and passed as transient data under "producer", as
+// {"a": ..., "b": ...}. The quadratic coefficient must be positive so the
+// producer has a rising marginal cost, and 0 <= productionMin <= productionMax.
+func (s *EnergyMarket) CreateProducer(ctx contractapi.TransactionContextInterface, id string, productionMin float64, productionMax float64, ownerID string) error {
+	var details ProducerPrivate
+	if err := getTransient(ctx, producerTransientKey, &details); err != nil {
+		return err
+	}
+	if hasCostCurve(&Producer{CostCurve: details.CostCurve, OfferBlocks: details.OfferBlocks}) {
+		return fmt.Errorf("use CreateProducerWithCurve for a cost curve or block offers")
+	}
+	if !(details.A > 0) || math.IsInf(details.A, 0) {
+		return fmt.Errorf("producer %s must have a positive quadratic cost coefficient", id)
+	}
+	if math.IsNaN(details.B) || math.IsInf(details.B, 0) {
+		return fmt.Errorf("producer %s has an invalid linear cost coefficient", id)
+	}
+	if !(productionMin >= 0) || !(productionMax >= productionMin) || math.IsInf(productionMax, 0) {
+		return fmt.Errorf("producer %s has invalid production limits", id)
 	}
 
 	// Create new producer
 	newProducer := Producer{
 		ID:            id,
-		A:             a,
-		B:             b,
+		A:             details.A,
+		B:             details.B,
 		ProductionMin: productionMin,
 		ProductionMax: productionMax,
-		Production:    productionMin,
-		Lambda:        2*a*productionMin + b,
-		Cost:          a*math.Pow(productionMin, 2) + b*productionMin,
 		OwnerID:       ownerID,
 		TradedVolume:  0,
 	}
 
-	// Add new producer to market state
-	marketState.Producers = append(marketState.Producers, newProducer)
-
-	// Update owner's producer list
-	marketState.Consumers[ownerIndex].ProducerIDs = append(marketState.Consumers[ownerIndex].ProducerIDs, id)
+	return s.addProducer(ctx, newProducer)
+}
 
-	// Update demands and utilities arrays for all consumers
-	for i := range marketState.Consumers {
-		marketState.Consumers[i].Demands = append(marketState.Consumers[i].Demands, 0)
-		marketState.Consumers[i].Utilities = append(marketState.Consumers[i].Utilities, 0)
+// addProducer adds a new producer to the market, starting it at its minimum
+// output and the marginal cost there under whichever cost curve it uses. The
+// caller must act for the producer's owner, whose organisation keeps its
+// private details.
+func (s *EnergyMarket) addProducer(ctx contractapi.TransactionContextInterface, newProducer Producer) error {
+	if err := assertCaller(ctx, newProducer.OwnerID); err != nil {
+		return err
 	}
 
-	// Save updated market state
-	marketStateJSON, err := json.Marshal(marketState)
+	marketState, err := loadMarketProfiles(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal market state: %v", err)
+		return err
 	}
+	id := newProducer.ID
 
-	err = ctx.GetStub().PutState("MarketState", marketStateJSON)
+	// Check if producer ID already exists
+	if findProducer(marketState, id) >= 0 {
+		return fmt.Errorf("producer with ID %s already exists", id)
+	}
+
+	// A storage unit discharges under its own ID as a producer in the day-ahead market
+	storage, err := readStorage(ctx, id)
 	if err != nil {
-		return fmt.Errorf("failed to update market state: %v", err)
+		return err
+	}
+	if storage != nil {
+		return fmt.Errorf("storage with ID %s already exists", id)
 	}
 
-	return nil
+	// Validate owner
+	ownerIndex := findConsumer(marketState, newProducer.OwnerID)
+	if ownerIndex < 0 {
+		return fmt.Errorf("owner %s not found", newProducer.OwnerID)
+	}
+
+	newProducer.MSPID = marketState.Consumers[ownerIndex].MSPID
+	newProducer.Production = newProducer.ProductionMin
+	newProducer.Lambda = marginalCost(&newProducer, newProducer.ProductionMin)
+	newProducer.Cost = productionCost(&newProducer, newProducer.ProductionMin)
+
+	// Update owner's producer list
+	marketState.Consumers[ownerIndex].ProducerIDs = append(marketState.Consumers[ownerIndex].ProducerIDs, id)
+
+	// Producers are stored in ID order, so the new producer's demand entries
+	// go in at its sorted position for all consumers. Their private utilities
+	// are realigned when they are next read.
+	position := sort.Search(len(marketState.Producers), func(i int) bool {
+		return marketState.Producers[i].ID > id
+	})
+	for i := range marketState.Consumers {
+		consumer := &marketState.Consumers[i]
+		consumer.Demands = append(consumer.Demands[:position], append([]float64{0}, consumer.Demands[position:]...)...)
+		if err := putConsumer(ctx, consumer); err != nil {
+			return err
+		}
+	}
+
+	if err := putProducer(ctx, &newProducer); err != nil {
+		return err
+	}
+	return putProducerDetails(ctx, &newProducer)
 }
 
 // Main function to start the chaincode
 func main() {
-	chaincode, err := contractapi.NewChaincode(&EnergyMarket{})
+	// Roles are enforced for every transaction before it runs
+	market := &EnergyMarket{}
+	market.BeforeTransaction = authorizeTransaction
+
+	chaincode, err := contractapi.NewChaincode(market)
 	if err != nil {
 		fmt.Printf("Error creating energy market chaincode: %s", err.Error())
 		return
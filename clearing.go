@@ -0,0 +1,489 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// maxBisectionSteps bounds the bisection on the clearing price. Each step
+// halves the bracket, so this is far more than float64 precision needs.
+const maxBisectionSteps = 200
+
+// ClearedInterval records a settlement interval ClearMarketExact has
+// settled, so that clearing the same book again cannot bill it twice
+type ClearedInterval struct {
+	IntervalID    string `json:"intervalId"`
+	Method        string `json:"method"`        // Clearing that settled the interval
+	ConfigVersion int    `json:"configVersion"` // Version of the MarketConfig the clearing ran with
+	ClearedAt     string `json:"clearedAt"`     // When the interval was cleared
+}
+
+// ClearingComparison compares the exact clearing solution with the result of
+// the subgradient iteration run from the same starting point
+type ClearingComparison struct {
+	ExactPrice          float64   `json:"exactPrice"`          // Uniform clearing price of the exact solution
+	ExactGeneration     float64   `json:"exactGeneration"`     // Total generation of the exact solution
+	ExactDemand         float64   `json:"exactDemand"`         // Total demand of the exact solution
+	ExactWelfare        float64   `json:"exactWelfare"`        // Social welfare of the exact solution
+	IterativePrices     []float64 `json:"iterativePrices"`     // Producer lambdas after the iteration, in producer order
+	IterativeGeneration float64   `json:"iterativeGeneration"` // Total generation after the iteration
+	IterativeDemand     float64   `json:"iterativeDemand"`     // Total demand after the iteration
+	IterativeWelfare    float64   `json:"iterativeWelfare"`    // Social welfare after the iteration
+	Iterations          int       `json:"iterations"`          // Iterations run
+	ConfigVersion       int       `json:"configVersion"`       // Version of the MarketConfig the iteration ran with
+	IterativeConverged  bool      `json:"iterativeConverged"`  // Whether the iteration met its convergence test
+	MaxProductionGap    float64   `json:"maxProductionGap"`    // Largest difference in producer output between the two
+	WelfareGap          float64   `json:"welfareGap"`          // Exact welfare minus iterative welfare
+}
+
+// ClearMarketExact clears the market in a single call by solving the
+// equilibrium directly instead of iterating. Every producer's output is a
+// non-decreasing function of the price, whatever its cost curve, and every
+// consumer's total demand a non-increasing one, whatever its utility model,
+// so the excess supply is monotone in the price and the clearing price is
+// found by bisection. The result is written to the same MarketState fields as
+// UpdateMarket, and the optimized trades are recorded at the clearing price.
+// Each call settles one settlement interval, which can be cleared only once.
+func (s *EnergyMarket) ClearMarketExact(ctx contractapi.TransactionContextInterface, intervalID string) error {
+	if err := assertIntervalNotCleared(ctx, intervalID); err != nil {
+		return err
+	}
+
+	marketState, err := loadMarketState(ctx)
+	if err != nil {
+		return err
+	}
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Every interval is a new clearing and settles its own trades, whether
+	// or not the previous one converged
+	marketState.Converged = false
+	_, err = solveExactClearing(marketState, config.gridCharges(marketState))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.recordOptimizedTrades(ctx, marketState, config, nil, 1)
+	if err != nil {
+		return fmt.Errorf("failed to record optimized trades: %v", err)
+	}
+
+	marketState.Converged = true
+	marketState.IterationCount++
+	marketState.ConfigVersion = config.Version
+
+	if err := putClearedInterval(ctx, intervalID, "exact", config.Version); err != nil {
+		return err
+	}
+	return putMarketState(ctx, marketState)
+}
+
+// assertIntervalNotCleared fails unless a settlement interval is named and
+// has not been cleared yet
+func assertIntervalNotCleared(ctx contractapi.TransactionContextInterface, intervalID string) error {
+	if intervalID == "" {
+		return fmt.Errorf("interval ID is required")
+	}
+
+	var existing ClearedInterval
+	found, err := getObject(ctx, clearedIntervalType, intervalID, &existing)
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("interval %s has already been cleared by the %s clearing", intervalID, existing.Method)
+	}
+	return nil
+}
+
+// putClearedInterval records that a settlement interval has been cleared
+func putClearedInterval(ctx contractapi.TransactionContextInterface, intervalID string, method string, configVersion int) error {
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+
+	interval := ClearedInterval{
+		IntervalID:    intervalID,
+		Method:        method,
+		ConfigVersion: configVersion,
+		ClearedAt:     timestamp.Format(orderTimestampLayout),
+	}
+	return putObject(ctx, clearedIntervalType, intervalID, interval)
+}
+
+// CompareClearingMethods solves the current market exactly and runs the
+// subgradient iteration from its initial point for up to maxIterations, or the
+// configured maximum when empty, then reports both results side by side.
+// Nothing is written to the ledger.
+//
+// The two do not solve quite the same problem. The exact solution applies a
+// consumer's utility curve to their total demand at one common price. The
+// iteration prices each producer's output separately and applies the utility
+// curve to the demand for each producer on its own, so with several producers
+// it settles at a higher demand and welfare, and a producer at a production
+// limit has its lambda moved to its marginal cost. The gaps reported here
+// measure that difference as well as how far the iteration got.
+func (s *EnergyMarket) CompareClearingMethods(ctx contractapi.TransactionContextInterface, maxIterations string) (*ClearingComparison, error) {
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	maxIter, err := parseMaxIterations(maxIterations, config)
+	if err != nil {
+		return nil, err
+	}
+
+	exact, err := loadMarketState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	price, err := solveExactClearing(exact, config.gridCharges(exact))
+	if err != nil {
+		return nil, err
+	}
+
+	iterative, err := loadMarketState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resetClearing(iterative, config)
+
+	comparison := &ClearingComparison{
+		ConfigVersion:   config.Version,
+		ExactPrice:      price,
+		ExactGeneration: exact.TotalGeneration,
+		ExactDemand:     exact.TotalDemand,
+		ExactWelfare:    exact.SocialWelfare,
+	}
+	for comparison.Iterations < maxIter && !comparison.IterativeConverged {
+		comparison.IterativeConverged = clearingStep(iterative, config)
+		iterative.IterationCount++
+		comparison.Iterations++
+	}
+
+	comparison.IterativeGeneration = iterative.TotalGeneration
+	comparison.IterativeDemand = iterative.TotalDemand
+	comparison.IterativeWelfare = iterative.SocialWelfare
+	comparison.WelfareGap = exact.SocialWelfare - iterative.SocialWelfare
+	comparison.IterativePrices = make([]float64, len(iterative.Producers))
+	for i := range iterative.Producers {
+		comparison.IterativePrices[i] = iterative.Producers[i].Lambda
+		gap := math.Abs(exact.Producers[i].Production - iterative.Producers[i].Production)
+		comparison.MaxProductionGap = math.Max(comparison.MaxProductionGap, gap)
+	}
+
+	return comparison, nil
+}
+
+// solveExactClearing finds the uniform price at which total supply meets total
+// demand and writes production, prices, costs, demands, utilities, the KKT
+// multipliers of the demand limits and the market totals to the given state.
+// Each consumer's demand is split across producers in proportion to their
+// output, so every producer sells exactly what it produces, and the consumer's
+// utility is split the same way. Each consumer demands at the price delivered
+// to it under the grid tariffs, blended by that split, and the producers
+// generate its losses on top. It returns the clearing price.
+func solveExactClearing(marketState *MarketState, charges [][]gridCharge) (float64, error) {
+	return solveOffsetClearing(marketState, charges, nil, nil)
+}
+
+// solveOffsetClearing clears the market like solveExactClearing, except that
+// each producer and consumer sees the system price minus its own offset, as
+// under locational pricing. Nil offsets are all zero. It returns the system
+// price; every producer's Lambda is the price it sees.
+func solveOffsetClearing(marketState *MarketState, charges [][]gridCharge, producerOffsets []float64, consumerOffsets []float64) (float64, error) {
+	if len(marketState.Producers) == 0 || len(marketState.Consumers) == 0 {
+		return 0, fmt.Errorf("market needs at least one producer and one consumer")
+	}
+
+	var minSupply, maxSupply, minDemand, maxDemand float64
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		minSupply += producer.ProductionMin
+		maxSupply += producer.ProductionMax
+		low, high := marginalCostBounds(producer)
+		lo = math.Min(lo, low+offsetAt(producerOffsets, i))
+		hi = math.Max(hi, high+offsetAt(producerOffsets, i))
+	}
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		minDemand += consumer.DemandMin
+		maxDemand += consumer.DemandMax
+		low, high := maxCharge(charges, j).priceRange(marginalUtilityBounds(consumer))
+		lo = math.Min(lo, low+offsetAt(consumerOffsets, j))
+		hi = math.Max(hi, high+offsetAt(consumerOffsets, j))
+	}
+	if maxSupply < minDemand {
+		return 0, fmt.Errorf("producers cannot cover the minimum demand: capacity %.2f, minimum demand %.2f", maxSupply, minDemand)
+	}
+	if minSupply > maxDemand {
+		return 0, fmt.Errorf("minimum production exceeds the maximum demand: minimum production %.2f, maximum demand %.2f", minSupply, maxDemand)
+	}
+
+	// At lo every producer is at its minimum and every consumer at its maximum,
+	// at hi the other way round, so the excess supply changes sign in between
+	for step := 0; step < maxBisectionSteps; step++ {
+		mid := lo + (hi-lo)/2
+		if mid <= lo || mid >= hi {
+			break
+		}
+		if excessSupply(marketState, charges, mid, producerOffsets, consumerOffsets) < 0 {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	price := lo + (hi-lo)/2
+
+	// Supply and demand jump at the price of a curve stretch or block, so the
+	// bracket can end with supply short at lo and long at hi. Everyone moves
+	// the same fraction of the way from lo to hi, which balances the market;
+	// without a jump both ends give the same quantities.
+	fraction := 0.5
+	excessLo := excessSupply(marketState, charges, lo, producerOffsets, consumerOffsets)
+	excessHi := excessSupply(marketState, charges, hi, producerOffsets, consumerOffsets)
+	if excessHi > excessLo {
+		fraction = math.Min(math.Max(-excessLo/(excessHi-excessLo), 0), 1)
+	}
+
+	// Supply side
+	totalCost := 0.0
+	totalGeneration := 0.0
+	outputsLo := make([]float64, len(marketState.Producers))
+	outputsHi := make([]float64, len(marketState.Producers))
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		offset := offsetAt(producerOffsets, i)
+		low, high := producerOutput(producer, lo-offset), producerOutput(producer, hi-offset)
+		outputsLo[i], outputsHi[i] = low, high
+		producer.Lambda = price - offset
+		producer.Production = low + fraction*(high-low)
+		producer.Cost = productionCost(producer, producer.Production)
+		totalCost += producer.Cost
+		totalGeneration += producer.Production
+	}
+
+	// Demand side
+	totalUtility := 0.0
+	totalDemand := 0.0
+	totalLosses := 0.0
+	shares := outputShares(marketState)
+	sharesLo, sharesHi := sharesOf(outputsLo), sharesOf(outputsHi)
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		offset := offsetAt(consumerOffsets, j)
+		low := consumerDemand(consumer, blendedCharge(charges, j, sharesLo).deliveredPrice(lo-offset))
+		high := consumerDemand(consumer, blendedCharge(charges, j, sharesHi).deliveredPrice(hi-offset))
+		demand := low + fraction*(high-low)
+		utilityModel := utilityOf(consumer)
+		utility := utilityModel.Utility(demand)
+		charge := blendedCharge(charges, j, shares)
+		delivered := charge.deliveredPrice(price - offset)
+
+		// Multipliers of the demand limits from the stationarity condition
+		// U'(demand) - delivered price + UMin - UMax = 0, where at a kink
+		// U'(demand) can be anything between the marginal utilities on
+		// either side
+		consumer.UMin = math.Max(0, delivered-utilityModel.MarginalUtilityBelow(demand))
+		consumer.UMax = math.Max(0, utilityModel.MarginalUtility(demand)-delivered)
+
+		consumer.TotalDemand = demand
+		for i, share := range shares {
+			consumer.Demands[i] = demand * share
+			consumer.Utilities[i] = utility * share
+		}
+
+		totalUtility += utility
+		totalDemand += demand
+		totalLosses += demand * charge.loss
+	}
+
+	marketState.TotalGeneration = totalGeneration
+	marketState.TotalDemand = totalDemand
+	marketState.TotalLosses = totalLosses
+	marketState.SocialWelfare = totalUtility - totalCost
+
+	return price, nil
+}
+
+// outputShares returns each producer's share of total production, which is
+// how a consumer's demand is split across producers after a uniform-price
+// clearing. Without any production the demand is split evenly.
+func outputShares(marketState *MarketState) []float64 {
+	outputs := make([]float64, len(marketState.Producers))
+	for i, producer := range marketState.Producers {
+		outputs[i] = producer.Production
+	}
+	return sharesOf(outputs)
+}
+
+// sharesOf returns each output's share of the total, or even shares when
+// the total is zero
+func sharesOf(outputs []float64) []float64 {
+	total := 0.0
+	for _, output := range outputs {
+		total += output
+	}
+
+	shares := make([]float64, len(outputs))
+	for i, output := range outputs {
+		shares[i] = 1 / float64(len(outputs))
+		if total > 0 {
+			shares[i] = output / total
+		}
+	}
+	return shares
+}
+
+// excessSupply returns total supply minus total demand and the losses it
+// causes at a system price, which is non-decreasing in the price when the
+// tariffs are the same from every producer. Each participant sees the price
+// minus its offset, and each consumer the delivered price on top.
+func excessSupply(marketState *MarketState, charges [][]gridCharge, price float64, producerOffsets []float64, consumerOffsets []float64) float64 {
+	excess := 0.0
+	outputs := make([]float64, len(marketState.Producers))
+	for i := range marketState.Producers {
+		outputs[i] = producerOutput(&marketState.Producers[i], price-offsetAt(producerOffsets, i))
+		excess += outputs[i]
+	}
+	shares := sharesOf(outputs)
+	for j := range marketState.Consumers {
+		charge := blendedCharge(charges, j, shares)
+		demand := consumerDemand(&marketState.Consumers[j], charge.deliveredPrice(price-offsetAt(consumerOffsets, j)))
+		excess -= demand * (1 + charge.loss)
+	}
+	return excess
+}
+
+// offsetAt returns the price offset at an index, which is zero without offsets
+func offsetAt(offsets []float64, index int) float64 {
+	if offsets == nil {
+		return 0
+	}
+	return offsets[index]
+}
+
+// consumerDemand returns the demand at which a consumer's marginal utility
+// meets the price, within its demand limits
+func consumerDemand(consumer *Consumer, price float64) float64 {
+	demand := utilityOf(consumer).Demand(price)
+	return math.Min(math.Max(demand, consumer.DemandMin), consumer.DemandMax)
+}
+
+// resetClearing puts the clearing variables back to the point the iteration
+// starts from. Producers start at the lambda given by the configured rule:
+// their marginal cost at minimum output, or a fixed value at which they
+// produce their cost-minimising output within their limits.
+func resetClearing(marketState *MarketState, config *MarketConfig) {
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		if config.InitialLambda == InitialLambdaFixed {
+			producer.Lambda = config.InitialLambdaValue
+			producer.Production = producerOutput(producer, producer.Lambda)
+		} else if hasCostCurve(producer) {
+			producer.Lambda = marginalCost(producer, producer.ProductionMin)
+			producer.Production = producer.ProductionMin
+		} else {
+			producer.Lambda = 2*producer.A*producer.ProductionMin + producer.B
+			producer.Production = (producer.Lambda - producer.B) / (2 * producer.A)
+		}
+		producer.Cost = productionCost(producer, producer.Production)
+	}
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		consumer.UMin = 0
+		consumer.UMax = 0
+		consumer.TotalDemand = 0
+		for i := range consumer.Demands {
+			consumer.Demands[i] = 0
+			consumer.Utilities[i] = 0
+		}
+	}
+	marketState.TotalGeneration = 0
+	marketState.TotalDemand = 0
+	marketState.TotalLosses = 0
+	marketState.SocialWelfare = 0
+	marketState.IterationCount = 0
+	marketState.Converged = false
+	marketState.StepScale = 1
+	marketState.ConfigVersion = config.Version
+}
+
+// clearingStep runs one subgradient iteration under the configured step
+// schedule. The adaptive schedule backtracks Armijo-style: it starts from the
+// previous iteration's step scale grown by one backtrack, and shrinks it until
+// the step cuts the supply-demand gap by the sufficient decrease. If no
+// backtrack achieves that, the step is taken at the starting scale, so a run
+// of poor steps cannot shrink the scale to nothing. The scale it settles on
+// is kept for the next iteration.
+func clearingStep(marketState *MarketState, config *MarketConfig) bool {
+	if config.StepSchedule != StepScheduleAdaptive {
+		return subgradientStep(marketState, config)
+	}
+
+	gap := math.Abs(marketState.TotalGeneration - marketState.TotalDemand - marketState.TotalLosses)
+	initialScale := 1.0
+	if marketState.StepScale > 0 {
+		initialScale = math.Min(1, marketState.StepScale/config.BacktrackFactor)
+	}
+
+	scale := initialScale
+	for backtracks := 0; backtracks <= config.MaxBacktracks; backtracks++ {
+		trial := cloneMarketState(marketState)
+		trial.StepScale = scale
+		converged := subgradientStep(trial, config)
+
+		trialGap := math.Abs(trial.TotalGeneration - trial.TotalDemand - trial.TotalLosses)
+		if marketState.IterationCount == 0 || trialGap <= (1-config.SufficientDecrease)*gap {
+			*marketState = *trial
+			return converged
+		}
+		scale *= config.BacktrackFactor
+	}
+
+	marketState.StepScale = initialScale
+	return subgradientStep(marketState, config)
+}
+
+// cloneMarketState returns a copy of the market state that shares no slices
+// with the original
+func cloneMarketState(marketState *MarketState) *MarketState {
+	clone := *marketState
+	clone.Producers = append([]Producer{}, marketState.Producers...)
+	clone.Consumers = make([]Consumer, len(marketState.Consumers))
+	for j, consumer := range marketState.Consumers {
+		consumer.Demands = append([]float64{}, consumer.Demands...)
+		consumer.Utilities = append([]float64{}, consumer.Utilities...)
+		consumer.ProducerIDs = append([]string{}, consumer.ProducerIDs...)
+		clone.Consumers[j] = consumer
+	}
+	return &clone
+}
+
+// parseMaxIterations reads an iteration limit argument, using the configured
+// maximum when it is empty. Like the configured one, the limit must be positive.
+func parseMaxIterations(maxIterations string, config *MarketConfig) (int, error) {
+	if maxIterations == "" {
+		return config.MaxIterations, nil
+	}
+
+	maxIter, err := strconv.Atoi(maxIterations)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maximum iterations: %v", err)
+	}
+	if maxIter <= 0 {
+		return 0, fmt.Errorf("max iterations must be positive")
+	}
+
+	return maxIter, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// singleProducerSeed is a market whose one producer clears away from its
+// production limits and whose consumers clear away from their demand limits,
+// where the exact and iterative solvers solve the same problem
+func singleProducerSeed() MarketSeed {
+	return MarketSeed{
+		Producers: []ProducerSeed{
+			{ID: "producer1", A: 0.0080, B: 2.25, ProductionMin: 10, ProductionMax: 350, OwnerID: "consumer1"},
+		},
+		Consumers: []ConsumerSeed{
+			{ID: "consumer1", Beta: 8.25, Theta: 0.0720, DemandMin: 0, DemandMax: 150},
+			{ID: "consumer2", Beta: 7.90, Theta: 0.0660, DemandMin: 0, DemandMax: 150},
+		},
+	}
+}
+
+func TestExactAndIterativeClearingAgree(t *testing.T) {
+	config := defaultMarketConfig()
+
+	exact, err := newMarketState(singleProducerSeed(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	price, err := solveExactClearing(exact, config.gridCharges(exact))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	producer := exact.Producers[0]
+	if producer.Production <= producer.ProductionMin || producer.Production >= producer.ProductionMax {
+		t.Fatalf("producer clears at its limit, output %.4f", producer.Production)
+	}
+
+	iterative, err := newMarketState(singleProducerSeed(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for iterative.IterationCount < config.MaxIterations && !iterative.Converged {
+		iterative.Converged = clearingStep(iterative, config)
+		iterative.IterationCount++
+	}
+	if !iterative.Converged {
+		t.Fatalf("iteration did not converge in %d iterations", config.MaxIterations)
+	}
+
+	if gap := math.Abs(iterative.Producers[0].Lambda - price); gap > 0.01 {
+		t.Errorf("iterative price %.6f differs from exact price %.6f", iterative.Producers[0].Lambda, price)
+	}
+	if gap := math.Abs(iterative.TotalGeneration - exact.TotalGeneration); gap > config.BalanceTolerance {
+		t.Errorf("iterative generation %.4f differs from exact generation %.4f", iterative.TotalGeneration, exact.TotalGeneration)
+	}
+	for j := range exact.Consumers {
+		if gap := math.Abs(iterative.Consumers[j].TotalDemand - exact.Consumers[j].TotalDemand); gap > config.BalanceTolerance {
+			t.Errorf("iterative demand %.4f of %s differs from exact demand %.4f", iterative.Consumers[j].TotalDemand, exact.Consumers[j].ID, exact.Consumers[j].TotalDemand)
+		}
+	}
+	if gap := math.Abs(iterative.SocialWelfare - exact.SocialWelfare); gap > 0.01*math.Abs(exact.SocialWelfare) {
+		t.Errorf("iterative welfare %.4f differs from exact welfare %.4f", iterative.SocialWelfare, exact.SocialWelfare)
+	}
+}
+
+func TestExactClearingBalancesSupplyAndDemand(t *testing.T) {
+	config := defaultMarketConfig()
+
+	marketState, err := newMarketState(defaultMarketSeed(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	price, err := solveExactClearing(marketState, config.gridCharges(marketState))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gap := marketState.TotalGeneration - marketState.TotalDemand - marketState.TotalLosses; math.Abs(gap) > 1e-6 {
+		t.Errorf("generation %.6f does not cover demand %.6f and losses %.6f", marketState.TotalGeneration, marketState.TotalDemand, marketState.TotalLosses)
+	}
+	for _, producer := range marketState.Producers {
+		if producer.Production > producer.ProductionMin && producer.Production < producer.ProductionMax {
+			if mc := marginalCost(&producer, producer.Production); math.Abs(mc-price) > 1e-6 {
+				t.Errorf("producer %s has marginal cost %.6f at the price %.6f", producer.ID, mc, price)
+			}
+		}
+	}
+}
+
+func TestClearMarketExactSettlesEachIntervalOnce(t *testing.T) {
+	market := newTestMarket(t)
+
+	tests := []struct {
+		intervalID string
+		ok         bool
+	}{
+		{"", false},
+		{"2024-06-01T10", true},
+		{"2024-06-01T10", false}, // The same book again would bill every consumer twice
+		{"2024-06-01T11", true},
+	}
+	settled := 0
+	for _, test := range tests {
+		err := market.contract.ClearMarketExact(market.operator(), test.intervalID)
+		if (err == nil) != test.ok {
+			t.Fatalf("ClearMarketExact of interval %q returned %v, want success %v", test.intervalID, err, test.ok)
+		}
+
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ok {
+			if len(trades) <= settled {
+				t.Errorf("interval %q recorded no trades", test.intervalID)
+			}
+		} else if len(trades) != settled {
+			t.Errorf("rejected interval %q recorded %d trades", test.intervalID, len(trades)-settled)
+		}
+		settled = len(trades)
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestParseMaxIterations(t *testing.T) {
+	config := defaultMarketConfig()
+	tests := []struct {
+		argument string
+		ok       bool
+		want     int
+	}{
+		{"", true, config.MaxIterations},
+		{"25", true, 25},
+		{"1", true, 1},
+		{"0", false, 0},
+		{"-3", false, 0},
+		{"ten", false, 0},
+	}
+	for _, test := range tests {
+		maxIter, err := parseMaxIterations(test.argument, config)
+		if (err == nil) != test.ok {
+			t.Errorf("parseMaxIterations(%q) returned %v, want success %v", test.argument, err, test.ok)
+		}
+		if test.ok && maxIter != test.want {
+			t.Errorf("parseMaxIterations(%q) = %d, want %d", test.argument, maxIter, test.want)
+		}
+	}
+}
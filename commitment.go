@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// unitStatus is a producer's commitment status carried from one cleared
+// interval to the next
+type unitStatus struct {
+	online  bool    // Whether the unit was online
+	periods int     // Intervals it has been online or offline, 0 without any history
+	output  float64 // Output in the interval
+}
+
+// SetProducerConstraints sets the inter-temporal constraints of a producer:
+// its ramp limits in MW per interval, its minimum up and down times in
+// intervals, and the cost of starting it up. A ramp limit of 0 means no
+// limit. The constraints are enforced by ClearDayAhead, which clears the
+// intervals in order. Only the producer's owner may set them.
+func (s *EnergyMarket) SetProducerConstraints(ctx contractapi.TransactionContextInterface, producerID string, ownerID string, rampUp float64, rampDown float64, minUpTime int, minDownTime int, startupCost float64) error {
+	if err := assertCaller(ctx, ownerID); err != nil {
+		return err
+	}
+
+	producer, err := getProducerProfile(ctx, producerID)
+	if err != nil {
+		return err
+	}
+	if producer.OwnerID != ownerID {
+		return fmt.Errorf("user %s is not the owner of producer %s", ownerID, producerID)
+	}
+
+	for _, value := range []float64{rampUp, rampDown, startupCost} {
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+			return fmt.Errorf("ramp limits and start-up cost must be non-negative numbers")
+		}
+	}
+	if minUpTime < 0 || minDownTime < 0 {
+		return fmt.Errorf("minimum up and down times cannot be negative")
+	}
+
+	producer.RampUp = rampUp
+	producer.RampDown = rampDown
+	producer.MinUpTime = minUpTime
+	producer.MinDownTime = minDownTime
+	producer.StartupCost = startupCost
+
+	return putProducer(ctx, producer)
+}
+
+// clearCommittedInterval clears one interval exactly under the producers'
+// inter-temporal constraints, given their status in the previous interval.
+// An offline unit produces nothing. An online unit moves from its previous
+// output by at most its ramp limits, and a unit starting up reaches at most
+// its ramp-up limit or its minimum output, whichever is higher.
+//
+// Units start in their previous status. Each unit that is free to switch,
+// because it has met its minimum up or down time and can ramp down to its
+// minimum output before shutting down, is then switched in turn whenever that
+// raises the social welfare net of start-up costs, until no switch does.
+// Start-up costs are added to the started units' Cost and taken off the
+// SocialWelfare of the returned state, which comes with the clearing price
+// and the units that are online. Consumers pay the given grid tariffs.
+func clearCommittedInterval(marketState *MarketState, status []unitStatus, charges [][]gridCharge) (*MarketState, float64, []bool, error) {
+	online := make([]bool, len(status))
+	for i := range status {
+		online[i] = status[i].online
+	}
+
+	best, price, err := clearWithCommitment(marketState, status, online, charges)
+	committed := append([]bool{}, online...)
+	for pass := 0; pass <= len(status); pass++ {
+		improved := false
+		for i := range marketState.Producers {
+			if !canSwitch(&marketState.Producers[i], status[i]) {
+				continue
+			}
+
+			online[i] = !online[i]
+			trial, trialPrice, trialErr := clearWithCommitment(marketState, status, online, charges)
+			if trialErr == nil && (best == nil || trial.SocialWelfare > best.SocialWelfare) {
+				best, price, err = trial, trialPrice, nil
+				committed = append(committed[:0], online...)
+				improved = true
+			} else {
+				online[i] = !online[i]
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	if best == nil {
+		return nil, 0, nil, err
+	}
+
+	return best, price, committed, nil
+}
+
+// clearWithCommitment clears a copy of the market with the given units online
+func clearWithCommitment(marketState *MarketState, status []unitStatus, online []bool, charges [][]gridCharge) (*MarketState, float64, error) {
+	trial := cloneMarketState(marketState)
+	for i := range trial.Producers {
+		applyCommitment(&trial.Producers[i], status[i], online[i])
+	}
+
+	price, err := solveExactClearing(trial, charges)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for i := range trial.Producers {
+		producer := &trial.Producers[i]
+		if !online[i] {
+			// An offline unit has no fixed cost either
+			trial.SocialWelfare += producer.Cost
+			producer.Cost = 0
+		}
+		if online[i] && !status[i].online {
+			producer.Cost += producer.StartupCost
+			trial.SocialWelfare -= producer.StartupCost
+		}
+	}
+
+	return trial, price, nil
+}
+
+// applyCommitment narrows a producer's production limits to what its status
+// allows in the next interval
+func applyCommitment(producer *Producer, status unitStatus, online bool) {
+	if !online {
+		producer.ProductionMin = 0
+		producer.ProductionMax = 0
+		return
+	}
+	if status.periods == 0 {
+		return
+	}
+
+	if status.online {
+		if producer.RampUp > 0 {
+			producer.ProductionMax = math.Min(producer.ProductionMax, status.output+producer.RampUp)
+		}
+		if producer.RampDown > 0 {
+			producer.ProductionMin = math.Max(producer.ProductionMin, status.output-producer.RampDown)
+		}
+	} else if producer.RampUp > 0 {
+		producer.ProductionMax = math.Min(producer.ProductionMax, math.Max(producer.ProductionMin, producer.RampUp))
+	}
+
+	// The production limits win over a ramp limit they conflict with
+	producer.ProductionMin = math.Min(producer.ProductionMin, producer.ProductionMax)
+}
+
+// canSwitch reports whether a unit may change its status in the next interval
+func canSwitch(producer *Producer, status unitStatus) bool {
+	if status.periods == 0 {
+		return true
+	}
+	if !status.online {
+		return status.periods >= producer.MinDownTime
+	}
+	if status.periods < producer.MinUpTime {
+		return false
+	}
+	return producer.RampDown <= 0 || status.output <= math.Max(producer.ProductionMin, producer.RampDown)
+}
+
+// nextStatus returns a unit's status after an interval in which it was online
+// or not and produced output
+func nextStatus(status unitStatus, online bool, output float64) unitStatus {
+	periods := 1
+	if status.periods > 0 && status.online == online {
+		periods = status.periods + 1
+	}
+	return unitStatus{online: online, periods: periods, output: output}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// commitmentDemand is each consumer's demand in the six intervals of the
+// commitment tests: producer3 is only needed when it is high
+var commitmentDemand = []float64{10, 100, 10, 10, 100, 100}
+
+// outputs returns a producer's output in each interval of a day
+func outputs(day *DaySchedule, producerID string) []float64 {
+	quantities := []float64{}
+	for _, interval := range day.Intervals {
+		for _, dispatch := range interval.Producers {
+			if dispatch.ID == producerID {
+				quantities = append(quantities, dispatch.Quantity)
+			}
+		}
+	}
+	return quantities
+}
+
+func TestDayAheadCommitsUnitsAcrossIntervals(t *testing.T) {
+	tests := []struct {
+		name        string
+		producerID  string
+		ownerID     string
+		rampUp      float64
+		rampDown    float64
+		minUpTime   int
+		minDownTime int
+		online      []bool
+	}{
+		{"unconstrained", "producer3", "consumer3", 0, 0, 0, 0, []bool{false, true, false, false, true, true}},
+		// Once started it stays online for three intervals
+		{"minimum up time", "producer3", "consumer3", 0, 0, 3, 0, []bool{false, true, true, true, true, true}},
+		// Offline from the first interval, it cannot start until the fourth
+		{"minimum down time", "producer3", "consumer3", 0, 0, 0, 3, []bool{false, false, false, false, true, true}},
+		{"ramp limits", "producer2", "consumer2", 10, 10, 0, 0, []bool{false, true, false, false, true, true}},
+	}
+	for _, test := range tests {
+		market := newTestMarket(t)
+		market.setPeriods(len(commitmentDemand))
+		market.setDemand(commitmentDemand)
+		err := market.contract.SetProducerConstraints(market.participant(test.ownerID), test.producerID, test.ownerID, test.rampUp, test.rampDown, test.minUpTime, test.minDownTime, 50)
+		if err != nil {
+			t.Fatalf("%s: SetProducerConstraints failed: %v", test.name, err)
+		}
+
+		day, err := market.contract.ClearDayAhead(market.operator(), "2024-06-01")
+		if err != nil {
+			t.Fatalf("%s: ClearDayAhead failed: %v", test.name, err)
+		}
+
+		previous := IntervalDispatch{}
+		for i, interval := range day.Intervals {
+			var dispatch IntervalDispatch
+			for _, producer := range interval.Producers {
+				if producer.ID == test.producerID {
+					dispatch = producer
+				}
+			}
+			if dispatch.Online != test.online[i] {
+				t.Errorf("%s: %s is online %v in interval %d at %.2f, want %v", test.name, test.producerID, dispatch.Online, i, dispatch.Quantity, test.online[i])
+			}
+
+			// A unit started up pays its start-up cost once
+			if started := dispatch.Online && (i == 0 || !previous.Online); started && interval.StartupCost < 50 {
+				t.Errorf("%s: interval %d started %s at a cost of %v", test.name, i, test.producerID, interval.StartupCost)
+			}
+
+			// An online unit ramps from its previous output, a starting one
+			// from its minimum output
+			if test.rampUp > 0 && dispatch.Online {
+				from := 20.0
+				if previous.Online {
+					from = previous.Quantity
+				}
+				if dispatch.Quantity > math.Max(from+test.rampUp, 20)+1e-6 || (previous.Online && dispatch.Quantity < previous.Quantity-test.rampDown-1e-6) {
+					t.Errorf("%s: %s moves from %.2f to %.2f MW in interval %d", test.name, test.producerID, previous.Quantity, dispatch.Quantity, i)
+				}
+			}
+			previous = dispatch
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestCommitmentCarriesIntoTheNextDay(t *testing.T) {
+	market := newTestMarket(t)
+	market.setPeriods(len(commitmentDemand))
+	market.setDemand(commitmentDemand)
+	if err := market.contract.SetProducerConstraints(market.participant("consumer2"), "producer2", "consumer2", 10, 10, 0, 0, 50); err != nil {
+		t.Fatalf("SetProducerConstraints failed: %v", err)
+	}
+
+	first, err := market.contract.ClearDayAhead(market.operator(), "2024-06-01")
+	if err != nil {
+		t.Fatalf("ClearDayAhead failed: %v", err)
+	}
+	last := outputs(first, "producer2")[len(commitmentDemand)-1]
+
+	// The unit ends the day above what it can ramp down to its minimum, so
+	// it stays online into the low demand of the next morning
+	producer := market.producer("producer2")
+	if producer.Offline || producer.LastOutput != last || producer.StatusPeriods == 0 {
+		t.Fatalf("producer2 is stored offline %v after %d intervals at %.2f MW, want online at %.2f MW", producer.Offline, producer.StatusPeriods, producer.LastOutput, last)
+	}
+	second, err := market.contract.ClearDayAhead(market.operator(), "2024-06-02")
+	if err != nil {
+		t.Fatalf("ClearDayAhead of the next day failed: %v", err)
+	}
+	if dispatch := second.Intervals[0].Producers[1]; !dispatch.Online || dispatch.Quantity < last-10-1e-6 {
+		t.Errorf("producer2 starts the next day online %v at %.2f MW, want online at %.2f MW or more", dispatch.Online, dispatch.Quantity, last-10)
+	}
+	if second.Intervals[0].StartupCost != 0 {
+		t.Errorf("the next day pays a start-up cost of %v for a unit left online", second.Intervals[0].StartupCost)
+	}
+}
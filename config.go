@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// defaultPeriods is the number of hourly intervals in a day-ahead schedule
+const defaultPeriods = 24
+
+// defaultCongestionStepSize is the step size of the line shadow price update
+const defaultCongestionStepSize = 0.002
+
+// marketConfigKey is the ledger key of the current clearing configuration
+const marketConfigKey = "MarketConfig"
+
+// configVersionObjectType keeps every published configuration version, so a
+// clearing result can always be traced back to the parameters behind it
+const configVersionObjectType = "MarketConfigVersion"
+
+// Step-size schedules supported on MarketConfig.StepSchedule
+const (
+	StepScheduleConstant = "constant" // The base step size in every iteration
+	StepScheduleInvSqrt  = "inv_sqrt" // The base step size divided by sqrt(k+1)
+	StepScheduleAdaptive = "adaptive" // Armijo backtracking on the supply-demand gap
+)
+
+// Initial lambda rules supported on MarketConfig.InitialLambda
+const (
+	InitialLambdaMinCost = "min_marginal_cost" // Each producer's marginal cost at its minimum output
+	InitialLambdaFixed   = "fixed"             // InitialLambdaValue for every producer
+)
+
+// MarketConfig holds the parameters of the subgradient clearing algorithm.
+// Version, UpdatedAt and UpdatedBy are set by SetMarketConfig.
+type MarketConfig struct {
+	Version            int          `json:"version,omitempty"`            // Increases by one with every change, 0 for the built-in defaults
+	StepSchedule       string       `json:"stepSchedule"`                 // "constant", "inv_sqrt" or "adaptive"
+	PriceStepSize      float64      `json:"priceStepSize"`                // Base step size of the producer lambda update
+	MultiplierStepSize float64      `json:"multiplierStepSize"`           // Base step size of the consumer multiplier update
+	BacktrackFactor    float64      `json:"backtrackFactor,omitempty"`    // Adaptive: step reduction per backtrack, in (0, 1)
+	SufficientDecrease float64      `json:"sufficientDecrease,omitempty"` // Adaptive: relative gap reduction a step must achieve, in (0, 1)
+	MaxBacktracks      int          `json:"maxBacktracks,omitempty"`      // Adaptive: backtracks before a step is taken anyway
+	PriceTolerance     float64      `json:"priceTolerance"`               // Largest lambda change accepted at convergence
+	BalanceTolerance   float64      `json:"balanceTolerance"`             // Largest supply-demand gap accepted at convergence, in MW
+	MaxIterations      int          `json:"maxIterations"`                // Iterations RunMarketUntilConvergence runs when not told otherwise
+	Periods            int          `json:"periods,omitempty"`            // Intervals in the day-ahead schedule, 24 when not set
+	CongestionStepSize float64      `json:"congestionStepSize,omitempty"` // Step size of the line shadow price update, 0.002 when not set
+	InitialLambda      string       `json:"initialLambda"`                // "min_marginal_cost" or "fixed"
+	InitialLambdaValue float64      `json:"initialLambdaValue,omitempty"` // Starting lambda for the "fixed" rule
+	GridTariffs        []GridTariff `json:"gridTariffs,omitempty"`        // Network fee and loss factor per producer-consumer pair
+	FeeAccountID       string       `json:"feeAccountId,omitempty"`       // Account of the DSO that network fees and congestion rents are paid into
+	UpdatedAt          string       `json:"updatedAt,omitempty"`          // When this version was published
+	UpdatedBy          string       `json:"updatedBy,omitempty"`          // Identity that published this version
+}
+
+// defaultMarketConfig returns the parameters the market used before they
+// became configurable. It is in effect until an operator sets a config.
+func defaultMarketConfig() *MarketConfig {
+	return &MarketConfig{
+		Version:            0,
+		StepSchedule:       StepScheduleInvSqrt,
+		PriceStepSize:      0.005,
+		MultiplierStepSize: 0.0001,
+		BacktrackFactor:    0.5,
+		SufficientDecrease: 0.0001,
+		MaxBacktracks:      10,
+		PriceTolerance:     0.00009,
+		BalanceTolerance:   1.0,
+		MaxIterations:      10000,
+		Periods:            defaultPeriods,
+		CongestionStepSize: defaultCongestionStepSize,
+		InitialLambda:      InitialLambdaMinCost,
+	}
+}
+
+// SetMarketConfig publishes a new version of the clearing configuration.
+// Only a market operator may call it. Clearing runs started afterwards
+// use the new parameters and record its version.
+func (s *EnergyMarket) SetMarketConfig(ctx contractapi.TransactionContextInterface, config MarketConfig) (*MarketConfig, error) {
+	current, err := getMarketConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.StepSchedule == StepScheduleAdaptive {
+		// Fill in the backtracking parameters that were left out
+		if config.BacktrackFactor == 0 {
+			config.BacktrackFactor = current.BacktrackFactor
+		}
+		if config.SufficientDecrease == 0 {
+			config.SufficientDecrease = current.SufficientDecrease
+		}
+		if config.MaxBacktracks == 0 {
+			config.MaxBacktracks = current.MaxBacktracks
+		}
+	}
+	if err := validateMarketConfig(&config); err != nil {
+		return nil, err
+	}
+	if config.FeeAccountID != "" {
+		if _, err := getAccount(ctx, config.FeeAccountID); err != nil {
+			return nil, fmt.Errorf("fee account: %v", err)
+		}
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	updatedBy, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read caller identity: %v", err)
+	}
+
+	config.Version = current.Version + 1
+	config.UpdatedAt = timestamp.Format(orderTimestampLayout)
+	config.UpdatedBy = updatedBy
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal market config: %v", err)
+	}
+	err = ctx.GetStub().PutState(marketConfigKey, configJSON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save market config: %v", err)
+	}
+	if err := putObject(ctx, configVersionObjectType, configVersionID(config.Version), config); err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+// GetMarketConfig retrieves the clearing configuration currently in effect
+func (s *EnergyMarket) GetMarketConfig(ctx contractapi.TransactionContextInterface) (*MarketConfig, error) {
+	return getMarketConfig(ctx)
+}
+
+// GetMarketConfigVersion retrieves a published version of the clearing
+// configuration, such as the one recorded on a clearing result
+func (s *EnergyMarket) GetMarketConfigVersion(ctx contractapi.TransactionContextInterface, version int) (*MarketConfig, error) {
+	if version == 0 {
+		return defaultMarketConfig(), nil
+	}
+
+	var config MarketConfig
+	found, err := getObject(ctx, configVersionObjectType, configVersionID(version), &config)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("market config version %d does not exist", version)
+	}
+
+	return &config, nil
+}
+
+// getMarketConfig reads the current clearing configuration, falling back to
+// the defaults when none has been set
+func getMarketConfig(ctx contractapi.TransactionContextInterface) (*MarketConfig, error) {
+	configJSON, err := ctx.GetStub().GetState(marketConfigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read market config: %v", err)
+	}
+	if configJSON == nil {
+		return defaultMarketConfig(), nil
+	}
+
+	var config MarketConfig
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal market config: %v", err)
+	}
+
+	return &config, nil
+}
+
+// validateMarketConfig checks that a configuration can drive the clearing algorithm
+func validateMarketConfig(config *MarketConfig) error {
+	switch config.StepSchedule {
+	case StepScheduleConstant, StepScheduleInvSqrt:
+	case StepScheduleAdaptive:
+		if config.BacktrackFactor <= 0 || config.BacktrackFactor >= 1 {
+			return fmt.Errorf("backtrack factor must be between 0 and 1")
+		}
+		if config.SufficientDecrease <= 0 || config.SufficientDecrease >= 1 {
+			return fmt.Errorf("sufficient decrease must be between 0 and 1")
+		}
+		if config.MaxBacktracks < 0 {
+			return fmt.Errorf("max backtracks cannot be negative")
+		}
+	default:
+		return fmt.Errorf("invalid step schedule %q, expected %q, %q or %q", config.StepSchedule, StepScheduleConstant, StepScheduleInvSqrt, StepScheduleAdaptive)
+	}
+
+	if !(config.PriceStepSize > 0) || !(config.MultiplierStepSize > 0) {
+		return fmt.Errorf("step sizes must be positive")
+	}
+	if !(config.PriceTolerance > 0) || !(config.BalanceTolerance > 0) {
+		return fmt.Errorf("tolerances must be positive")
+	}
+	if config.MaxIterations <= 0 {
+		return fmt.Errorf("max iterations must be positive")
+	}
+	if config.Periods < 0 {
+		return fmt.Errorf("periods cannot be negative")
+	}
+	if !(config.CongestionStepSize >= 0) || math.IsInf(config.CongestionStepSize, 0) {
+		return fmt.Errorf("congestion step size cannot be negative")
+	}
+
+	switch config.InitialLambda {
+	case InitialLambdaMinCost:
+	case InitialLambdaFixed:
+		if math.IsNaN(config.InitialLambdaValue) || math.IsInf(config.InitialLambdaValue, 0) || config.InitialLambdaValue < 0 {
+			return fmt.Errorf("initial lambda value must be a non-negative number")
+		}
+	default:
+		return fmt.Errorf("invalid initial lambda rule %q, expected %q or %q", config.InitialLambda, InitialLambdaMinCost, InitialLambdaFixed)
+	}
+
+	if err := validateGridTariffs(config.GridTariffs); err != nil {
+		return err
+	}
+	for _, tariff := range config.GridTariffs {
+		if tariff.Fee > 0 && config.FeeAccountID == "" {
+			return fmt.Errorf("network fees need a fee account to be paid into")
+		}
+	}
+	return nil
+}
+
+// stepSize returns the step size of iteration k for a base step size under
+// the configured schedule. The adaptive schedule scales the base step by the
+// factor its backtracking settled on.
+func (config *MarketConfig) stepSize(base float64, k int, scale float64) float64 {
+	switch config.StepSchedule {
+	case StepScheduleConstant:
+		return base
+	case StepScheduleAdaptive:
+		return base * scale
+	default:
+		return base / math.Sqrt(float64(k+1))
+	}
+}
+
+// periods returns the number of intervals in the day-ahead schedule
+func (config *MarketConfig) periods() int {
+	if config.Periods <= 0 {
+		return defaultPeriods
+	}
+	return config.Periods
+}
+
+// congestionStepSize returns the step size of the line shadow price update
+func (config *MarketConfig) congestionStepSize() float64 {
+	if config.CongestionStepSize <= 0 {
+		return defaultCongestionStepSize
+	}
+	return config.CongestionStepSize
+}
+
+// configVersionID formats a version number so that versions sort in order
+func configVersionID(version int) string {
+	return fmt.Sprintf("%010d", version)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// CostPoint is a breakpoint of a piecewise-linear cost curve: the total cost
+// of producing Output MW. The cost is linear between breakpoints, and the
+// cost at the first breakpoint, at zero output, is a fixed cost.
+type CostPoint struct {
+	Output float64 `json:"output"` // Production at the breakpoint
+	Cost   float64 `json:"cost"`   // Total cost at the breakpoint
+}
+
+// OfferBlock is a block of a block offer: Quantity MW offered at Price per
+// MWh. Blocks are offered from zero output upwards, in the order given.
+type OfferBlock struct {
+	Quantity float64 `json:"quantity"` // Size of the block
+	Price    float64 `json:"price"`    // Marginal cost of the block
+}
+
+// costStep is a stretch of output over which a producer's marginal cost is constant
+type costStep struct {
+	start float64
+	end   float64
+	price float64
+}
+
+// CreateProducerWithCurve creates a new producer whose cost is given by a
+// piecewise-linear cost curve or by block offers instead of A and B. The
+// curve or blocks are private and passed as transient data under "producer",
+// as {"costCurve": [...]} or {"offerBlocks": [...]}; exactly one must be
+// non-empty. The curve must be convex, so its marginal cost never falls, and
+// must run from zero output to at least the maximum production; block prices
+// must not fall from one block to the next, and the blocks must add up to at
+// least the maximum production.
+func (s *EnergyMarket) CreateProducerWithCurve(ctx contractapi.TransactionContextInterface, id string, productionMin float64, productionMax float64, ownerID string) error {
+	var details ProducerPrivate
+	if err := getTransient(ctx, producerTransientKey, &details); err != nil {
+		return err
+	}
+	costCurve, offerBlocks := details.CostCurve, details.OfferBlocks
+
+	if productionMin < 0 || productionMax < productionMin {
+		return fmt.Errorf("producer %s has invalid production limits", id)
+	}
+	if len(costCurve) == 0 && len(offerBlocks) == 0 {
+		return fmt.Errorf("producer %s needs a cost curve or block offers", id)
+	}
+	if err := validateCostCurve(costCurve, offerBlocks, productionMax); err != nil {
+		return fmt.Errorf("producer %s: %v", id, err)
+	}
+
+	newProducer := Producer{
+		ID:            id,
+		ProductionMin: productionMin,
+		ProductionMax: productionMax,
+		OwnerID:       ownerID,
+		CostCurve:     costCurve,
+		OfferBlocks:   offerBlocks,
+	}
+
+	return s.addProducer(ctx, newProducer)
+}
+
+// validateCostCurve checks a piecewise-linear cost curve or a block offer
+// against a producer's maximum production. Both empty means the quadratic
+// cost applies.
+func validateCostCurve(costCurve []CostPoint, offerBlocks []OfferBlock, productionMax float64) error {
+	if len(costCurve) > 0 && len(offerBlocks) > 0 {
+		return fmt.Errorf("a producer has either a cost curve or block offers, not both")
+	}
+
+	if len(costCurve) > 0 {
+		if len(costCurve) < 2 {
+			return fmt.Errorf("cost curve needs at least two points")
+		}
+		slope := math.Inf(-1)
+		for k, point := range costCurve {
+			if math.IsNaN(point.Output) || math.IsInf(point.Output, 0) || math.IsNaN(point.Cost) || math.IsInf(point.Cost, 0) {
+				return fmt.Errorf("cost curve point %d is not a finite number", k)
+			}
+			if k == 0 {
+				continue
+			}
+			previous := costCurve[k-1]
+			if point.Output <= previous.Output {
+				return fmt.Errorf("cost curve outputs must increase, point %d does not", k)
+			}
+			next := (point.Cost - previous.Cost) / (point.Output - previous.Output)
+			if next < slope {
+				return fmt.Errorf("cost curve must be convex, its marginal cost falls at point %d", k)
+			}
+			slope = next
+		}
+		if costCurve[0].Output != 0 || costCurve[len(costCurve)-1].Output < productionMax {
+			return fmt.Errorf("cost curve must cover outputs from 0 to the maximum production %.2f", productionMax)
+		}
+	}
+
+	if len(offerBlocks) > 0 {
+		total := 0.0
+		for k, block := range offerBlocks {
+			if math.IsNaN(block.Quantity) || math.IsInf(block.Quantity, 0) || block.Quantity <= 0 {
+				return fmt.Errorf("offer block %d must have a positive quantity", k)
+			}
+			if math.IsNaN(block.Price) || math.IsInf(block.Price, 0) {
+				return fmt.Errorf("offer block %d price is not a finite number", k)
+			}
+			if k > 0 && block.Price < offerBlocks[k-1].Price {
+				return fmt.Errorf("offer block prices must not fall, block %d does", k)
+			}
+			total += block.Quantity
+		}
+		if total < productionMax {
+			return fmt.Errorf("offer blocks total %.2f, less than the maximum production %.2f", total, productionMax)
+		}
+	}
+
+	return nil
+}
+
+// hasCostCurve reports whether a producer's cost is a curve or block offer
+// rather than quadratic
+func hasCostCurve(producer *Producer) bool {
+	return len(producer.CostCurve) > 0 || len(producer.OfferBlocks) > 0
+}
+
+// costSteps returns the cost at the start of a producer's curve and the
+// stretches of constant marginal cost that follow it
+func costSteps(producer *Producer) (float64, []costStep) {
+	var steps []costStep
+	if len(producer.CostCurve) > 0 {
+		for k := 1; k < len(producer.CostCurve); k++ {
+			previous, point := producer.CostCurve[k-1], producer.CostCurve[k]
+			price := (point.Cost - previous.Cost) / (point.Output - previous.Output)
+			steps = append(steps, costStep{start: previous.Output, end: point.Output, price: price})
+		}
+		return producer.CostCurve[0].Cost, steps
+	}
+
+	output := 0.0
+	for _, block := range producer.OfferBlocks {
+		steps = append(steps, costStep{start: output, end: output + block.Quantity, price: block.Price})
+		output += block.Quantity
+	}
+	return 0, steps
+}
+
+// productionCost returns a producer's total cost at an output
+func productionCost(producer *Producer, output float64) float64 {
+	if !hasCostCurve(producer) {
+		return producer.A*math.Pow(output, 2) + producer.B*output
+	}
+
+	cost, steps := costSteps(producer)
+	for _, step := range steps {
+		cost += step.price * math.Min(math.Max(output-step.start, 0), step.end-step.start)
+	}
+	return cost
+}
+
+// marginalCost returns a producer's marginal cost of raising its output
+func marginalCost(producer *Producer, output float64) float64 {
+	if !hasCostCurve(producer) {
+		return 2*producer.A*output + producer.B
+	}
+
+	_, steps := costSteps(producer)
+	for _, step := range steps {
+		if output < step.end {
+			return step.price
+		}
+	}
+	return steps[len(steps)-1].price
+}
+
+// marginalCostBelow returns a producer's marginal cost of the last MW up to
+// an output, which differs from marginalCost at a breakpoint of a curve
+func marginalCostBelow(producer *Producer, output float64) float64 {
+	if !hasCostCurve(producer) {
+		return 2*producer.A*output + producer.B
+	}
+
+	_, steps := costSteps(producer)
+	for _, step := range steps {
+		if output <= step.end {
+			return step.price
+		}
+	}
+	return steps[len(steps)-1].price
+}
+
+// producerOutput returns the output at which a producer's marginal cost meets
+// the price, within its production limits. On a curve the producer offers
+// every stretch priced below the price.
+func producerOutput(producer *Producer, price float64) float64 {
+	var output float64
+	if !hasCostCurve(producer) {
+		output = (price - producer.B) / (2 * producer.A)
+	} else {
+		_, steps := costSteps(producer)
+		output = steps[0].start
+		for _, step := range steps {
+			if step.price >= price {
+				break
+			}
+			output = step.end
+		}
+	}
+	return math.Min(math.Max(output, producer.ProductionMin), producer.ProductionMax)
+}
+
+// marginalCostBounds returns a price at or below which a producer produces
+// its minimum and a price at or above which it produces its maximum
+func marginalCostBounds(producer *Producer) (float64, float64) {
+	low := marginalCost(producer, producer.ProductionMin)
+	high := marginalCostBelow(producer, producer.ProductionMax)
+	if hasCostCurve(producer) {
+		// A curve offers a stretch only at prices strictly above its price
+		high = math.Nextafter(high, math.Inf(1))
+	}
+	return low, high
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// deliveryDateLayout is the format of a day-ahead delivery date
+const deliveryDateLayout = "2006-01-02"
+
+// IntervalOffer is a producer's offer for one interval of the day-ahead
+// market: its production limits and the linear cost coefficient it bids.
+// The quadratic coefficient A stays the producer's own, and B has no effect
+// on a producer with a cost curve or block offer.
+type IntervalOffer struct {
+	ProductionMin float64 `json:"productionMin"` // Minimum production in the interval
+	ProductionMax float64 `json:"productionMax"` // Maximum production in the interval
+	B             float64 `json:"b"`             // Linear cost coefficient in the interval
+}
+
+// IntervalBid is a consumer's bid for one interval of the day-ahead market:
+// its demand limits and the utility parameter Beta. Theta stays the
+// consumer's own, and Beta has no effect on a consumer with the piecewise or
+// block utility model.
+type IntervalBid struct {
+	DemandMin float64 `json:"demandMin"` // Minimum demand in the interval
+	DemandMax float64 `json:"demandMax"` // Maximum demand in the interval
+	Beta      float64 `json:"beta"`      // Utility function parameter in the interval
+}
+
+// ProducerSchedule holds a producer's offers for every interval of the day
+type ProducerSchedule struct {
+	ProducerID string          `json:"producerId"`
+	Offers     []IntervalOffer `json:"offers"`
+}
+
+// ConsumerSchedule holds a consumer's bids for every interval of the day
+type ConsumerSchedule struct {
+	ConsumerID string        `json:"consumerId"`
+	Bids       []IntervalBid `json:"bids"`
+}
+
+// IntervalDispatch is the cleared quantity of one participant in one
+// interval. A producer's cost is not included: the schedule is public, and
+// its costs at several outputs would give its cost coefficients away.
+type IntervalDispatch struct {
+	ID       string  `json:"id"`
+	Quantity float64 `json:"quantity"`         // Output of a producer or demand of a consumer, in MW
+	Online   bool    `json:"online,omitempty"` // Whether a producer is online
+}
+
+// IntervalResult is the clearing result of one interval of the day
+type IntervalResult struct {
+	Interval        int                `json:"interval"`          // Interval number, 0 for the hour starting at midnight
+	Lambda          float64            `json:"lambda"`            // Clearing price of the interval
+	Producers       []IntervalDispatch `json:"producers"`         // Output of each producer
+	Consumers       []IntervalDispatch `json:"consumers"`         // Demand of each consumer
+	TotalGeneration float64            `json:"totalGeneration"`   // Total generation in the interval
+	TotalDemand     float64            `json:"totalDemand"`       // Total demand in the interval
+	SocialWelfare   float64            `json:"socialWelfare"`     // Utility minus cost, including start-up costs, in the interval
+	StartupCost     float64            `json:"startupCost"`       // Start-up cost of the units started in the interval
+	Storage         []StorageDispatch  `json:"storage,omitempty"` // Charging and discharging of each storage unit
+	TradeIDs        []string           `json:"tradeIds"`          // Trades recorded for the interval
+}
+
+// DaySchedule is the day-ahead clearing result of one delivery date
+type DaySchedule struct {
+	DeliveryDate  string           `json:"deliveryDate"`  // Date the schedule is delivered on, as 2006-01-02
+	Periods       int              `json:"periods"`       // Number of intervals in the day
+	ConfigVersion int              `json:"configVersion"` // Version of the MarketConfig in effect when the day was cleared
+	ClearedAt     string           `json:"clearedAt"`     // When the day was cleared
+	Intervals     []IntervalResult `json:"intervals"`     // Result of each interval, in interval order
+}
+
+// SetProducerSchedule stores a producer's offers for the day-ahead market, one
+// for each of the configured periods. The offers are private and passed as
+// transient data under "offers", and are kept in the private data
+// collection of the owner's organisation. It replaces any earlier schedule and is used for every day
+// cleared until it is replaced.
+func (s *EnergyMarket) SetProducerSchedule(ctx contractapi.TransactionContextInterface, producerID string) error {
+	var offers []IntervalOffer
+	if err := getTransient(ctx, offersTransientKey, &offers); err != nil {
+		return err
+	}
+
+	producer, err := getProducerProfile(ctx, producerID)
+	if err != nil {
+		return err
+	}
+	if err := assertCaller(ctx, producer.OwnerID); err != nil {
+		return err
+	}
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if len(offers) != config.periods() {
+		return fmt.Errorf("expected %d offers, got %d", config.periods(), len(offers))
+	}
+
+	for t, offer := range offers {
+		if !validLimits(offer.ProductionMin, offer.ProductionMax) {
+			return fmt.Errorf("invalid production limits in interval %d", t)
+		}
+		if math.IsNaN(offer.B) || math.IsInf(offer.B, 0) {
+			return fmt.Errorf("invalid cost coefficient in interval %d", t)
+		}
+	}
+
+	schedule := ProducerSchedule{ProducerID: producer.ID, Offers: offers}
+
+	return putPrivateObject(ctx, producer.MSPID, offerObjectType, producer.ID, schedule)
+}
+
+// SetConsumerSchedule stores a consumer's bids for the day-ahead market, one
+// for each of the configured periods. The bids are private and passed as
+// transient data under "bids", and are kept in the private data collection
+// of the consumer's organisation. It replaces any earlier schedule and is used for every day cleared until
+// it is replaced.
+func (s *EnergyMarket) SetConsumerSchedule(ctx contractapi.TransactionContextInterface, consumerID string) error {
+	var bids []IntervalBid
+	if err := getTransient(ctx, bidsTransientKey, &bids); err != nil {
+		return err
+	}
+
+	consumer, err := getConsumerProfile(ctx, consumerID)
+	if err != nil {
+		return err
+	}
+	if err := assertCaller(ctx, consumer.ID); err != nil {
+		return err
+	}
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if len(bids) != config.periods() {
+		return fmt.Errorf("expected %d bids, got %d", config.periods(), len(bids))
+	}
+
+	for t, bid := range bids {
+		if !validLimits(bid.DemandMin, bid.DemandMax) {
+			return fmt.Errorf("invalid demand limits in interval %d", t)
+		}
+		if math.IsNaN(bid.Beta) || math.IsInf(bid.Beta, 0) {
+			return fmt.Errorf("invalid utility parameter in interval %d", t)
+		}
+	}
+
+	schedule := ConsumerSchedule{ConsumerID: consumer.ID, Bids: bids}
+
+	return putPrivateObject(ctx, consumer.MSPID, bidObjectType, consumer.ID, schedule)
+}
+
+// ClearDayAhead clears every interval of a delivery date and records the
+// trades of each. Each interval is cleared exactly, as in ClearMarketExact,
+// with the participants' schedules applied; a participant without a schedule
+// takes part with its own limits and coefficients in every interval. The
+// intervals are cleared in order, so each producer's ramp limits, minimum up
+// and down times and start-up cost apply from one interval to the next and
+// from the last interval of the previous day cleared. Storage units take part
+// as both a consumer and a producer, and the state of charge each interval
+// leaves is what the next one can charge into and discharge from. Each
+// interval's trades settle the energy dispatched over its hours. The
+// schedule is stored under the delivery date, which can be cleared only once.
+// Only a market operator may clear the day.
+func (s *EnergyMarket) ClearDayAhead(ctx contractapi.TransactionContextInterface, deliveryDate string) (*DaySchedule, error) {
+	if _, err := time.Parse(deliveryDateLayout, deliveryDate); err != nil {
+		return nil, fmt.Errorf("invalid delivery date %q, expected %s", deliveryDate, deliveryDateLayout)
+	}
+
+	var existing DaySchedule
+	found, err := getObject(ctx, dayAheadObjectType, deliveryDate, &existing)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		return nil, fmt.Errorf("delivery date %s has already been cleared", deliveryDate)
+	}
+
+	marketState, err := loadMarketState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	offers, bids, err := getSchedules(ctx, marketState)
+	if err != nil {
+		return nil, err
+	}
+	storages, err := getAllStorage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	day := &DaySchedule{
+		DeliveryDate:  deliveryDate,
+		Periods:       config.periods(),
+		ConfigVersion: config.Version,
+		ClearedAt:     timestamp.Format(orderTimestampLayout),
+		Intervals:     []IntervalResult{},
+	}
+
+	status := make([]unitStatus, len(marketState.Producers))
+	for i, producer := range marketState.Producers {
+		status[i] = unitStatus{online: !producer.Offline, periods: producer.StatusPeriods, output: producer.LastOutput}
+	}
+	hours := 24 / float64(day.Periods)
+
+	for t := 0; t < day.Periods; t++ {
+		// Clear the interval on a copy so the schedule does not overwrite the
+		// participants' own parameters
+		scheduled := cloneMarketState(marketState)
+		applySchedules(scheduled, offers, bids, t)
+		units := addStorage(scheduled, storages, hours)
+
+		// Storage is online in every interval it can discharge in
+		intervalStatus := append([]unitStatus{}, status...)
+		for len(intervalStatus) < len(scheduled.Producers) {
+			intervalStatus = append(intervalStatus, unitStatus{online: true})
+		}
+
+		interval, price, online, err := clearCommittedInterval(scheduled, intervalStatus, config.gridCharges(scheduled))
+		if err != nil {
+			return nil, fmt.Errorf("failed to clear interval %d: %v", t, err)
+		}
+		trades, err := s.recordOptimizedTrades(ctx, interval, config, nil, hours)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record trades of interval %d: %v", t, err)
+		}
+
+		result := IntervalResult{
+			Interval:        t,
+			Lambda:          price,
+			Producers:       []IntervalDispatch{},
+			Consumers:       []IntervalDispatch{},
+			TotalGeneration: interval.TotalGeneration,
+			TotalDemand:     interval.TotalDemand,
+			SocialWelfare:   interval.SocialWelfare,
+			TradeIDs:        []string{},
+		}
+		for i, producer := range interval.Producers[:len(status)] {
+			dispatch := IntervalDispatch{ID: producer.ID, Quantity: producer.Production, Online: online[i]}
+			if online[i] && !status[i].online {
+				result.StartupCost += producer.StartupCost
+			}
+			result.Producers = append(result.Producers, dispatch)
+			status[i] = nextStatus(status[i], online[i], producer.Production)
+		}
+		for _, consumer := range interval.Consumers[:len(marketState.Consumers)] {
+			result.Consumers = append(result.Consumers, IntervalDispatch{ID: consumer.ID, Quantity: consumer.TotalDemand})
+		}
+		for _, trade := range trades {
+			result.TradeIDs = append(result.TradeIDs, trade.ID)
+		}
+
+		// Carry the settlement forward so the next interval's trades build on it
+		for i := range marketState.Producers {
+			marketState.Producers[i].TradedVolume = interval.Producers[i].TradedVolume
+		}
+		for j := range marketState.Consumers {
+			marketState.Consumers[j].Balance = interval.Consumers[j].Balance
+		}
+		marketState.Statistics = interval.Statistics
+
+		// Carry the storage's state of charge into the next interval. Its
+		// charging was paid for from the owner's account directly.
+		for k, unit := range units {
+			storage := &storages[k]
+			charge, discharge := 0.0, 0.0
+			if unit.consumer >= 0 {
+				charge = interval.Consumers[unit.consumer].TotalDemand
+			}
+			if unit.producer >= 0 {
+				discharge = interval.Producers[unit.producer].Production
+				storage.TradedVolume += interval.Producers[unit.producer].TradedVolume
+			}
+			storage.StateOfCharge = nextStateOfCharge(storage, charge, discharge, hours)
+			result.Storage = append(result.Storage, StorageDispatch{ID: storage.ID, Charge: charge, Discharge: discharge, StateOfCharge: storage.StateOfCharge})
+		}
+		day.Intervals = append(day.Intervals, result)
+	}
+
+	// The next day starts from the status the units end this one in
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		producer.Offline = !status[i].online
+		producer.StatusPeriods = status[i].periods
+		producer.LastOutput = status[i].output
+	}
+
+	// Only the settlement, the unit status and the state of charge changed,
+	// the clearing variables are left alone
+	if err := putParticipants(ctx, marketState); err != nil {
+		return nil, err
+	}
+	for k := range storages {
+		if err := putStorage(ctx, &storages[k]); err != nil {
+			return nil, err
+		}
+	}
+	if err := putObject(ctx, dayAheadObjectType, deliveryDate, day); err != nil {
+		return nil, err
+	}
+
+	return day, nil
+}
+
+// GetMarketResults retrieves the day-ahead schedule of a delivery date, or of
+// the latest cleared date when empty. With an interval number only that
+// interval is returned, otherwise the whole day.
+func (s *EnergyMarket) GetMarketResults(ctx contractapi.TransactionContextInterface, deliveryDate string, interval string) (*DaySchedule, error) {
+	var day DaySchedule
+	if deliveryDate == "" {
+		// Delivery dates sort in date order, so the last key is the latest
+		found := false
+		err := scanObjects(ctx, dayAheadObjectType, func(value []byte) error {
+			found = true
+			day = DaySchedule{}
+			if err := json.Unmarshal(value, &day); err != nil {
+				return fmt.Errorf("failed to unmarshal day-ahead schedule: %v", err)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("no day has been cleared yet")
+		}
+	} else {
+		found, err := getObject(ctx, dayAheadObjectType, deliveryDate, &day)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("delivery date %s has not been cleared", deliveryDate)
+		}
+	}
+
+	if interval == "" {
+		return &day, nil
+	}
+
+	t, err := strconv.Atoi(interval)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval: %v", err)
+	}
+	if t < 0 || t >= len(day.Intervals) {
+		return nil, fmt.Errorf("interval %d is outside the %d intervals of %s", t, len(day.Intervals), day.DeliveryDate)
+	}
+	day.Intervals = day.Intervals[t : t+1]
+
+	return &day, nil
+}
+
+// getSchedules reads the schedule of every producer and consumer of a market
+// state, keyed by participant ID
+func getSchedules(ctx contractapi.TransactionContextInterface, marketState *MarketState) (map[string][]IntervalOffer, map[string][]IntervalBid, error) {
+	offers := make(map[string][]IntervalOffer)
+	for _, producer := range marketState.Producers {
+		var schedule ProducerSchedule
+		found, err := getPrivateObject(ctx, producer.MSPID, offerObjectType, producer.ID, &schedule)
+		if err != nil {
+			return nil, nil, err
+		}
+		if found {
+			offers[producer.ID] = schedule.Offers
+		}
+	}
+
+	bids := make(map[string][]IntervalBid)
+	for _, consumer := range marketState.Consumers {
+		var schedule ConsumerSchedule
+		found, err := getPrivateObject(ctx, consumer.MSPID, bidObjectType, consumer.ID, &schedule)
+		if err != nil {
+			return nil, nil, err
+		}
+		if found {
+			bids[consumer.ID] = schedule.Bids
+		}
+	}
+
+	return offers, bids, nil
+}
+
+// applySchedules overrides the participants' limits and bid coefficients with
+// their schedules for interval t. A schedule set before the number of periods
+// changed and too short for the interval is ignored.
+func applySchedules(marketState *MarketState, offers map[string][]IntervalOffer, bids map[string][]IntervalBid, t int) {
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		if schedule := offers[producer.ID]; t < len(schedule) {
+			producer.ProductionMin = schedule[t].ProductionMin
+			producer.ProductionMax = schedule[t].ProductionMax
+			producer.B = schedule[t].B
+		}
+	}
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		if schedule := bids[consumer.ID]; t < len(schedule) {
+			consumer.DemandMin = schedule[t].DemandMin
+			consumer.DemandMax = schedule[t].DemandMax
+			consumer.Beta = schedule[t].Beta
+		}
+	}
+}
+
+// validLimits reports whether a pair of limits is finite, non-negative and ordered
+func validLimits(min float64, max float64) bool {
+	if math.IsNaN(min) || math.IsNaN(max) || math.IsInf(max, 0) {
+		return false
+	}
+	return min >= 0 && min <= max
+}
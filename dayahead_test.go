@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// setPeriods publishes a config with the given number of day-ahead intervals
+func (market *testMarket) setPeriods(periods int) {
+	config := *defaultMarketConfig()
+	config.Periods = periods
+	if _, err := market.contract.SetMarketConfig(market.operator(), config); err != nil {
+		market.t.Fatalf("SetMarketConfig failed: %v", err)
+	}
+}
+
+// setDemand schedules every consumer of the default market to take a fixed
+// demand in each interval
+func (market *testMarket) setDemand(demands []float64) {
+	for _, consumer := range defaultMarketSeed().Consumers {
+		bids := []IntervalBid{}
+		for _, demand := range demands {
+			bids = append(bids, IntervalBid{DemandMin: demand, DemandMax: demand, Beta: consumer.Beta})
+		}
+		bidsJSON, err := json.Marshal(bids)
+		if err != nil {
+			market.t.Fatal(err)
+		}
+		ctx := market.participant(consumer.ID)
+		market.stub.TransientMap[bidsTransientKey] = bidsJSON
+		if err := market.contract.SetConsumerSchedule(ctx, consumer.ID); err != nil {
+			market.t.Fatalf("SetConsumerSchedule of %s failed: %v", consumer.ID, err)
+		}
+	}
+}
+
+func TestDayAheadSettlesTheEnergyOfEachInterval(t *testing.T) {
+	tests := []struct {
+		periods int
+		hours   float64
+	}{
+		{24, 1},
+		{6, 4},
+		{4, 6},
+	}
+	var dayEnergy Energy
+	for _, test := range tests {
+		market := newTestMarket(t)
+		market.setPeriods(test.periods)
+		demands := make([]float64, test.periods)
+		for t := range demands {
+			demands[t] = 80
+		}
+		market.setDemand(demands)
+
+		day, err := market.contract.ClearDayAhead(market.operator(), "2024-06-01")
+		if err != nil {
+			t.Fatalf("%d periods: ClearDayAhead failed: %v", test.periods, err)
+		}
+		if len(day.Intervals) != test.periods {
+			t.Fatalf("%d periods: cleared %d intervals", test.periods, len(day.Intervals))
+		}
+
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		byID := map[string]Trade{}
+		for _, trade := range trades {
+			byID[trade.ID] = trade
+		}
+
+		// Each interval trades the demand no consumer covers from its own
+		// producer, held for the interval's hours
+		var energy Energy
+		for _, interval := range day.Intervals {
+			var traded Energy
+			for _, id := range interval.TradeIDs {
+				traded += byID[id].Quantity
+			}
+			if limit, _ := toEnergy(interval.TotalDemand * test.hours); traded <= 0 || traded > limit {
+				t.Errorf("%d periods: interval %d traded %s of a demand of %s", test.periods, interval.Interval, traded, limit)
+			}
+			energy += traded
+		}
+
+		// A flat day trades the same energy however it is divided, up to the
+		// rounding of each trade
+		if dayEnergy == 0 {
+			dayEnergy = energy
+		} else if diff := energy - dayEnergy; diff > 10000 || diff < -10000 {
+			t.Errorf("%d periods: the day traded %s, %d hourly periods traded %s", test.periods, energy, tests[0].periods, dayEnergy)
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestClearDayAheadClearsEachDateOnce(t *testing.T) {
+	market := newTestMarket(t)
+	market.setPeriods(4)
+
+	tests := []struct {
+		deliveryDate string
+		ok           bool
+	}{
+		{"", false},
+		{"01/06/2024", false},
+		{"2024-06-01", true},
+		{"2024-06-01", false},
+		{"2024-06-02", true},
+	}
+	settled := 0
+	for _, test := range tests {
+		_, err := market.contract.ClearDayAhead(market.operator(), test.deliveryDate)
+		if (err == nil) != test.ok {
+			t.Fatalf("ClearDayAhead of %q returned %v, want success %v", test.deliveryDate, err, test.ok)
+		}
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ok == (len(trades) == settled) {
+			t.Errorf("clearing %q recorded %d trades, want success %v", test.deliveryDate, len(trades)-settled, test.ok)
+		}
+		settled = len(trades)
+	}
+
+	// The latest date and a single interval can be read back
+	day, err := market.contract.GetMarketResults(market.operator(), "", "2")
+	if err != nil {
+		t.Fatalf("GetMarketResults failed: %v", err)
+	}
+	if day.DeliveryDate != "2024-06-02" || len(day.Intervals) != 1 || day.Intervals[0].Interval != 2 {
+		t.Errorf("GetMarketResults returned %s with %d intervals, want interval 2 of 2024-06-02", day.DeliveryDate, len(day.Intervals))
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// fundsObjectType holds the deposit and withdrawal requests, in the private
+// data collection with the balances they move. fundsStatusType holds the
+// public status of each request, so open requests can be found and a request
+// can be looked up in its user's collection.
+const (
+	fundsObjectType = "FundsRequest"
+	fundsStatusType = "FundsStatus"
+)
+
+// Kinds of funds request
+const (
+	FundsDeposit    = "deposit"    // Fiat paid into the market's bank account, credited once settled
+	FundsWithdrawal = "withdrawal" // Credits paid out to the user's bank account once settled
+)
+
+// Statuses a funds request moves through. A request starts pending, is
+// approved by an operator and is settled once the bank transfer is made, or
+// is rejected before it settles.
+const (
+	FundsStatusPending  = "pending"
+	FundsStatusApproved = "approved"
+	FundsStatusSettled  = "settled"
+	FundsStatusRejected = "rejected"
+)
+
+// FundsRequest is a request to move money between a user's bank account and
+// their energy credits. Its references tie it to the off-chain bank transfer,
+// so the ledger can be reconciled with the bank statement.
+type FundsRequest struct {
+	ID            string `json:"id"`
+	UserID        string `json:"userId"`
+	Type          string `json:"type"`                    // "deposit" or "withdrawal"
+	Amount        Amount `json:"amount"`                  // Credits to mint or pay out, in micro-USD
+	Status        string `json:"status"`                  // "pending", "approved", "settled" or "rejected"
+	Reference     string `json:"reference"`               // The user's payment reference or bank account
+	BankReference string `json:"bankReference,omitempty"` // The bank transfer that settled the request
+	Reason        string `json:"reason,omitempty"`        // Why the request was rejected
+	RequestedAt   string `json:"requestedAt"`
+	ApprovedAt    string `json:"approvedAt,omitempty"`
+	ApprovedBy    string `json:"approvedBy,omitempty"`
+	SettledAt     string `json:"settledAt,omitempty"`
+	SettledBy     string `json:"settledBy,omitempty"`
+	RejectedAt    string `json:"rejectedAt,omitempty"`
+	RejectedBy    string `json:"rejectedBy,omitempty"`
+	mspID         string // Organisation of the user, whose collection holds the request
+}
+
+// FundsStatus is the public record of a funds request
+type FundsStatus struct {
+	ID     string `json:"id"`
+	UserID string `json:"userId"`
+	MSPID  string `json:"mspId"`
+	Status string `json:"status"`
+}
+
+// RequestDeposit records that a user is paying an amount in USD into the
+// market's bank account. The credits are minted when an operator settles it.
+func (s *EnergyMarket) RequestDeposit(ctx contractapi.TransactionContextInterface, userID string, amount float64, reference string) (*FundsRequest, error) {
+	return newFundsRequest(ctx, userID, FundsDeposit, amount, reference)
+}
+
+// RequestWithdrawal asks for an amount in USD of a user's available credits
+// to be paid out to their bank account. The credits are locked until the
+// request settles, when they are burned, or is rejected, when they are
+// released.
+func (s *EnergyMarket) RequestWithdrawal(ctx contractapi.TransactionContextInterface, userID string, amount float64, reference string) (*FundsRequest, error) {
+	return newFundsRequest(ctx, userID, FundsWithdrawal, amount, reference)
+}
+
+// ApproveFundsRequest approves a pending deposit or withdrawal. Only a
+// market operator may call it.
+func (s *EnergyMarket) ApproveFundsRequest(ctx contractapi.TransactionContextInterface, requestID string) (*FundsRequest, error) {
+	request, err := getFundsRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != FundsStatusPending {
+		return nil, fmt.Errorf("funds request %s is %s, not %s", requestID, request.Status, FundsStatusPending)
+	}
+
+	timestamp, caller, err := fundsActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = FundsStatusApproved
+	request.ApprovedAt = timestamp
+	request.ApprovedBy = caller
+
+	if err := putFundsRequest(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// SettleFundsRequest records the bank transfer of an approved request and
+// moves the credits: a deposit mints them into the user's account and a
+// withdrawal burns the credits it locked. Only a market operator may call it.
+func (s *EnergyMarket) SettleFundsRequest(ctx contractapi.TransactionContextInterface, requestID string, bankReference string) (*FundsRequest, error) {
+	if bankReference == "" {
+		return nil, fmt.Errorf("bank reference is required")
+	}
+	request, err := getFundsRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != FundsStatusApproved {
+		return nil, fmt.Errorf("funds request %s is %s, not %s", requestID, request.Status, FundsStatusApproved)
+	}
+
+	account, err := getAccount(ctx, request.UserID)
+	if err != nil {
+		return nil, err
+	}
+	supply, err := getTokenSupply(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	switch request.Type {
+	case FundsDeposit:
+		if account.Balance > maxAmount-request.Amount || supply.Total > maxAmount-request.Amount {
+			return nil, fmt.Errorf("depositing %s would overflow the supply", request.Amount)
+		}
+		account.Balance += request.Amount
+		supply.Total += request.Amount
+	case FundsWithdrawal:
+		if account.LockedBalance < request.Amount {
+			return nil, fmt.Errorf("user %s has %s locked, withdrawal %s requires %s", request.UserID, account.LockedBalance, requestID, request.Amount)
+		}
+		account.LockedBalance -= request.Amount
+		supply.Total -= request.Amount
+	}
+
+	timestamp, caller, err := fundsActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = FundsStatusSettled
+	request.BankReference = bankReference
+	request.SettledAt = timestamp
+	request.SettledBy = caller
+
+	if err := putAccountObject(ctx, account); err != nil {
+		return nil, err
+	}
+	if err := putTokenSupply(ctx, supply); err != nil {
+		return nil, err
+	}
+	if err := putFundsRequest(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// RejectFundsRequest rejects a pending or approved request that has not
+// settled, releasing the credits a withdrawal locked. Only a market operator
+// may call it.
+func (s *EnergyMarket) RejectFundsRequest(ctx contractapi.TransactionContextInterface, requestID string, reason string) (*FundsRequest, error) {
+	request, err := getFundsRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != FundsStatusPending && request.Status != FundsStatusApproved {
+		return nil, fmt.Errorf("funds request %s is already %s", requestID, request.Status)
+	}
+
+	if request.Type == FundsWithdrawal {
+		account, err := getAccount(ctx, request.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if account.LockedBalance < request.Amount {
+			return nil, fmt.Errorf("user %s has %s locked, withdrawal %s requires %s", request.UserID, account.LockedBalance, requestID, request.Amount)
+		}
+		account.LockedBalance -= request.Amount
+		account.Balance += request.Amount
+		if err := putAccountObject(ctx, account); err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp, caller, err := fundsActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request.Status = FundsStatusRejected
+	request.Reason = reason
+	request.RejectedAt = timestamp
+	request.RejectedBy = caller
+
+	if err := putFundsRequest(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// GetFundsRequest retrieves a deposit or withdrawal request
+func (s *EnergyMarket) GetFundsRequest(ctx contractapi.TransactionContextInterface, requestID string) (*FundsRequest, error) {
+	request, err := getFundsRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if err := assertCanRead(ctx, request.UserID); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// GetFundsHistory retrieves every deposit and withdrawal request of a user,
+// oldest first, so their credits can be reconciled with their bank account
+func (s *EnergyMarket) GetFundsHistory(ctx contractapi.TransactionContextInterface, userID string) ([]FundsRequest, error) {
+	if err := assertCanRead(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	history := []FundsRequest{}
+	err := scanObjects(ctx, fundsStatusType, func(value []byte) error {
+		var status FundsStatus
+		if err := json.Unmarshal(value, &status); err != nil {
+			return fmt.Errorf("failed to unmarshal funds status: %v", err)
+		}
+		if status.UserID != userID {
+			return nil
+		}
+		request, err := readFundsRequest(ctx, &status)
+		if err != nil {
+			return err
+		}
+		history = append(history, *request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		if history[i].RequestedAt != history[j].RequestedAt {
+			return history[i].RequestedAt < history[j].RequestedAt
+		}
+		return history[i].ID < history[j].ID
+	})
+
+	return history, nil
+}
+
+// newFundsRequest records a pending deposit or withdrawal of the caller,
+// locking the credits of a withdrawal
+func newFundsRequest(ctx contractapi.TransactionContextInterface, userID string, requestType string, amount float64, reference string) (*FundsRequest, error) {
+	if err := assertCaller(ctx, userID); err != nil {
+		return nil, err
+	}
+	value, err := creditAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	if reference == "" {
+		return nil, fmt.Errorf("payment reference is required")
+	}
+
+	account, err := getAccount(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if requestType == FundsWithdrawal {
+		if account.Balance < value {
+			return nil, fmt.Errorf("insufficient credits: user %s has %s available, withdrawal requires %s", userID, account.Balance, value)
+		}
+		account.Balance -= value
+		account.LockedBalance += value
+		if err := putAccountObject(ctx, account); err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request := &FundsRequest{
+		ID:          "FUNDS_" + ctx.GetStub().GetTxID(),
+		UserID:      userID,
+		Type:        requestType,
+		Amount:      value,
+		Status:      FundsStatusPending,
+		Reference:   reference,
+		RequestedAt: timestamp.Format(orderTimestampLayout),
+		mspID:       account.mspID,
+	}
+
+	if err := putFundsRequest(ctx, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// getFundsRequest reads a funds request that must exist
+func getFundsRequest(ctx contractapi.TransactionContextInterface, requestID string) (*FundsRequest, error) {
+	var status FundsStatus
+	found, err := getObject(ctx, fundsStatusType, requestID, &status)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("funds request %s not found", requestID)
+	}
+	return readFundsRequest(ctx, &status)
+}
+
+// readFundsRequest reads the private record of a funds request from the
+// collection its status names
+func readFundsRequest(ctx contractapi.TransactionContextInterface, status *FundsStatus) (*FundsRequest, error) {
+	request := FundsRequest{mspID: status.MSPID}
+	found, err := getPrivateObject(ctx, status.MSPID, fundsObjectType, status.ID, &request)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("funds request %s not found", status.ID)
+	}
+	return &request, nil
+}
+
+// putFundsRequest stores a funds request in its user's collection and its
+// status in the public record
+func putFundsRequest(ctx contractapi.TransactionContextInterface, request *FundsRequest) error {
+	if err := putPrivateObject(ctx, request.mspID, fundsObjectType, request.ID, request); err != nil {
+		return err
+	}
+	status := FundsStatus{ID: request.ID, UserID: request.UserID, MSPID: request.mspID, Status: request.Status}
+	return putObject(ctx, fundsStatusType, request.ID, status)
+}
+
+// assertNoOpenFundsRequests checks that every funds request has settled or
+// been rejected
+func assertNoOpenFundsRequests(ctx contractapi.TransactionContextInterface) error {
+	return scanObjects(ctx, fundsStatusType, func(value []byte) error {
+		var status FundsStatus
+		if err := json.Unmarshal(value, &status); err != nil {
+			return fmt.Errorf("failed to unmarshal funds status: %v", err)
+		}
+		if status.Status == FundsStatusPending || status.Status == FundsStatusApproved {
+			return fmt.Errorf("funds request %s of user %s is still %s", status.ID, status.UserID, status.Status)
+		}
+		return nil
+	})
+}
+
+// fundsActor returns the time of the transaction and the identity of the
+// operator moving a request on
+func fundsActor(ctx contractapi.TransactionContextInterface) (string, string, error) {
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	caller, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read caller identity: %v", err)
+	}
+	return timestamp.Format(orderTimestampLayout), caller, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import "testing"
+
+func TestFundsRequestsMoveThroughTheirStatuses(t *testing.T) {
+	type step struct {
+		action string // "approve", "settle" or "reject"
+		ok     bool
+	}
+	tests := []struct {
+		name        string
+		kind        string
+		steps       []step
+		status      string
+		balance     Amount // consumer1's available credits at the end
+		locked      Amount
+		totalSupply Amount
+	}{
+		{"deposit settled", FundsDeposit, []step{{"approve", true}, {"settle", true}}, FundsStatusSettled, 10250000000, 0, 60250000000},
+		{"deposit settled unapproved", FundsDeposit, []step{{"settle", false}}, FundsStatusPending, 10000000000, 0, 60000000000},
+		{"deposit rejected", FundsDeposit, []step{{"reject", true}, {"approve", false}, {"settle", false}}, FundsStatusRejected, 10000000000, 0, 60000000000},
+		{"deposit settled twice", FundsDeposit, []step{{"approve", true}, {"settle", true}, {"settle", false}, {"reject", false}}, FundsStatusSettled, 10250000000, 0, 60250000000},
+		{"withdrawal pending", FundsWithdrawal, nil, FundsStatusPending, 9750000000, 250000000, 60000000000},
+		{"withdrawal approved", FundsWithdrawal, []step{{"approve", true}, {"approve", false}}, FundsStatusApproved, 9750000000, 250000000, 60000000000},
+		{"withdrawal settled", FundsWithdrawal, []step{{"approve", true}, {"settle", true}}, FundsStatusSettled, 9750000000, 0, 59750000000},
+		{"withdrawal rejected after approval", FundsWithdrawal, []step{{"approve", true}, {"reject", true}, {"settle", false}}, FundsStatusRejected, 10000000000, 0, 60000000000},
+	}
+	for _, test := range tests {
+		market := newTestMarket(t)
+		request, err := newFundsRequest(market.participant("consumer1"), "consumer1", test.kind, 250, "IBAN DE00 1234")
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", test.name, err)
+		}
+
+		for _, step := range test.steps {
+			switch step.action {
+			case "approve":
+				_, err = market.contract.ApproveFundsRequest(market.operator(), request.ID)
+			case "settle":
+				_, err = market.contract.SettleFundsRequest(market.operator(), request.ID, "BANK-0001")
+			case "reject":
+				_, err = market.contract.RejectFundsRequest(market.operator(), request.ID, "unknown payment")
+			}
+			if (err == nil) != step.ok {
+				t.Errorf("%s: %s returned %v, want success %v", test.name, step.action, err, step.ok)
+			}
+		}
+
+		request, err = market.contract.GetFundsRequest(market.participant("consumer1"), request.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if request.Status != test.status {
+			t.Errorf("%s: request is %s, want %s", test.name, request.Status, test.status)
+		}
+		consumer := market.consumer("consumer1")
+		if consumer.Balance != test.balance || consumer.LockedBalance != test.locked {
+			t.Errorf("%s: consumer1 has %s available and %s locked, want %s and %s", test.name, consumer.Balance, consumer.LockedBalance, test.balance, test.locked)
+		}
+		supply, err := market.contract.TotalSupply(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if supply != test.totalSupply {
+			t.Errorf("%s: total supply is %s, want %s", test.name, supply, test.totalSupply)
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestWithdrawalLocksItsCredits(t *testing.T) {
+	market := newTestMarket(t)
+	request, err := market.contract.RequestWithdrawal(market.participant("consumer1"), "consumer1", 9000, "IBAN DE00 1234")
+	if err != nil {
+		t.Fatalf("RequestWithdrawal failed: %v", err)
+	}
+
+	// The locked credits cannot be spent, burned or withdrawn again
+	spends := []struct {
+		name string
+		run  func() error
+	}{
+		{"transfer", func() error {
+			return market.contract.Transfer(market.participant("consumer1"), "consumer1", "consumer2", 1500)
+		}},
+		{"burn", func() error { return market.contract.Burn(market.participant("consumer1"), "consumer1", 1500) }},
+		{"buy order", func() error {
+			return market.contract.PlaceOrder(market.participant("consumer1"), "buy", 100, 15, "consumer1", "")
+		}},
+		{"second withdrawal", func() error {
+			_, err := market.contract.RequestWithdrawal(market.participant("consumer1"), "consumer1", 1500, "IBAN DE00 1234")
+			return err
+		}},
+	}
+	for _, spend := range spends {
+		if err := spend.run(); err == nil {
+			t.Errorf("%s of locked credits was accepted", spend.name)
+		}
+	}
+
+	// An open request keeps the market from being reset
+	if err := market.contract.InitMarket(market.operator()); err == nil {
+		t.Errorf("InitMarket reset the market with a withdrawal open")
+	}
+
+	// Only the requesting user may open a request
+	if _, err := market.contract.RequestWithdrawal(market.participant("consumer2"), "consumer1", 10, "IBAN DE00 1234"); err == nil {
+		t.Errorf("consumer2 opened a withdrawal from consumer1's account")
+	}
+
+	if _, err := market.contract.RejectFundsRequest(market.operator(), request.ID, "closed account"); err != nil {
+		t.Fatalf("RejectFundsRequest failed: %v", err)
+	}
+	if err := market.contract.Transfer(market.participant("consumer1"), "consumer1", "consumer2", 1500); err != nil {
+		t.Errorf("the released credits cannot be transferred: %v", err)
+	}
+	market.assertSupplyConsistent()
+}
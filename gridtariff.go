@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// GridTariff is the DSO's charge for delivering energy from a producer to a
+// consumer, set by their electrical distance. Fee is charged per MWh
+// delivered and paid into the configured fee account. LossFactor is the energy lost in the network per MWh delivered,
+// which the producer must generate on top and the consumer pays for at the
+// producer's price.
+type GridTariff struct {
+	ProducerID string  `json:"producerId"`
+	ConsumerID string  `json:"consumerId"`
+	Fee        float64 `json:"fee"`        // Network fee per MWh delivered
+	LossFactor float64 `json:"lossFactor"` // MWh lost per MWh delivered, in [0, 1)
+}
+
+// gridCharge is the tariff between one consumer and one producer
+type gridCharge struct {
+	fee  float64
+	loss float64
+}
+
+// tradeCharges are the network components of a trade's value
+type tradeCharges struct {
+	networkFee     Amount
+	lossCharge     Amount
+	lossQuantity   Energy
+	congestionRent Amount
+}
+
+// deliveredPrice returns what a consumer pays per MWh delivered when the
+// producer sells at a price
+func (charge gridCharge) deliveredPrice(price float64) float64 {
+	return price*(1+charge.loss) + charge.fee
+}
+
+// gridCharges returns the tariff of every consumer and producer pair of the
+// market, indexed by consumer and then producer. Pairs without a tariff are
+// charged nothing. It returns nil when no tariff is configured.
+func (config *MarketConfig) gridCharges(marketState *MarketState) [][]gridCharge {
+	if len(config.GridTariffs) == 0 {
+		return nil
+	}
+
+	tariffs := make(map[[2]string]gridCharge)
+	for _, tariff := range config.GridTariffs {
+		tariffs[[2]string{tariff.ConsumerID, tariff.ProducerID}] = gridCharge{fee: tariff.Fee, loss: tariff.LossFactor}
+	}
+
+	charges := make([][]gridCharge, len(marketState.Consumers))
+	for j, consumer := range marketState.Consumers {
+		charges[j] = make([]gridCharge, len(marketState.Producers))
+		for i, producer := range marketState.Producers {
+			charges[j][i] = tariffs[[2]string{consumer.ID, producer.ID}]
+		}
+	}
+	return charges
+}
+
+// chargeAt returns the tariff between consumer j and producer i, which is
+// nothing when no tariff is configured
+func chargeAt(charges [][]gridCharge, j int, i int) gridCharge {
+	if charges == nil {
+		return gridCharge{}
+	}
+	return charges[j][i]
+}
+
+// blendedCharge returns the tariff consumer j pays on average when its demand
+// is split across the producers by the given shares
+func blendedCharge(charges [][]gridCharge, j int, shares []float64) gridCharge {
+	var blended gridCharge
+	if charges == nil {
+		return blended
+	}
+	for i, share := range shares {
+		blended.fee += share * charges[j][i].fee
+		blended.loss += share * charges[j][i].loss
+	}
+	return blended
+}
+
+// maxCharge returns the largest fee and loss factor consumer j faces from any
+// producer
+func maxCharge(charges [][]gridCharge, j int) gridCharge {
+	var largest gridCharge
+	if charges == nil {
+		return largest
+	}
+	for _, charge := range charges[j] {
+		largest.fee = math.Max(largest.fee, charge.fee)
+		largest.loss = math.Max(largest.loss, charge.loss)
+	}
+	return largest
+}
+
+// priceRange returns the producer prices between which the delivered price
+// runs from low to high, under any tariff up to this one
+func (charge gridCharge) priceRange(low float64, high float64) (float64, float64) {
+	low -= charge.fee
+	return math.Min(low, low/(1+charge.loss)), math.Max(high, high/(1+charge.loss))
+}
+
+// validateGridTariffs checks that every tariff names a pair once and has a
+// non-negative fee and a loss factor below one
+func validateGridTariffs(tariffs []GridTariff) error {
+	seen := make(map[[2]string]bool)
+	for k, tariff := range tariffs {
+		if tariff.ProducerID == "" || tariff.ConsumerID == "" {
+			return fmt.Errorf("grid tariff %d must name a producer and a consumer", k)
+		}
+		pair := [2]string{tariff.ConsumerID, tariff.ProducerID}
+		if seen[pair] {
+			return fmt.Errorf("grid tariff from producer %s to consumer %s is given twice", tariff.ProducerID, tariff.ConsumerID)
+		}
+		seen[pair] = true
+
+		if !(tariff.Fee >= 0) || math.IsInf(tariff.Fee, 0) {
+			return fmt.Errorf("grid tariff %d fee must be a non-negative number", k)
+		}
+		if !(tariff.LossFactor >= 0) || tariff.LossFactor >= 1 {
+			return fmt.Errorf("grid tariff %d loss factor must be between 0 and 1", k)
+		}
+	}
+	return nil
+}
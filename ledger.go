@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// ProducerSeed describes a producer created by InitLedgerWithConfig
+type ProducerSeed struct {
+	ID            string       `json:"id"`
+	A             float64      `json:"a"`                     // Quadratic cost coefficient
+	B             float64      `json:"b"`                     // Linear cost coefficient
+	ProductionMin float64      `json:"productionMin"`         // Minimum production limit
+	ProductionMax float64      `json:"productionMax"`         // Maximum production limit
+	OwnerID       string       `json:"ownerId"`               // ID of the consumer who owns this producer
+	CostCurve     []CostPoint  `json:"costCurve,omitempty"`   // Piecewise-linear cost curve, used instead of A and B when set
+	OfferBlocks   []OfferBlock `json:"offerBlocks,omitempty"` // Block offer, used instead of A and B when set
+}
+
+// ConsumerSeed describes a consumer created by InitLedgerWithConfig
+type ConsumerSeed struct {
+	ID           string         `json:"id"`
+	Beta         float64        `json:"beta"`                   // Utility function parameter of the quadratic and log models
+	Theta        float64        `json:"theta"`                  // Utility function parameter of the quadratic and log models
+	DemandMin    float64        `json:"demandMin"`              // Minimum demand limit
+	DemandMax    float64        `json:"demandMax"`              // Maximum demand limit
+	Balance      float64        `json:"balance"`                // Starting balance in USD
+	UtilityModel string         `json:"utilityModel,omitempty"` // "quadratic" (default), "log", "piecewise" or "block"
+	UtilityCurve []UtilityPoint `json:"utilityCurve,omitempty"` // Breakpoints of the piecewise utility model
+	DemandBlocks []DemandBlock  `json:"demandBlocks,omitempty"` // Blocks of the block utility model
+}
+
+// MarketSeed is the configuration a market is initialised from
+type MarketSeed struct {
+	Producers   []ProducerSeed `json:"producers"`
+	Consumers   []ConsumerSeed `json:"consumers"`
+	TradingMode string         `json:"tradingMode,omitempty"` // "continuous" (default) or "auction"
+}
+
+// BalanceInfo breaks a user's funds down into escrowed, locked and available
+// amounts
+type BalanceInfo struct {
+	UserID    string `json:"userId"`
+	Balance   Amount `json:"balance"`   // Total funds, escrowed and locked plus available
+	Escrowed  Amount `json:"escrowed"`  // Funds locked by resting buy orders
+	Locked    Amount `json:"locked"`    // Funds locked by pending withdrawals
+	Available Amount `json:"available"` // Funds that can be spent on new orders
+}
+
+// ledgerKeyRanges are the key ranges wiped by ClearLedger
+var ledgerKeyRanges = [][2]string{
+	{"ORDER_", "ORDER_~"},
+	{"TRADE_", "TRADE_~"},
+}
+
+// InitLedger seeds the default market when the ledger is empty. The
+// operator's frontend calls it on every page load, so an existing market is
+// left untouched. The accounts are salted as in InitMarket.
+func (s *EnergyMarket) InitLedger(ctx contractapi.TransactionContextInterface) error {
+	marketStateJSON, err := ctx.GetStub().GetState("MarketState")
+	if err != nil {
+		return fmt.Errorf("failed to read market state: %v", err)
+	}
+	if marketStateJSON != nil {
+		return nil
+	}
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	marketState, err := newMarketState(defaultMarketSeed(), config)
+	if err != nil {
+		return err
+	}
+
+	return putSeededMarket(ctx, marketState)
+}
+
+// InitLedgerWithConfig seeds an empty ledger with the given producers,
+// consumers and trading mode. The consumers' starting balances are minted as
+// energy credits, and the accounts are salted as in InitMarket. Run
+// ClearLedger first to reseed a market.
+func (s *EnergyMarket) InitLedgerWithConfig(ctx contractapi.TransactionContextInterface, seed MarketSeed) error {
+	marketStateJSON, err := ctx.GetStub().GetState("MarketState")
+	if err != nil {
+		return fmt.Errorf("failed to read market state: %v", err)
+	}
+	if marketStateJSON != nil {
+		return fmt.Errorf("market is already initialized, clear the ledger first")
+	}
+
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	marketState, err := newMarketState(seed, config)
+	if err != nil {
+		return err
+	}
+
+	return putSeededMarket(ctx, marketState)
+}
+
+// ClearLedger deletes every order and trade together with the market state
+// and its producer, consumer, storage, balance and statistics keys, their
+// private details and the energy credit supply. The clearing configuration,
+// the transmission network, identity registrations, allowances and the
+// history of funds requests are kept, and the ledger cannot be cleared while
+// a funds request is open. Only a market operator may call it.
+func (s *EnergyMarket) ClearLedger(ctx contractapi.TransactionContextInterface) error {
+	for _, keyRange := range ledgerKeyRanges {
+		if err := deleteKeyRange(ctx, keyRange[0], keyRange[1]); err != nil {
+			return err
+		}
+	}
+
+	// The market state is spread over the header and the per-entity keys
+	if err := deleteMarketObjects(ctx); err != nil {
+		return err
+	}
+
+	err := ctx.GetStub().DelState("MarketState")
+	if err != nil {
+		return fmt.Errorf("failed to delete market state: %v", err)
+	}
+
+	return nil
+}
+
+// GetBalance retrieves a user's total balance together with the part locked
+// in escrow by resting buy orders, the part locked by pending withdrawals and
+// the part still available
+func (s *EnergyMarket) GetBalance(ctx contractapi.TransactionContextInterface, userID string) (*BalanceInfo, error) {
+	if err := assertCanRead(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	consumer, err := getConsumer(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BalanceInfo{
+		UserID:    userID,
+		Balance:   consumer.Balance + consumer.EscrowBalance + consumer.LockedBalance,
+		Escrowed:  consumer.EscrowBalance,
+		Locked:    consumer.LockedBalance,
+		Available: consumer.Balance,
+	}, nil
+}
+
+// putSeededMarket stores a newly seeded market with its participants in the
+// caller's organisation, which keeps their private details and salted
+// balances, and mints the balances it was seeded with
+func putSeededMarket(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("failed to read caller MSP ID: %v", err)
+	}
+	for i := range marketState.Producers {
+		marketState.Producers[i].MSPID = mspID
+	}
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		consumer.MSPID = mspID
+		consumer.accountSalt, err = newSalt(ctx, accountObjectType, consumer.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := putMarketState(ctx, marketState); err != nil {
+		return fmt.Errorf("failed to put market state: %v", err)
+	}
+	return mintSeedBalances(ctx, marketState)
+}
+
+// deleteKeyRange deletes every key in [startKey, endKey)
+func deleteKeyRange(ctx contractapi.TransactionContextInterface, startKey string, endKey string) error {
+	iterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
+	if err != nil {
+		return fmt.Errorf("failed to get keys in range %s: %v", startKey, err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return fmt.Errorf("error iterating keys in range %s: %v", startKey, err)
+		}
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %v", queryResponse.Key, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// testMSPID is the organisation of the test peer and of every test caller
+const testMSPID = "Org1MSP"
+
+// testSalt is passed to every transaction to salt the records it creates
+var testSalt = []byte("0123456789abcdef0123456789abcdef")
+
+// testStub is a MockStub that also hashes and deletes private data, as a peer
+// does, and reports the function a test names as the one invoked
+type testStub struct {
+	*shimtest.MockStub
+	function string
+}
+
+// GetFunctionAndParameters returns the function set by the test
+func (stub *testStub) GetFunctionAndParameters() (string, []string) {
+	return stub.function, nil
+}
+
+// GetPrivateDataHash returns the SHA-256 hash of a private value
+func (stub *testStub) GetPrivateDataHash(collection string, key string) ([]byte, error) {
+	value, err := stub.GetPrivateData(collection, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(value)
+	return hash[:], nil
+}
+
+// DelPrivateData removes a private value
+func (stub *testStub) DelPrivateData(collection string, key string) error {
+	delete(stub.PvtState[collection], key)
+	return nil
+}
+
+// testIdentity is the certificate of a caller, carrying a role and an enrolment ID
+type testIdentity struct {
+	mspID        string
+	role         string
+	enrollmentID string
+}
+
+func (identity testIdentity) GetID() (string, error) {
+	return "x509::CN=" + identity.enrollmentID, nil
+}
+
+func (identity testIdentity) GetMSPID() (string, error) {
+	return identity.mspID, nil
+}
+
+func (identity testIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	switch attrName {
+	case roleAttribute:
+		return identity.role, identity.role != "", nil
+	case enrollmentIDAttribute:
+		return identity.enrollmentID, true, nil
+	}
+	return "", false, nil
+}
+
+func (identity testIdentity) AssertAttributeValue(attrName string, attrValue string) error {
+	value, found, _ := identity.GetAttributeValue(attrName)
+	if !found || value != attrValue {
+		return fmt.Errorf("attribute %s is not %s", attrName, attrValue)
+	}
+	return nil
+}
+
+func (identity testIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
+
+// testMarket is the default market, seeded by InitMarket on a mock ledger,
+// with every consumer's enrolment ID registered to it
+type testMarket struct {
+	t        *testing.T
+	stub     *testStub
+	contract *EnergyMarket
+	txCount  int
+}
+
+// newTestMarket seeds the default market
+func newTestMarket(t *testing.T) *testMarket {
+	t.Setenv("CORE_PEER_LOCALMSPID", testMSPID)
+
+	market := &testMarket{
+		t:        t,
+		stub:     &testStub{MockStub: shimtest.NewMockStub("energymarket", nil)},
+		contract: &EnergyMarket{},
+	}
+	if err := market.contract.InitMarket(market.operator()); err != nil {
+		t.Fatalf("InitMarket failed: %v", err)
+	}
+	for _, consumer := range defaultMarketSeed().Consumers {
+		if _, err := market.contract.RegisterIdentity(market.operator(), testMSPID, consumer.ID, consumer.ID); err != nil {
+			t.Fatalf("RegisterIdentity failed: %v", err)
+		}
+	}
+	return market
+}
+
+// as starts a new transaction called by an identity, passed only the salt as
+// transient data. Transaction IDs increase, so orders placed later sort after
+// earlier ones when their timestamps tie.
+func (market *testMarket) as(identity testIdentity) contractapi.TransactionContextInterface {
+	market.txCount++
+	market.stub.MockTransactionStart(fmt.Sprintf("tx%04d", market.txCount))
+	market.stub.TransientMap = map[string][]byte{saltTransientKey: testSalt}
+
+	ctx := &contractapi.TransactionContext{}
+	ctx.SetStub(market.stub)
+	ctx.SetClientIdentity(identity)
+	return ctx
+}
+
+// operator starts a transaction called by a market operator
+func (market *testMarket) operator() contractapi.TransactionContextInterface {
+	return market.as(testIdentity{mspID: testMSPID, role: RoleOperator, enrollmentID: "admin"})
+}
+
+// participant starts a transaction called by the holder of a consumer's certificate
+func (market *testMarket) participant(consumerID string) contractapi.TransactionContextInterface {
+	return market.as(testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: consumerID})
+}
+
+// consumer reads a consumer with its balance
+func (market *testMarket) consumer(consumerID string) *Consumer {
+	consumer, err := getConsumer(market.operator(), consumerID)
+	if err != nil {
+		market.t.Fatalf("failed to read consumer %s: %v", consumerID, err)
+	}
+	return consumer
+}
+
+// producer reads a producer
+func (market *testMarket) producer(producerID string) *Producer {
+	producer, err := getProducer(market.operator(), producerID)
+	if err != nil {
+		market.t.Fatalf("failed to read producer %s: %v", producerID, err)
+	}
+	return producer
+}
+
+// placeOrder places a limit order, failing the test if it is rejected
+func (market *testMarket) placeOrder(side string, price float64, quantity float64, userID string, producerID string) {
+	err := market.contract.PlaceOrder(market.participant(userID), side, price, quantity, userID, producerID)
+	if err != nil {
+		market.t.Fatalf("failed to place %s order of %s: %v", side, userID, err)
+	}
+}
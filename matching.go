@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// MatchOrders crosses the resting buy and sell orders by price-time priority.
+// Each fill is recorded as a trade at the price of the order that was placed
+// first, both sides are settled from escrow, and filled orders are removed
+// from the order book while partially filled orders keep their remainder.
+func (s *EnergyMarket) MatchOrders(ctx contractapi.TransactionContextInterface) ([]Trade, error) {
+	orderBook, err := s.GetOrderBook(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := getMarketHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if header.TradingMode == TradingModeAuction {
+		return nil, fmt.Errorf("market is in auction mode, orders are filled by ClearAuction")
+	}
+
+	userIDs, producerIDs := orderParticipants(orderBook["buy"], orderBook["sell"])
+	marketState, err := loadParticipants(ctx, userIDs, producerIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	buys := orderBook["buy"]
+	sells := orderBook["sell"]
+	touchedBuys := make([]bool, len(buys))
+	touchedSells := make([]bool, len(sells))
+	trades := []Trade{}
+
+	for bi := range buys {
+		bid := &buys[bi]
+
+		for si := range sells {
+			if bid.Quantity <= 0 {
+				break
+			}
+
+			ask := &sells[si]
+			if ask.Price > bid.Price {
+				// Sells are sorted by ascending price, nothing further crosses
+				break
+			}
+			if ask.Quantity <= 0 || !canCross(bid, ask) {
+				continue
+			}
+
+			// A post-only order never takes liquidity, so it cannot be the later order
+			if (bid.PostOnly && placedBefore(*ask, *bid)) || (ask.PostOnly && placedBefore(*bid, *ask)) {
+				continue
+			}
+
+			quantity := minEnergy(bid.Quantity, ask.Quantity)
+
+			// The order that rested first sets the price
+			price := bid.Price
+			if placedBefore(*ask, *bid) {
+				price = ask.Price
+			}
+
+			trade, err := s.fillOrders(ctx, marketState, bid, ask, price, quantity)
+			if err != nil {
+				return nil, err
+			}
+			trades = append(trades, *trade)
+			touchedBuys[bi] = true
+			touchedSells[si] = true
+		}
+	}
+
+	// Store the remainders and remove the filled orders
+	for i := range buys {
+		if touchedBuys[i] {
+			if err := s.storeOrRemoveOrder(ctx, marketState, &buys[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i := range sells {
+		if touchedSells[i] {
+			if err := s.storeOrRemoveOrder(ctx, marketState, &sells[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(trades) == 0 {
+		return trades, nil
+	}
+
+	if err := putParticipants(ctx, marketState); err != nil {
+		return nil, err
+	}
+
+	return trades, nil
+}
+
+// executeAgainstBook fills an incoming taker order against the resting orders
+// on the other side of the book, which must be sorted by priority. Every fill
+// takes place at the resting order's price, and touched marks the resting
+// orders that were filled so the caller can store or remove them.
+func (s *EnergyMarket) executeAgainstBook(ctx contractapi.TransactionContextInterface, marketState *MarketState, taker *Order, makers []Order, touched []bool) ([]Trade, error) {
+	trades := []Trade{}
+
+	for i := range makers {
+		if taker.Quantity <= 0 {
+			break
+		}
+
+		maker := &makers[i]
+		if !crossesPrice(taker, maker) {
+			break
+		}
+
+		bid, ask := taker, maker
+		if taker.OrderType == "sell" {
+			bid, ask = maker, taker
+		}
+		if maker.Quantity <= 0 || !canCross(bid, ask) {
+			continue
+		}
+
+		quantity := fillQuantity(bid, ask, maker.Price)
+		if quantity <= 0 {
+			// A market buy has run out of budget
+			break
+		}
+
+		trade, err := s.fillOrders(ctx, marketState, bid, ask, maker.Price, quantity)
+		if err != nil {
+			return nil, err
+		}
+		trades = append(trades, *trade)
+		touched[i] = true
+	}
+
+	return trades, nil
+}
+
+// fillableQuantity returns how much of an incoming order would fill against
+// the resting orders right now, without changing any of them
+func fillableQuantity(taker *Order, makers []Order) Energy {
+	remaining := taker.Quantity
+	budget := taker.EscrowAmount
+
+	for i := range makers {
+		if remaining <= 0 {
+			break
+		}
+
+		maker := &makers[i]
+		if !crossesPrice(taker, maker) {
+			break
+		}
+
+		bid, ask := taker, maker
+		if taker.OrderType == "sell" {
+			bid, ask = maker, taker
+		}
+		if maker.Quantity <= 0 || !canCross(bid, ask) {
+			continue
+		}
+
+		quantity := minEnergy(remaining, maker.Quantity)
+		if taker.OrderType == "buy" && taker.ExecutionType == ExecutionMarket {
+			quantity = minEnergy(quantity, affordableEnergy(budget, maker.Price))
+			budget -= valueOf(maker.Price, quantity)
+		}
+		remaining -= quantity
+	}
+
+	return taker.Quantity - remaining
+}
+
+// fillQuantity returns the quantity a buy and a sell order can trade at the
+// given price, limited for market buys by the funds they still have locked
+func fillQuantity(bid *Order, ask *Order, price Amount) Energy {
+	quantity := minEnergy(bid.Quantity, ask.Quantity)
+	if bid.ExecutionType == ExecutionMarket {
+		quantity = minEnergy(quantity, affordableEnergy(bid.EscrowAmount, price))
+	}
+	return quantity
+}
+
+// crossesPrice reports whether an incoming order accepts the price of a
+// resting order. Market orders accept any price.
+func crossesPrice(taker *Order, maker *Order) bool {
+	if taker.ExecutionType == ExecutionMarket {
+		return true
+	}
+	if taker.OrderType == "buy" {
+		return maker.Price <= taker.Price
+	}
+	return maker.Price >= taker.Price
+}
+
+// canCross reports whether a buy and a sell order may trade with each other
+func canCross(bid *Order, ask *Order) bool {
+	// Users cannot trade with themselves
+	if bid.UserID == ask.UserID {
+		return false
+	}
+
+	// A buy order naming a producer only accepts that producer's energy
+	if bid.ProducerID != "" && bid.ProducerID != ask.ProducerID {
+		return false
+	}
+
+	return true
+}
+
+// fillOrders settles one fill between a buy and a sell order. The buyer pays
+// out of escrow and gets back the difference to their limit price, the seller
+// is credited and the producer capacity locked by the sell order is released.
+// The fill that completes a limit buy takes whatever escrow is left on it, so
+// rounding never leaves funds behind or takes more than was locked.
+func (s *EnergyMarket) fillOrders(ctx contractapi.TransactionContextInterface, marketState *MarketState, bid *Order, ask *Order, price Amount, quantity Energy) (*Trade, error) {
+	buyerIndex := findConsumer(marketState, bid.UserID)
+	if buyerIndex < 0 {
+		return nil, fmt.Errorf("buyer %s of order %s not found", bid.UserID, bid.ID)
+	}
+	sellerIndex := findConsumer(marketState, ask.UserID)
+	if sellerIndex < 0 {
+		return nil, fmt.Errorf("seller %s of order %s not found", ask.UserID, ask.ID)
+	}
+	producerIndex := findProducer(marketState, ask.ProducerID)
+	if producerIndex < 0 {
+		return nil, fmt.Errorf("producer %s of order %s not found", ask.ProducerID, ask.ID)
+	}
+
+	// Market buys lock their whole budget and pay exactly the trade value
+	paid := valueOf(price, quantity)
+	locked := valueOf(bid.Price, quantity)
+	if bid.ExecutionType == ExecutionMarket {
+		locked = paid
+	}
+	if locked > bid.EscrowAmount || quantity == bid.Quantity {
+		locked = bid.EscrowAmount
+	}
+	if paid > locked {
+		paid = locked
+	}
+
+	// Release the escrow and pay the seller out of it
+	buyer := &marketState.Consumers[buyerIndex]
+	buyer.EscrowBalance -= locked
+	buyer.Balance += locked
+	bid.EscrowAmount -= locked
+	bid.Quantity -= quantity
+
+	if err := transferCredits(marketState, bid.UserID, ask.UserID, paid); err != nil {
+		return nil, err
+	}
+	// The sold energy stays committed, so it cannot be offered again
+	ask.Quantity -= quantity
+
+	trade, err := s.recordTrade(ctx, marketState, bid.UserID, ask.UserID, ask.ProducerID, price, quantity, paid, tradeCharges{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to record trade between %s and %s: %v", bid.ID, ask.ID, err)
+	}
+
+	return trade, nil
+}
+
+// storeOrRemoveOrder writes back a partially filled order, or deletes a filled
+// one and releases whatever escrow is left on it
+func (s *EnergyMarket) storeOrRemoveOrder(ctx contractapi.TransactionContextInterface, marketState *MarketState, order *Order) error {
+	if order.Quantity > 0 {
+		return putOrder(ctx, order)
+	}
+
+	releaseOrderEscrow(marketState, order)
+
+	return deleteOrder(ctx, order)
+}
+
+// placedBefore reports whether order a was placed before order b, breaking
+// ties on the order ID so that every peer sorts the book the same way
+func placedBefore(a Order, b Order) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
@@ -0,0 +1,97 @@
+package main
+
+import "testing"
+
+func TestMatchOrdersFillsByPriceTimePriority(t *testing.T) {
+	market := newTestMarket(t)
+
+	market.placeOrder("sell", 20, 5, "consumer1", "producer1")
+	market.placeOrder("sell", 18, 5, "consumer2", "producer2")
+	market.placeOrder("buy", 25, 8, "consumer3", "")
+
+	trades, err := market.contract.MatchOrders(market.operator())
+	if err != nil {
+		t.Fatalf("MatchOrders failed: %v", err)
+	}
+
+	// The cheaper ask fills first, and each fill is at the price of the
+	// order that rested first
+	want := []struct {
+		sellerID string
+		price    Amount
+		quantity Energy
+	}{
+		{"consumer2", 18000000, 5000000},
+		{"consumer1", 20000000, 3000000},
+	}
+	if len(trades) != len(want) {
+		t.Fatalf("got %d trades, want %d", len(trades), len(want))
+	}
+	for i, trade := range trades {
+		if trade.BuyerID != "consumer3" || trade.SellerID != want[i].sellerID || trade.Price != want[i].price || trade.Quantity != want[i].quantity {
+			t.Errorf("trade %d is %s buying %s from %s at %s, want %s from %s at %s", i, trade.BuyerID, trade.Quantity, trade.SellerID, trade.Price, want[i].quantity, want[i].sellerID, want[i].price)
+		}
+	}
+
+	// The buyer pays the trade values and gets back the rest of its escrow
+	buyer := market.consumer("consumer3")
+	if buyer.Balance != 10000000000-150000000 || buyer.EscrowBalance != 0 {
+		t.Errorf("buyer has %s available and %s in escrow, want 9850.000000 and 0.000000", buyer.Balance, buyer.EscrowBalance)
+	}
+	if seller := market.consumer("consumer2"); seller.Balance != 10000000000+90000000 {
+		t.Errorf("consumer2 has %s, want 10090.000000", seller.Balance)
+	}
+	if seller := market.consumer("consumer1"); seller.Balance != 10000000000+60000000 {
+		t.Errorf("consumer1 has %s, want 10060.000000", seller.Balance)
+	}
+
+	// The filled orders leave the book and the partly filled ask keeps its remainder
+	orderBook, err := market.contract.GetOrderBook(market.operator())
+	if err != nil {
+		t.Fatalf("GetOrderBook failed: %v", err)
+	}
+	if len(orderBook["buy"]) != 0 {
+		t.Errorf("%d buy orders rest in the book, want none", len(orderBook["buy"]))
+	}
+	if len(orderBook["sell"]) != 1 || orderBook["sell"][0].UserID != "consumer1" || orderBook["sell"][0].Quantity != 2000000 {
+		t.Errorf("sell side is %+v, want the 2 MWh remainder of consumer1", orderBook["sell"])
+	}
+}
+
+func TestMatchOrdersKeepsSoldCapacityCommitted(t *testing.T) {
+	market := newTestMarket(t)
+
+	capacity := market.producer("producer2").ProductionMax
+	market.placeOrder("sell", 18, 5, "consumer2", "producer2")
+	market.placeOrder("buy", 25, 5, "consumer3", "")
+
+	if _, err := market.contract.MatchOrders(market.operator()); err != nil {
+		t.Fatalf("MatchOrders failed: %v", err)
+	}
+
+	// The sold energy stays committed, so it cannot be offered again
+	if committed := market.producer("producer2").CommittedCapacity; committed != 5000000 {
+		t.Errorf("producer2 has %s committed, want 5.000000", committed)
+	}
+	err := market.contract.PlaceOrder(market.participant("consumer2"), "sell", 18, capacity-4, "consumer2", "producer2")
+	if err == nil {
+		t.Errorf("sold capacity was offered again")
+	}
+	market.placeOrder("sell", 18, capacity-5, "consumer2", "producer2")
+}
+
+func TestMatchOrdersSkipsOrdersThatCannotCross(t *testing.T) {
+	market := newTestMarket(t)
+
+	market.placeOrder("sell", 20, 5, "consumer1", "producer1")
+	market.placeOrder("buy", 19, 5, "consumer3", "")
+	market.placeOrder("buy", 25, 5, "consumer1", "")
+
+	trades, err := market.contract.MatchOrders(market.operator())
+	if err != nil {
+		t.Fatalf("MatchOrders failed: %v", err)
+	}
+	if len(trades) != 0 {
+		t.Errorf("got %d trades below the ask price or with the seller itself, want none", len(trades))
+	}
+}
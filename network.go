@@ -0,0 +1,515 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// networkID is the ID of the single network and network result under their object types
+const networkID = "current"
+
+// Network is the transmission network under a DC power-flow model. Every
+// producer and consumer sits at a bus; one without a bus sits at the slack
+// bus, which balances the injections of all others.
+type Network struct {
+	SlackBus string   `json:"slackBus"` // Reference bus
+	Buses    []string `json:"buses"`    // Bus IDs
+	Lines    []Line   `json:"lines"`    // Lines between the buses
+}
+
+// Line is a transmission line between two buses
+type Line struct {
+	ID        string  `json:"id"`
+	From      string  `json:"from"`            // Bus a positive flow leaves
+	To        string  `json:"to"`              // Bus a positive flow enters
+	Reactance float64 `json:"reactance"`       // Series reactance, in per unit
+	Limit     float64 `json:"limit,omitempty"` // Thermal limit on the flow in either direction, in MW, 0 for no limit
+}
+
+// NetworkResult is the result of a network-constrained clearing
+type NetworkResult struct {
+	IntervalID     string      `json:"intervalId"`     // Settlement interval the clearing settled
+	SystemPrice    float64     `json:"systemPrice"`    // Price at the slack bus
+	BusPrices      []BusResult `json:"busPrices"`      // Locational marginal price of each bus, in network order
+	Lines          []LineFlow  `json:"lines"`          // Flow on each line, in network order
+	CongestionRent float64     `json:"congestionRent"` // What consumers pay at their bus prices minus what producers receive at theirs
+	CollectedRent  Amount      `json:"collectedRent"`  // Congestion rent of the recorded trades, paid into the fee account; energy from a consumer's own producers is not traded and pays none
+	Iterations     int         `json:"iterations"`     // Iterations of the line price update
+	ConfigVersion  int         `json:"configVersion"`  // Version of the MarketConfig the clearing ran with
+}
+
+// BusResult is the clearing result at one bus
+type BusResult struct {
+	BusID      string  `json:"busId"`
+	Price      float64 `json:"price"`      // Locational marginal price
+	Generation float64 `json:"generation"` // Output of the producers at the bus
+	Demand     float64 `json:"demand"`     // Demand of the consumers at the bus
+}
+
+// LineFlow is the clearing result on one line
+type LineFlow struct {
+	LineID         string  `json:"lineId"`
+	Flow           float64 `json:"flow"`           // Flow from From to To, in MW
+	Limit          float64 `json:"limit"`          // Thermal limit, 0 for no limit
+	ShadowPrice    float64 `json:"shadowPrice"`    // Welfare gained per MW the limit is raised, negative when binding against the reverse direction
+	CongestionRent float64 `json:"congestionRent"` // Shadow price times flow
+}
+
+// SetNetwork replaces the transmission network. Only a market operator may
+// change it. Participants keep their bus assignments, which must name buses
+// of the new network before the next network clearing.
+func (s *EnergyMarket) SetNetwork(ctx contractapi.TransactionContextInterface, network Network) (*Network, error) {
+	if err := validateNetwork(&network); err != nil {
+		return nil, err
+	}
+
+	if err := putObject(ctx, networkObjectType, networkID, network); err != nil {
+		return nil, err
+	}
+
+	return &network, nil
+}
+
+// GetNetwork retrieves the transmission network
+func (s *EnergyMarket) GetNetwork(ctx contractapi.TransactionContextInterface) (*Network, error) {
+	return getNetwork(ctx)
+}
+
+// SetProducerBus assigns a producer to a bus of the network. Only a market
+// operator may assign buses.
+func (s *EnergyMarket) SetProducerBus(ctx contractapi.TransactionContextInterface, producerID string, busID string) error {
+	if err := assertBus(ctx, busID); err != nil {
+		return err
+	}
+
+	producer, err := getProducerProfile(ctx, producerID)
+	if err != nil {
+		return err
+	}
+	producer.Bus = busID
+
+	return putProducer(ctx, producer)
+}
+
+// SetConsumerBus assigns a consumer to a bus of the network. Only a market
+// operator may assign buses.
+func (s *EnergyMarket) SetConsumerBus(ctx contractapi.TransactionContextInterface, consumerID string, busID string) error {
+	if err := assertBus(ctx, busID); err != nil {
+		return err
+	}
+
+	consumer, err := getConsumerProfile(ctx, consumerID)
+	if err != nil {
+		return err
+	}
+	consumer.Bus = busID
+
+	return putConsumer(ctx, consumer)
+}
+
+// ClearMarketWithNetwork clears the market exactly, like ClearMarketExact,
+// but keeps every line flow within its thermal limit. Each line has a shadow
+// price, and each bus's price is the system price adjusted by the shadow
+// prices weighted by how much an injection at the bus loads each line. The
+// shadow prices are raised on overloaded lines and lowered on the others by
+// projected gradient steps of the configured congestion step size, and the
+// market is cleared exactly at the resulting bus prices, until no line is
+// overloaded by more than the balance tolerance and no shadow price moves by
+// more than the price tolerance.
+//
+// Every producer's Lambda becomes the price at its bus. Trades are recorded
+// at the buyer's bus price and the seller is paid its own, so the congestion
+// rent between the two is paid into the DSO's fee account, which a congested
+// network needs. The rent is reported in the network result, which is stored
+// alongside the market state. Each call settles one settlement interval,
+// which can be cleared only once.
+func (s *EnergyMarket) ClearMarketWithNetwork(ctx contractapi.TransactionContextInterface, intervalID string) (*NetworkResult, error) {
+	if err := assertIntervalNotCleared(ctx, intervalID); err != nil {
+		return nil, err
+	}
+
+	marketState, err := loadMarketState(ctx)
+	if err != nil {
+		return nil, err
+	}
+	config, err := getMarketConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	network, err := getNetwork(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every interval is a new clearing and settles its own trades, whether
+	// or not the previous one converged
+	marketState.Converged = false
+	result, consumerPrices, err := solveNetworkClearing(marketState, network, config)
+	if err != nil {
+		return nil, err
+	}
+
+	trades, err := s.recordOptimizedTrades(ctx, marketState, config, consumerPrices, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record optimized trades: %v", err)
+	}
+	result.IntervalID = intervalID
+	for _, trade := range trades {
+		result.CollectedRent += trade.CongestionRent
+	}
+
+	marketState.Converged = true
+	marketState.IterationCount++
+	marketState.ConfigVersion = config.Version
+
+	if err := putClearedInterval(ctx, intervalID, "network", config.Version); err != nil {
+		return nil, err
+	}
+	if err := putMarketState(ctx, marketState); err != nil {
+		return nil, err
+	}
+	if err := putObject(ctx, networkResultType, networkID, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetNetworkResult retrieves the result of the last network-constrained clearing
+func (s *EnergyMarket) GetNetworkResult(ctx contractapi.TransactionContextInterface) (*NetworkResult, error) {
+	var result NetworkResult
+	found, err := getObject(ctx, networkResultType, networkID, &result)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("the market has not been cleared with the network")
+	}
+
+	return &result, nil
+}
+
+// solveNetworkClearing clears the market state under the network's line
+// limits, see ClearMarketWithNetwork, and returns the prices and flows along
+// with the price at each consumer's bus
+func solveNetworkClearing(marketState *MarketState, network *Network, config *MarketConfig) (*NetworkResult, []float64, error) {
+	ptdf, err := network.ptdf()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buses := make(map[string]int)
+	for b, busID := range network.Buses {
+		buses[busID] = b
+	}
+	busOf := func(busID string, participantID string) (int, error) {
+		if busID == "" {
+			busID = network.SlackBus
+		}
+		b, exists := buses[busID]
+		if !exists {
+			return 0, fmt.Errorf("bus %s of %s is not in the network", busID, participantID)
+		}
+		return b, nil
+	}
+	producerBuses := make([]int, len(marketState.Producers))
+	for i, producer := range marketState.Producers {
+		if producerBuses[i], err = busOf(producer.Bus, producer.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+	consumerBuses := make([]int, len(marketState.Consumers))
+	for j, consumer := range marketState.Consumers {
+		if consumerBuses[j], err = busOf(consumer.Bus, consumer.ID); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	charges := config.gridCharges(marketState)
+
+	// Shadow prices of the upper and lower flow limits of each line
+	upper := make([]float64, len(network.Lines))
+	lower := make([]float64, len(network.Lines))
+	nextUpper := make([]float64, len(network.Lines))
+	nextLower := make([]float64, len(network.Lines))
+	busOffsets := make([]float64, len(network.Buses))
+	producerOffsets := make([]float64, len(marketState.Producers))
+	consumerOffsets := make([]float64, len(marketState.Consumers))
+	var price float64
+	var flows []float64
+
+	iterations := 0
+	converged := false
+	for iterations < config.MaxIterations {
+		iterations++
+
+		// Injecting at a bus loads each line by its PTDF, so a congested
+		// line lowers the price at the buses that load it
+		for b := range network.Buses {
+			busOffsets[b] = 0
+			for l := range network.Lines {
+				busOffsets[b] += (upper[l] - lower[l]) * ptdf[l][b]
+			}
+		}
+		for i, b := range producerBuses {
+			producerOffsets[i] = busOffsets[b]
+		}
+		for j, b := range consumerBuses {
+			consumerOffsets[j] = busOffsets[b]
+		}
+
+		price, err = solveOffsetClearing(marketState, charges, producerOffsets, consumerOffsets)
+		if err != nil {
+			return nil, nil, err
+		}
+		flows = lineFlows(marketState, ptdf, producerBuses, consumerBuses)
+
+		// Projected gradient step on the shadow prices
+		converged = true
+		step := config.congestionStepSize()
+		for l, line := range network.Lines {
+			if line.Limit == 0 {
+				continue
+			}
+			nextUpper[l] = math.Max(0, upper[l]+step*(flows[l]-line.Limit))
+			nextLower[l] = math.Max(0, lower[l]+step*(-flows[l]-line.Limit))
+			if math.Abs(flows[l])-line.Limit > config.BalanceTolerance ||
+				math.Abs(nextUpper[l]-upper[l]) > config.PriceTolerance ||
+				math.Abs(nextLower[l]-lower[l]) > config.PriceTolerance {
+				converged = false
+			}
+		}
+		if converged {
+			break
+		}
+		copy(upper, nextUpper)
+		copy(lower, nextLower)
+	}
+	if !converged {
+		return nil, nil, fmt.Errorf("network clearing did not converge after %d iterations", iterations)
+	}
+
+	result := &NetworkResult{
+		SystemPrice:   price,
+		BusPrices:     []BusResult{},
+		Lines:         []LineFlow{},
+		Iterations:    iterations,
+		ConfigVersion: config.Version,
+	}
+	for b, busID := range network.Buses {
+		result.BusPrices = append(result.BusPrices, BusResult{BusID: busID, Price: price - busOffsets[b]})
+	}
+	for i, b := range producerBuses {
+		result.BusPrices[b].Generation += marketState.Producers[i].Production
+		result.CongestionRent -= result.BusPrices[b].Price * marketState.Producers[i].Production
+	}
+	for j, b := range consumerBuses {
+		result.BusPrices[b].Demand += marketState.Consumers[j].TotalDemand
+		result.CongestionRent += result.BusPrices[b].Price * marketState.Consumers[j].TotalDemand
+	}
+	for l, line := range network.Lines {
+		shadowPrice := upper[l] - lower[l]
+		result.Lines = append(result.Lines, LineFlow{
+			LineID:         line.ID,
+			Flow:           flows[l],
+			Limit:          line.Limit,
+			ShadowPrice:    shadowPrice,
+			CongestionRent: shadowPrice * flows[l],
+		})
+	}
+
+	consumerPrices := make([]float64, len(consumerBuses))
+	for j, b := range consumerBuses {
+		consumerPrices[j] = result.BusPrices[b].Price
+	}
+
+	return result, consumerPrices, nil
+}
+
+// lineFlows returns the flow on each line for the production and demand in a
+// market state
+func lineFlows(marketState *MarketState, ptdf [][]float64, producerBuses []int, consumerBuses []int) []float64 {
+	flows := make([]float64, len(ptdf))
+	for l := range ptdf {
+		for i, b := range producerBuses {
+			flows[l] += ptdf[l][b] * marketState.Producers[i].Production
+		}
+		for j, b := range consumerBuses {
+			flows[l] -= ptdf[l][b] * marketState.Consumers[j].TotalDemand
+		}
+	}
+	return flows
+}
+
+// ptdf returns the power transfer distribution factors of the network: the
+// flow on each line when 1 MW is injected at each bus and withdrawn at the
+// slack bus
+func (network *Network) ptdf() ([][]float64, error) {
+	buses := make(map[string]int)
+	for b, busID := range network.Buses {
+		buses[busID] = b
+	}
+	slack := buses[network.SlackBus]
+
+	// Bus susceptance matrix without the slack bus
+	reduced := func(b int) int {
+		if b > slack {
+			return b - 1
+		}
+		return b
+	}
+	size := len(network.Buses) - 1
+	susceptance := make([][]float64, size)
+	for k := range susceptance {
+		susceptance[k] = make([]float64, size)
+	}
+	for _, line := range network.Lines {
+		from, to := buses[line.From], buses[line.To]
+		admittance := 1 / line.Reactance
+		if from != slack {
+			susceptance[reduced(from)][reduced(from)] += admittance
+		}
+		if to != slack {
+			susceptance[reduced(to)][reduced(to)] += admittance
+		}
+		if from != slack && to != slack {
+			susceptance[reduced(from)][reduced(to)] -= admittance
+			susceptance[reduced(to)][reduced(from)] -= admittance
+		}
+	}
+
+	reactance, err := invertMatrix(susceptance)
+	if err != nil {
+		return nil, fmt.Errorf("network is not connected: %v", err)
+	}
+
+	// Voltage angle at a bus per MW injected at another, zero at the slack bus
+	angle := func(at int, injected int) float64 {
+		if at == slack || injected == slack {
+			return 0
+		}
+		return reactance[reduced(at)][reduced(injected)]
+	}
+
+	factors := make([][]float64, len(network.Lines))
+	for l, line := range network.Lines {
+		from, to := buses[line.From], buses[line.To]
+		factors[l] = make([]float64, len(network.Buses))
+		for b := range network.Buses {
+			factors[l][b] = (angle(from, b) - angle(to, b)) / line.Reactance
+		}
+	}
+
+	return factors, nil
+}
+
+// invertMatrix inverts a square matrix by Gauss-Jordan elimination with
+// partial pivoting
+func invertMatrix(matrix [][]float64) ([][]float64, error) {
+	size := len(matrix)
+	work := make([][]float64, size)
+	inverse := make([][]float64, size)
+	for r := range matrix {
+		work[r] = append([]float64{}, matrix[r]...)
+		inverse[r] = make([]float64, size)
+		inverse[r][r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		pivot := c
+		for r := c + 1; r < size; r++ {
+			if math.Abs(work[r][c]) > math.Abs(work[pivot][c]) {
+				pivot = r
+			}
+		}
+		if math.Abs(work[pivot][c]) < 1e-12 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		inverse[c], inverse[pivot] = inverse[pivot], inverse[c]
+
+		scale := work[c][c]
+		for k := 0; k < size; k++ {
+			work[c][k] /= scale
+			inverse[c][k] /= scale
+		}
+		for r := 0; r < size; r++ {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for k := 0; k < size; k++ {
+				work[r][k] -= factor * work[c][k]
+				inverse[r][k] -= factor * inverse[c][k]
+			}
+		}
+	}
+
+	return inverse, nil
+}
+
+// validateNetwork checks that a network's buses and lines are well formed and
+// that the lines connect every bus
+func validateNetwork(network *Network) error {
+	buses := make(map[string]bool)
+	for _, busID := range network.Buses {
+		if busID == "" || buses[busID] {
+			return fmt.Errorf("bus IDs must be unique and not empty")
+		}
+		buses[busID] = true
+	}
+	if !buses[network.SlackBus] {
+		return fmt.Errorf("slack bus %s is not in the network", network.SlackBus)
+	}
+
+	lines := make(map[string]bool)
+	for _, line := range network.Lines {
+		if line.ID == "" || lines[line.ID] {
+			return fmt.Errorf("line IDs must be unique and not empty")
+		}
+		lines[line.ID] = true
+		if !buses[line.From] || !buses[line.To] || line.From == line.To {
+			return fmt.Errorf("line %s must connect two different buses of the network", line.ID)
+		}
+		if !(line.Reactance > 0) || math.IsInf(line.Reactance, 0) {
+			return fmt.Errorf("line %s must have a positive reactance", line.ID)
+		}
+		if !(line.Limit >= 0) || math.IsInf(line.Limit, 0) {
+			return fmt.Errorf("line %s must have a non-negative limit", line.ID)
+		}
+	}
+
+	_, err := network.ptdf()
+	return err
+}
+
+// getNetwork reads the transmission network
+func getNetwork(ctx contractapi.TransactionContextInterface) (*Network, error) {
+	var network Network
+	found, err := getObject(ctx, networkObjectType, networkID, &network)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no network has been set")
+	}
+
+	return &network, nil
+}
+
+// assertBus checks that a bus is part of the network
+func assertBus(ctx contractapi.TransactionContextInterface, busID string) error {
+	network, err := getNetwork(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range network.Buses {
+		if id == busID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("bus %s is not in the network", busID)
+}
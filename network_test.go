@@ -0,0 +1,183 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// triangleNetwork is three buses joined in a ring by identical lines, with
+// the line from the slack bus to bus3 limited
+func triangleNetwork(limit float64) Network {
+	return Network{
+		SlackBus: "bus1",
+		Buses:    []string{"bus1", "bus2", "bus3"},
+		Lines: []Line{
+			{ID: "line12", From: "bus1", To: "bus2", Reactance: 0.1},
+			{ID: "line23", From: "bus2", To: "bus3", Reactance: 0.1},
+			{ID: "line13", From: "bus1", To: "bus3", Reactance: 0.1, Limit: limit},
+		},
+	}
+}
+
+// newNetworkMarket seeds the default market on the triangle network, with the
+// cheapest producer at the slack bus and half the consumers at bus3
+func newNetworkMarket(t *testing.T, limit float64, feeAccountID string) *testMarket {
+	market := newTestMarket(t)
+	if _, err := market.contract.SetNetwork(market.operator(), triangleNetwork(limit)); err != nil {
+		t.Fatalf("SetNetwork failed: %v", err)
+	}
+	for producerID, busID := range map[string]string{"producer1": "bus1", "producer2": "bus2", "producer3": "bus3"} {
+		if err := market.contract.SetProducerBus(market.operator(), producerID, busID); err != nil {
+			t.Fatalf("SetProducerBus failed: %v", err)
+		}
+	}
+	for _, consumerID := range []string{"consumer4", "consumer5", "consumer6"} {
+		if err := market.contract.SetConsumerBus(market.operator(), consumerID, "bus3"); err != nil {
+			t.Fatalf("SetConsumerBus failed: %v", err)
+		}
+	}
+	if feeAccountID != "" {
+		config := *defaultMarketConfig()
+		config.FeeAccountID = feeAccountID
+		if _, err := market.contract.SetMarketConfig(market.operator(), config); err != nil {
+			t.Fatalf("SetMarketConfig failed: %v", err)
+		}
+	}
+	return market
+}
+
+func TestTrianglePTDF(t *testing.T) {
+	network := triangleNetwork(0)
+	ptdf, err := network.ptdf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 MW injected at a bus reaches the slack bus two thirds over the
+	// direct line and one third around the ring
+	want := [][]float64{
+		{0, -2.0 / 3, -1.0 / 3}, // line12
+		{0, 1.0 / 3, -1.0 / 3},  // line23
+		{0, -1.0 / 3, -2.0 / 3}, // line13
+	}
+	for l := range want {
+		for b := range want[l] {
+			if math.Abs(ptdf[l][b]-want[l][b]) > 1e-9 {
+				t.Errorf("PTDF of %s at %s is %v, want %v", network.Lines[l].ID, network.Buses[b], ptdf[l][b], want[l][b])
+			}
+		}
+	}
+}
+
+func TestNetworkClearingPricesACongestedLine(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     float64
+		congested bool
+	}{
+		{"unlimited", 0, false},
+		{"loose limit", 20, false},
+		{"congested", 5, true},
+	}
+	for _, test := range tests {
+		market := newNetworkMarket(t, test.limit, "consumer1")
+		result, err := market.contract.ClearMarketWithNetwork(market.operator(), "2024-06-01T10")
+		if err != nil {
+			t.Fatalf("%s: ClearMarketWithNetwork failed: %v", test.name, err)
+		}
+
+		for _, line := range result.Lines {
+			if line.Limit > 0 && math.Abs(line.Flow) > line.Limit+defaultMarketConfig().BalanceTolerance {
+				t.Errorf("%s: %s carries %.2f MW over its limit of %.2f", test.name, line.LineID, line.Flow, line.Limit)
+			}
+		}
+
+		// Only line13 can bind, and it loads bus2 half as much as bus3, so
+		// bus2 is priced halfway between the other two
+		prices := map[string]float64{}
+		for _, bus := range result.BusPrices {
+			prices[bus.BusID] = bus.Price
+		}
+		spread := prices["bus3"] - prices["bus1"]
+		if congested := spread > 0.01; congested != test.congested {
+			t.Errorf("%s: bus3 is priced %.4f above the slack bus, want congestion %v", test.name, spread, test.congested)
+		}
+		if midpoint := (prices["bus1"] + prices["bus3"]) / 2; math.Abs(prices["bus2"]-midpoint) > 1e-6 {
+			t.Errorf("%s: bus2 is priced %.4f, want the midpoint %.4f", test.name, prices["bus2"], midpoint)
+		}
+
+		// Producers are paid their own bus price, consumers pay theirs and
+		// the difference is collected as congestion rent
+		buses := map[string]string{"producer1": "bus1", "producer2": "bus2", "producer3": "bus3"}
+		for producerID, busID := range buses {
+			if lambda := market.producer(producerID).Lambda; math.Abs(lambda-prices[busID]) > 1e-9 {
+				t.Errorf("%s: %s has lambda %.4f, want its bus price %.4f", test.name, producerID, lambda, prices[busID])
+			}
+		}
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var collected Amount
+		for _, trade := range trades {
+			busID := "bus1"
+			if market.consumer(trade.BuyerID).Bus != "" {
+				busID = market.consumer(trade.BuyerID).Bus
+			}
+			if want, _ := toAmount(prices[busID]); trade.Price != want {
+				t.Errorf("%s: %s paid %s, want the price %s at its bus", test.name, trade.BuyerID, trade.Price, want)
+			}
+			collected += trade.CongestionRent
+		}
+		if collected != result.CollectedRent {
+			t.Errorf("%s: trades carry a rent of %s, the result reports %s", test.name, collected, result.CollectedRent)
+		}
+		if (collected > 0) != test.congested || (result.CongestionRent > 0.01) != test.congested {
+			t.Errorf("%s: collected a rent of %s of %.2f, want congestion %v", test.name, collected, result.CongestionRent, test.congested)
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestCongestionRentNeedsAFeeAccount(t *testing.T) {
+	market := newNetworkMarket(t, 5, "")
+	if _, err := market.contract.ClearMarketWithNetwork(market.operator(), "2024-06-01T10"); err == nil {
+		t.Errorf("a congested clearing without a fee account was settled")
+	}
+}
+
+func TestClearMarketWithNetworkSettlesEachIntervalOnce(t *testing.T) {
+	market := newNetworkMarket(t, 5, "consumer1")
+
+	tests := []struct {
+		intervalID string
+		ok         bool
+	}{
+		{"", false},
+		{"2024-06-01T10", true},
+		{"2024-06-01T10", false},
+		{"2024-06-01T11", true},
+	}
+	settled := 0
+	for _, test := range tests {
+		_, err := market.contract.ClearMarketWithNetwork(market.operator(), test.intervalID)
+		if (err == nil) != test.ok {
+			t.Fatalf("ClearMarketWithNetwork of interval %q returned %v, want success %v", test.intervalID, err, test.ok)
+		}
+
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.ok == (len(trades) == settled) {
+			t.Errorf("interval %q recorded %d trades, want success %v", test.intervalID, len(trades)-settled, test.ok)
+		}
+		settled = len(trades)
+		market.assertSupplyConsistent()
+	}
+
+	// The exact clearing shares the intervals
+	if err := market.contract.ClearMarketExact(market.operator(), "2024-06-01T11"); err == nil {
+		t.Errorf("ClearMarketExact settled an interval the network clearing had settled")
+	}
+}
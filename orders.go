@@ -0,0 +1,715 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// orderTimestampLayout is RFC3339 with fixed-width nanoseconds, so that order
+// timestamps sort correctly as plain strings
+const orderTimestampLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+// Execution types supported on Order.ExecutionType
+const (
+	ExecutionLimit  = "limit"
+	ExecutionMarket = "market"
+)
+
+// Time-in-force values supported on Order.TimeInForce
+const (
+	TimeInForceGTC = "GTC" // Good till cancelled: the unfilled remainder rests in the book
+	TimeInForceIOC = "IOC" // Immediate or cancel: the unfilled remainder is cancelled
+	TimeInForceFOK = "FOK" // Fill or kill: the order fills completely or not at all
+	TimeInForceGTT = "GTT" // Good till time: the unfilled remainder rests until ExpiresAt
+)
+
+// Statuses reported in OrderResult.Status
+const (
+	OrderStatusResting         = "resting"
+	OrderStatusFilled          = "filled"
+	OrderStatusPartiallyFilled = "partially_filled"
+	OrderStatusCancelled       = "cancelled"
+	OrderStatusRejected        = "rejected"
+)
+
+// OrderRequest describes an order submitted through SubmitOrder. Price and
+// quantity are decimal USD per MWh and MWh; the stored order holds them as
+// fixed-point Amount and Energy.
+type OrderRequest struct {
+	Side          string  `json:"side"`                    // "buy" or "sell"
+	ExecutionType string  `json:"executionType,omitempty"` // "limit" (default) or "market"
+	TimeInForce   string  `json:"timeInForce,omitempty"`   // "GTC" (default for limit), "GTT", "IOC" or "FOK"
+	PostOnly      bool    `json:"postOnly,omitempty"`      // Reject the order instead of taking liquidity
+	Price         float64 `json:"price,omitempty"`         // Limit price in USD per MWh, ignored for market orders
+	Quantity      float64 `json:"quantity"`                // Quantity of energy to buy/sell in MWh
+	UserID        string  `json:"userId"`                  // ID of the consumer placing the order
+	ProducerID    string  `json:"producerId,omitempty"`    // Required for sell orders
+	ExpiresAt     string  `json:"expiresAt,omitempty"`     // RFC3339 expiry, implies "GTT"
+}
+
+// OrderResult reports what happened to an order submitted through SubmitOrder
+type OrderResult struct {
+	OrderID           string  `json:"orderId"`
+	Status            string  `json:"status"`            // One of the OrderStatus values
+	FilledQuantity    Energy  `json:"filledQuantity"`    // Quantity filled immediately
+	RestingQuantity   Energy  `json:"restingQuantity"`   // Quantity left resting in the book
+	CancelledQuantity Energy  `json:"cancelledQuantity"` // Unfilled quantity cancelled by IOC, FOK or market execution
+	Reason            string  `json:"reason,omitempty"`  // Why the order or its remainder was rejected or cancelled
+	Trades            []Trade `json:"trades"`            // Trades executed by the order
+}
+
+// PlaceOrder validates a buy or sell limit order, locks the buyer's funds or
+// the seller's producer capacity in escrow and stores the order in the order
+// book. The order rests until MatchOrders crosses it. The price is in USD per
+// MWh and the quantity in MWh.
+func (s *EnergyMarket) PlaceOrder(ctx contractapi.TransactionContextInterface, side string, price float64, quantity float64, userID string, producerID string) error {
+	marketState, err := loadParticipants(ctx, []string{userID}, []string{producerID})
+	if err != nil {
+		return err
+	}
+
+	order, err := s.newOrder(ctx, marketState, OrderRequest{
+		Side:       side,
+		Price:      price,
+		Quantity:   quantity,
+		UserID:     userID,
+		ProducerID: producerID,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := putOrder(ctx, order); err != nil {
+		return err
+	}
+
+	return putParticipants(ctx, marketState)
+}
+
+// SubmitOrder places a limit or market order and executes it immediately
+// against the resting orders on the other side of the book. Depending on its
+// time in force the unfilled remainder rests (GTC) or is cancelled (IOC and
+// market orders), and a fill-or-kill order is rejected unless it can fill
+// completely. A post-only order is rejected if it would trade on arrival.
+// Rejections and cancelled remainders are reported in the result.
+func (s *EnergyMarket) SubmitOrder(ctx contractapi.TransactionContextInterface, request OrderRequest) (*OrderResult, error) {
+	header, err := getMarketHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// In auction mode orders wait for ClearAuction instead of executing on arrival
+	if header.TradingMode == TradingModeAuction {
+		marketState, err := loadParticipants(ctx, []string{request.UserID}, []string{request.ProducerID})
+		if err != nil {
+			return nil, err
+		}
+		order, err := s.newOrder(ctx, marketState, request)
+		if err != nil {
+			return nil, err
+		}
+		if !isRestingOrder(order) {
+			return nil, fmt.Errorf("market is in auction mode, only limit orders that rest in the book are accepted")
+		}
+		if err := putOrder(ctx, order); err != nil {
+			return nil, err
+		}
+		if err := putParticipants(ctx, marketState); err != nil {
+			return nil, err
+		}
+		return &OrderResult{OrderID: order.ID, Status: OrderStatusResting, RestingQuantity: order.Quantity, Trades: []Trade{}}, nil
+	}
+
+	orderBook, err := s.GetOrderBook(ctx)
+	if err != nil {
+		return nil, err
+	}
+	makers := orderBook["sell"]
+	if request.Side == "sell" {
+		makers = orderBook["buy"]
+	}
+
+	// Load only the users and producers behind the orders this one can cross
+	probePrice, err := toAmount(request.Price)
+	if err != nil {
+		return nil, fmt.Errorf("invalid order price: %v", err)
+	}
+	probe := &Order{OrderType: request.Side, Price: probePrice, ExecutionType: request.ExecutionType}
+	crossing := 0
+	for crossing < len(makers) && crossesPrice(probe, &makers[crossing]) {
+		crossing++
+	}
+	userIDs, producerIDs := orderParticipants(makers[:crossing])
+	marketState, err := loadParticipants(ctx, append(userIDs, request.UserID), append(producerIDs, request.ProducerID))
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := s.newOrder(ctx, marketState, request)
+	if err != nil {
+		return nil, err
+	}
+	makers = makers[:crossing]
+
+	result := &OrderResult{OrderID: order.ID, Trades: []Trade{}}
+
+	// Rejections leave the ledger untouched
+	if order.PostOnly && fillableQuantity(order, makers) > 0 {
+		result.Status = OrderStatusRejected
+		result.CancelledQuantity = order.Quantity
+		result.Reason = "post-only order would take liquidity"
+		return result, nil
+	}
+	if order.TimeInForce == TimeInForceFOK && fillableQuantity(order, makers) < order.Quantity {
+		result.Status = OrderStatusRejected
+		result.CancelledQuantity = order.Quantity
+		result.Reason = "fill-or-kill order cannot be filled completely"
+		return result, nil
+	}
+
+	requested := order.Quantity
+	touched := make([]bool, len(makers))
+	trades, err := s.executeAgainstBook(ctx, marketState, order, makers, touched)
+	if err != nil {
+		return nil, err
+	}
+	result.Trades = trades
+
+	for i := range makers {
+		if touched[i] {
+			if err := s.storeOrRemoveOrder(ctx, marketState, &makers[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	result.FilledQuantity = requested - order.Quantity
+	switch {
+	case order.Quantity <= 0:
+		result.Status = OrderStatusFilled
+		releaseOrderEscrow(marketState, order)
+	case isRestingOrder(order):
+		result.RestingQuantity = order.Quantity
+		result.Status = OrderStatusResting
+		if len(trades) > 0 {
+			result.Status = OrderStatusPartiallyFilled
+		}
+		if err := putOrder(ctx, order); err != nil {
+			return nil, err
+		}
+	default:
+		result.CancelledQuantity = order.Quantity
+		result.Reason = "unfilled remainder cancelled"
+		result.Status = OrderStatusCancelled
+		if len(trades) > 0 {
+			result.Status = OrderStatusPartiallyFilled
+		}
+		releaseOrderEscrow(marketState, order)
+	}
+
+	if err := putParticipants(ctx, marketState); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// newOrder validates an order request against the market state and locks the
+// funds or capacity backing it. A limit buy locks price * quantity; a market
+// buy has no price, so it locks the whole available balance and the unused
+// part is released once the order has executed.
+func (s *EnergyMarket) newOrder(ctx contractapi.TransactionContextInterface, marketState *MarketState, request OrderRequest) (*Order, error) {
+	side := request.Side
+	if side != "buy" && side != "sell" {
+		return nil, fmt.Errorf("invalid order side %q, expected \"buy\" or \"sell\"", side)
+	}
+
+	executionType := request.ExecutionType
+	if executionType == "" {
+		executionType = ExecutionLimit
+	}
+	timeInForce := request.TimeInForce
+	switch executionType {
+	case ExecutionLimit:
+		if timeInForce == "" {
+			timeInForce = TimeInForceGTC
+			if request.ExpiresAt != "" {
+				timeInForce = TimeInForceGTT
+			}
+		}
+		if request.Price <= 0 {
+			return nil, fmt.Errorf("order price must be positive")
+		}
+	case ExecutionMarket:
+		// Market orders never rest in the book
+		if timeInForce == "" {
+			timeInForce = TimeInForceIOC
+		}
+		if timeInForce == TimeInForceGTC || timeInForce == TimeInForceGTT {
+			return nil, fmt.Errorf("market orders cannot rest in the order book")
+		}
+		if request.PostOnly {
+			return nil, fmt.Errorf("market orders cannot be post-only")
+		}
+	default:
+		return nil, fmt.Errorf("invalid execution type %q, expected %q or %q", executionType, ExecutionLimit, ExecutionMarket)
+	}
+	switch timeInForce {
+	case TimeInForceGTC, TimeInForceIOC, TimeInForceFOK:
+		if request.ExpiresAt != "" {
+			return nil, fmt.Errorf("only good-till-time orders can have an expiry")
+		}
+	case TimeInForceGTT:
+		if request.ExpiresAt == "" {
+			return nil, fmt.Errorf("good-till-time orders require an expiry")
+		}
+	default:
+		return nil, fmt.Errorf("invalid time in force %q", timeInForce)
+	}
+	if request.PostOnly && timeInForce != TimeInForceGTC && timeInForce != TimeInForceGTT {
+		return nil, fmt.Errorf("post-only orders must rest in the order book")
+	}
+
+	price, err := toAmount(request.Price)
+	if err != nil {
+		return nil, fmt.Errorf("invalid order price: %v", err)
+	}
+	if executionType == ExecutionLimit && price <= 0 {
+		return nil, fmt.Errorf("order price must be at least one micro-unit")
+	}
+	quantity, err := toEnergy(request.Quantity)
+	if err != nil {
+		return nil, fmt.Errorf("invalid order quantity: %v", err)
+	}
+	if quantity <= 0 {
+		return nil, fmt.Errorf("order quantity must be positive")
+	}
+
+	consumerIndex := findConsumer(marketState, request.UserID)
+	if consumerIndex < 0 {
+		return nil, fmt.Errorf("user %s not found", request.UserID)
+	}
+	if err := assertCaller(ctx, request.UserID); err != nil {
+		return nil, err
+	}
+
+	producerIndex := -1
+	if request.ProducerID != "" {
+		producerIndex = findProducer(marketState, request.ProducerID)
+		if producerIndex < 0 {
+			return nil, fmt.Errorf("producer %s not found", request.ProducerID)
+		}
+	}
+
+	timestamp, err := txTimestamp(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	expiresAt := ""
+	if request.ExpiresAt != "" {
+		expiry, err := time.Parse(time.RFC3339, request.ExpiresAt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expiry %q: %v", request.ExpiresAt, err)
+		}
+		if !expiry.After(timestamp) {
+			return nil, fmt.Errorf("order expiry %s is not after the transaction time", request.ExpiresAt)
+		}
+		expiresAt = expiry.UTC().Format(orderTimestampLayout)
+	}
+
+	order := &Order{
+		ID:            "ORDER_" + ctx.GetStub().GetTxID(),
+		UserID:        request.UserID,
+		Price:         price,
+		Quantity:      quantity,
+		OrderType:     side,
+		Timestamp:     timestamp.Format(orderTimestampLayout),
+		ProducerID:    request.ProducerID,
+		ExecutionType: executionType,
+		TimeInForce:   timeInForce,
+		PostOnly:      request.PostOnly,
+		ExpiresAt:     expiresAt,
+	}
+	if executionType == ExecutionMarket {
+		order.Price = 0
+	}
+
+	// Lock the funds or the capacity backing the order
+	if side == "buy" {
+		consumer := &marketState.Consumers[consumerIndex]
+		cost := valueOf(order.Price, order.Quantity)
+		if executionType == ExecutionMarket {
+			cost = consumer.Balance
+			if cost <= 0 {
+				return nil, fmt.Errorf("insufficient balance: user %s has no funds available", request.UserID)
+			}
+		}
+		if consumer.Balance < cost {
+			return nil, fmt.Errorf("insufficient balance: user %s has %s, order requires %s", request.UserID, consumer.Balance, cost)
+		}
+		consumer.Balance -= cost
+		consumer.EscrowBalance += cost
+		order.EscrowAmount = cost
+	} else {
+		if producerIndex < 0 {
+			return nil, fmt.Errorf("producer ID is required for sell orders")
+		}
+		producer := &marketState.Producers[producerIndex]
+		if producer.OwnerID != request.UserID {
+			return nil, fmt.Errorf("user %s is not the owner of producer %s", request.UserID, request.ProducerID)
+		}
+		available, err := availableCapacity(producer)
+		if err != nil {
+			return nil, err
+		}
+		if available < order.Quantity {
+			return nil, fmt.Errorf("insufficient capacity: producer %s has %s available, order requires %s", request.ProducerID, available, order.Quantity)
+		}
+		producer.CommittedCapacity += order.Quantity
+	}
+
+	existing, err := ctx.GetStub().GetState(order.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order %s: %v", order.ID, err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("order %s already exists", order.ID)
+	}
+
+	return order, nil
+}
+
+// CancelOrder withdraws a resting order and releases its escrowed funds or
+// producer capacity back to the owner
+func (s *EnergyMarket) CancelOrder(ctx contractapi.TransactionContextInterface, orderID string, userID string) error {
+	order, err := getOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.UserID != userID {
+		return fmt.Errorf("user %s is not the owner of order %s", userID, orderID)
+	}
+	if err := assertCaller(ctx, userID); err != nil {
+		return err
+	}
+
+	marketState, err := loadParticipants(ctx, []string{order.UserID}, []string{order.ProducerID})
+	if err != nil {
+		return err
+	}
+
+	releaseOrderEscrow(marketState, order)
+
+	if err := deleteOrder(ctx, order); err != nil {
+		return err
+	}
+
+	return putParticipants(ctx, marketState)
+}
+
+// PurgeExpiredOrders deletes every good-till-time order whose expiry has
+// passed at the transaction time and releases its escrowed funds or producer
+// capacity. It returns the number of orders purged.
+func (s *EnergyMarket) PurgeExpiredOrders(ctx contractapi.TransactionContextInterface) (int, error) {
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	orderIterator, err := ctx.GetStub().GetStateByRange("ORDER_", "ORDER_~")
+	if err != nil {
+		return 0, fmt.Errorf("failed to get orders: %v", err)
+	}
+	defer orderIterator.Close()
+
+	var expired []Order
+	for orderIterator.HasNext() {
+		queryResponse, err := orderIterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("error iterating orders: %v", err)
+		}
+		var order Order
+		err = json.Unmarshal(queryResponse.Value, &order)
+		if err != nil {
+			return 0, fmt.Errorf("failed to unmarshal order: %v", err)
+		}
+		if orderExpired(&order, now) {
+			expired = append(expired, order)
+		}
+	}
+
+	if len(expired) == 0 {
+		return 0, nil
+	}
+
+	userIDs, producerIDs := orderParticipants(expired)
+	marketState, err := loadParticipants(ctx, userIDs, producerIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range expired {
+		releaseOrderEscrow(marketState, &expired[i])
+		if err := deleteOrder(ctx, &expired[i]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := putParticipants(ctx, marketState); err != nil {
+		return 0, err
+	}
+
+	return len(expired), nil
+}
+
+// AmendOrder changes the price and quantity of a resting order, locking or
+// releasing the difference in escrow. The order keeps its place in the queue
+// only when the price is unchanged and the quantity goes down; any other
+// amendment is treated as a new order and moves to the back of the queue.
+// The new price is in USD per MWh and the new quantity in MWh. A post-only
+// order cannot be amended to a price that would cross the book.
+func (s *EnergyMarket) AmendOrder(ctx contractapi.TransactionContextInterface, orderID string, userID string, price float64, quantity float64) error {
+	newPrice, err := toAmount(price)
+	if err != nil {
+		return fmt.Errorf("invalid order price: %v", err)
+	}
+	if newPrice <= 0 {
+		return fmt.Errorf("order price must be at least one micro-unit")
+	}
+	newQuantity, err := toEnergy(quantity)
+	if err != nil {
+		return fmt.Errorf("invalid order quantity: %v", err)
+	}
+	if newQuantity <= 0 {
+		return fmt.Errorf("order quantity must be positive")
+	}
+
+	order, err := getOrder(ctx, orderID)
+	if err != nil {
+		return err
+	}
+	if order.UserID != userID {
+		return fmt.Errorf("user %s is not the owner of order %s", userID, orderID)
+	}
+	if err := assertCaller(ctx, userID); err != nil {
+		return err
+	}
+	if newPrice == order.Price && newQuantity == order.Quantity {
+		return fmt.Errorf("amendment leaves order %s unchanged", orderID)
+	}
+
+	now, err := txTimestamp(ctx)
+	if err != nil {
+		return err
+	}
+	if orderExpired(order, now) {
+		return fmt.Errorf("order %s has expired", orderID)
+	}
+
+	// A post-only order keeps adding liquidity, so it cannot be amended to a
+	// price that crosses the book, just as PlaceOrder rejects one
+	if order.PostOnly {
+		orderBook, err := s.GetOrderBook(ctx)
+		if err != nil {
+			return err
+		}
+		makers := orderBook["sell"]
+		if order.OrderType == "sell" {
+			makers = orderBook["buy"]
+		}
+		amended := *order
+		amended.Price = newPrice
+		amended.Quantity = newQuantity
+		if fillableQuantity(&amended, makers) > 0 {
+			return fmt.Errorf("post-only order %s would take liquidity at the amended price", orderID)
+		}
+	}
+
+	marketState, err := loadParticipants(ctx, []string{order.UserID}, []string{order.ProducerID})
+	if err != nil {
+		return err
+	}
+
+	if order.OrderType == "buy" {
+		consumerIndex := findConsumer(marketState, userID)
+		if consumerIndex < 0 {
+			return fmt.Errorf("user %s not found", userID)
+		}
+		consumer := &marketState.Consumers[consumerIndex]
+
+		// Lock or release only the difference to the current escrow
+		escrow := valueOf(newPrice, newQuantity)
+		delta := escrow - order.EscrowAmount
+		if delta > consumer.Balance {
+			return fmt.Errorf("insufficient balance: user %s has %s, amendment requires %s more", userID, consumer.Balance, delta)
+		}
+		consumer.Balance -= delta
+		consumer.EscrowBalance += delta
+		order.EscrowAmount = escrow
+	} else {
+		producerIndex := findProducer(marketState, order.ProducerID)
+		if producerIndex < 0 {
+			return fmt.Errorf("producer %s not found", order.ProducerID)
+		}
+		producer := &marketState.Producers[producerIndex]
+		if producer.OwnerID != userID {
+			return fmt.Errorf("user %s is not the owner of producer %s", userID, order.ProducerID)
+		}
+
+		available, err := availableCapacity(producer)
+		if err != nil {
+			return err
+		}
+		available += order.Quantity
+		if available < newQuantity {
+			return fmt.Errorf("insufficient capacity: producer %s has %s available, amendment requires %s", order.ProducerID, available, newQuantity)
+		}
+		producer.CommittedCapacity += newQuantity - order.Quantity
+	}
+
+	// Anything but a pure size reduction loses time priority
+	if newPrice != order.Price || newQuantity > order.Quantity {
+		order.Timestamp = now.Format(orderTimestampLayout)
+	}
+	order.Price = newPrice
+	order.Quantity = newQuantity
+
+	if err := putOrder(ctx, order); err != nil {
+		return err
+	}
+
+	return putParticipants(ctx, marketState)
+}
+
+// isRestingOrder reports whether an order may rest in the order book. Orders
+// stored before execution types existed are plain good-till-cancelled limits.
+func isRestingOrder(order *Order) bool {
+	if order.ExecutionType != "" && order.ExecutionType != ExecutionLimit {
+		return false
+	}
+	return order.TimeInForce == "" || order.TimeInForce == TimeInForceGTC || order.TimeInForce == TimeInForceGTT
+}
+
+// orderExpired reports whether a good-till-time order has expired at the given
+// transaction time
+func orderExpired(order *Order, now time.Time) bool {
+	if order.ExpiresAt == "" {
+		return false
+	}
+
+	expiry, err := time.Parse(time.RFC3339, order.ExpiresAt)
+	if err != nil {
+		// An unreadable expiry cannot be honoured, so the order is treated as expired
+		return true
+	}
+
+	return !now.Before(expiry)
+}
+
+// getOrder reads an order from the order book
+func getOrder(ctx contractapi.TransactionContextInterface, orderID string) (*Order, error) {
+	orderJSON, err := ctx.GetStub().GetState(orderID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read order %s: %v", orderID, err)
+	}
+	if orderJSON == nil {
+		return nil, fmt.Errorf("order %s does not exist", orderID)
+	}
+
+	var order Order
+	err = json.Unmarshal(orderJSON, &order)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal order %s: %v", orderID, err)
+	}
+
+	return &order, nil
+}
+
+// putOrder stores an order under its ORDER_ key
+func putOrder(ctx contractapi.TransactionContextInterface, order *Order) error {
+	orderJSON, err := json.Marshal(order)
+	if err != nil {
+		return fmt.Errorf("failed to marshal order: %v", err)
+	}
+
+	err = ctx.GetStub().PutState(order.ID, orderJSON)
+	if err != nil {
+		return fmt.Errorf("failed to save order %s: %v", order.ID, err)
+	}
+
+	return nil
+}
+
+// deleteOrder removes an order from the order book
+func deleteOrder(ctx contractapi.TransactionContextInterface, order *Order) error {
+	err := ctx.GetStub().DelState(order.ID)
+	if err != nil {
+		return fmt.Errorf("failed to delete order %s: %v", order.ID, err)
+	}
+
+	return nil
+}
+
+// releaseOrderEscrow returns the funds locked by a buy order to the buyer's
+// balance, or frees the producer capacity locked by a sell order
+func releaseOrderEscrow(marketState *MarketState, order *Order) {
+	if order.OrderType == "buy" {
+		if i := findConsumer(marketState, order.UserID); i >= 0 {
+			marketState.Consumers[i].EscrowBalance -= order.EscrowAmount
+			marketState.Consumers[i].Balance += order.EscrowAmount
+		}
+		order.EscrowAmount = 0
+		return
+	}
+
+	if i := findProducer(marketState, order.ProducerID); i >= 0 {
+		marketState.Producers[i].CommittedCapacity -= order.Quantity
+	}
+}
+
+// availableCapacity returns the capacity of a producer that is neither
+// committed to resting sell orders nor already sold through them. Only
+// cancelling, expiring or amending down a sell order gives capacity back.
+func availableCapacity(producer *Producer) (Energy, error) {
+	capacity, err := toEnergy(producer.ProductionMax)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capacity of producer %s: %v", producer.ID, err)
+	}
+
+	return capacity - producer.CommittedCapacity, nil
+}
+
+// txTimestamp returns the transaction timestamp proposed by the client, which
+// is identical on every endorsing peer
+func txTimestamp(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read transaction timestamp: %v", err)
+	}
+
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// findConsumer returns the index of the consumer with the given ID, or -1
+func findConsumer(marketState *MarketState, consumerID string) int {
+	for i := range marketState.Consumers {
+		if marketState.Consumers[i].ID == consumerID {
+			return i
+		}
+	}
+	return -1
+}
+
+// findProducer returns the index of the producer with the given ID, or -1
+func findProducer(marketState *MarketState, producerID string) int {
+	for i := range marketState.Producers {
+		if marketState.Producers[i].ID == producerID {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+func TestAmendOrderKeepsPostOnlyOrdersOffTheBook(t *testing.T) {
+	tests := []struct {
+		name     string
+		price    float64
+		quantity float64
+		ok       bool
+	}{
+		{"below the ask", 45, 4, true},
+		{"larger below the ask", 40, 8, true},
+		{"onto the ask", 50, 4, false},
+		{"through the ask", 60, 4, false},
+		{"through only its own ask", 32, 4, true},
+	}
+	for _, test := range tests {
+		market := newTestMarket(t)
+		market.placeOrder("sell", 50, 5, "consumer2", "producer2")
+		market.placeOrder("sell", 30, 5, "consumer1", "producer1")
+
+		request := OrderRequest{Side: "buy", PostOnly: true, Price: 25, Quantity: 4, UserID: "consumer1"}
+		result, err := market.contract.SubmitOrder(market.participant("consumer1"), request)
+		if err != nil || result.Status != OrderStatusResting {
+			t.Fatalf("post-only bid returned %+v, %v", result, err)
+		}
+
+		err = market.contract.AmendOrder(market.participant("consumer1"), result.OrderID, "consumer1", test.price, test.quantity)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: AmendOrder returned %v, want success %v", test.name, err, test.ok)
+		}
+
+		order, err := getOrder(market.operator(), result.OrderID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantPrice := Amount(25000000)
+		if test.ok {
+			wantPrice, _ = toAmount(test.price)
+		}
+		if order.Price != wantPrice {
+			t.Errorf("%s: the bid is at %s, want %s", test.name, order.Price, wantPrice)
+		}
+		if escrow := market.consumer("consumer1").EscrowBalance; escrow != order.EscrowAmount {
+			t.Errorf("%s: %s is held in escrow for a bid locking %s", test.name, escrow, order.EscrowAmount)
+		}
+	}
+}
+
+// at sets the time of the transaction just started
+func (market *testMarket) at(ctx contractapi.TransactionContextInterface, when time.Time) contractapi.TransactionContextInterface {
+	market.stub.TxTimestamp.Seconds = when.Unix()
+	market.stub.TxTimestamp.Nanos = int32(when.Nanosecond())
+	return ctx
+}
+
+func TestPurgeExpiredOrdersReleasesTheirEscrow(t *testing.T) {
+	market := newTestMarket(t)
+	start := time.Date(2024, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	orders := []struct {
+		request OrderRequest
+		expired bool // Expired when the book is purged at 11:00
+	}{
+		{OrderRequest{Side: "buy", Price: 20, Quantity: 5, UserID: "consumer1", ExpiresAt: "2024-06-01T10:30:00Z"}, true},
+		{OrderRequest{Side: "buy", Price: 20, Quantity: 5, UserID: "consumer2", ExpiresAt: "2024-06-01T11:00:00Z"}, true},
+		{OrderRequest{Side: "buy", Price: 20, Quantity: 5, UserID: "consumer3", ExpiresAt: "2024-06-01T12:00:00Z"}, false},
+		{OrderRequest{Side: "buy", Price: 20, Quantity: 5, UserID: "consumer4"}, false},
+		{OrderRequest{Side: "sell", Price: 30, Quantity: 5, UserID: "consumer1", ProducerID: "producer1", ExpiresAt: "2024-06-01T10:59:59Z"}, true},
+	}
+	for _, order := range orders {
+		result, err := market.contract.SubmitOrder(market.at(market.participant(order.request.UserID), start), order.request)
+		if err != nil || result.Status != OrderStatusResting {
+			t.Fatalf("order of %s returned %+v, %v", order.request.UserID, result, err)
+		}
+	}
+
+	// An expiry that has already passed is rejected
+	late := OrderRequest{Side: "buy", Price: 20, Quantity: 5, UserID: "consumer5", ExpiresAt: "2024-06-01T09:00:00Z"}
+	if _, err := market.contract.SubmitOrder(market.at(market.participant("consumer5"), start), late); err == nil {
+		t.Errorf("an order expiring before it was placed was accepted")
+	}
+
+	purged, err := market.contract.PurgeExpiredOrders(market.at(market.operator(), start.Add(time.Hour)))
+	if err != nil {
+		t.Fatalf("PurgeExpiredOrders failed: %v", err)
+	}
+	if purged != 3 {
+		t.Errorf("purged %d orders, want 3", purged)
+	}
+	if purged, err = market.contract.PurgeExpiredOrders(market.at(market.operator(), start.Add(time.Hour))); err != nil || purged != 0 {
+		t.Errorf("purging again returned %d, %v, want nothing purged", purged, err)
+	}
+
+	for _, order := range orders {
+		consumer := market.consumer(order.request.UserID)
+		if order.request.Side == "sell" {
+			if producer := market.producer(order.request.ProducerID); producer.CommittedCapacity != 0 {
+				t.Errorf("%s keeps %s committed to an expired order", producer.ID, producer.CommittedCapacity)
+			}
+			continue
+		}
+		wantEscrow := Amount(100000000)
+		if order.expired {
+			wantEscrow = 0
+		}
+		if consumer.EscrowBalance != wantEscrow || consumer.Balance+consumer.EscrowBalance != 10000000000 {
+			t.Errorf("%s has %s available and %s in escrow, want %s in escrow", consumer.ID, consumer.Balance, consumer.EscrowBalance, wantEscrow)
+		}
+	}
+
+	orderBook, err := market.contract.GetOrderBook(market.at(market.operator(), start.Add(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orderBook["buy"]) != 2 || len(orderBook["sell"]) != 0 {
+		t.Errorf("the book holds %d bids and %d asks after the purge, want 2 and none", len(orderBook["buy"]), len(orderBook["sell"]))
+	}
+	market.assertSupplyConsistent()
+}
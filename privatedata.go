@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Each organisation keeps the cost curves, utility parameters, schedules,
+// balances, allowances and funds requests of its own participants in its own
+// private data collection, named by collectionOf and configured in
+// collections_config.json. The channel only sees the hashes of their keys
+// and values. A peer of another organisation cannot read them, so clearing
+// and settlement transactions it endorses are passed the private records they
+// read as transient data under "private", as
+// {"<object type>": {"<id>": "<stored JSON>"}}. Each record is checked
+// against the hash on the ledger before it is used; GetPrivateInputs returns
+// a participant's records in this form. Clearing settles the balances of
+// every organisation, so the collections let non-members write.
+const privateTransientKey = "private"
+
+// Balances and allowances are small numbers, so their hashes on the channel
+// could be reversed by hashing every likely value. Each carries a salt drawn
+// from random bytes the client passes as transient data under "salt" to the
+// transaction that creates it.
+const (
+	saltTransientKey = "salt"
+	minSaltLength    = 16
+)
+
+// Transient data keys the private inputs of a transaction are passed under,
+// so they never appear in the transaction proposal
+const (
+	producerTransientKey = "producer"
+	consumerTransientKey = "consumer"
+	offersTransientKey   = "offers"
+	bidsTransientKey     = "bids"
+)
+
+// PrivateInputs holds stored private records, as the JSON they are stored as,
+// keyed by object type and ID
+type PrivateInputs map[string]map[string]string
+
+// privateRecord names a private record and the organisation holding it
+type privateRecord struct {
+	mspID      string
+	objectType string
+	id         string
+}
+
+// privateUnavailableError reports a private record the endorsing peer cannot
+// read and that was not passed as transient data
+type privateUnavailableError struct {
+	objectType string
+	id         string
+	mspID      string
+}
+
+func (e *privateUnavailableError) Error() string {
+	return fmt.Sprintf("private %s %s is held by %s, pass it as transient data under %q", e.objectType, e.id, e.mspID, privateTransientKey)
+}
+
+// isPrivateUnavailable reports whether an error is a privateUnavailableError
+func isPrivateUnavailable(err error) bool {
+	var unavailable *privateUnavailableError
+	return errors.As(err, &unavailable)
+}
+
+// collectionOf is the private data collection of an organisation
+func collectionOf(mspID string) string {
+	return mspID + "PrivateCollection"
+}
+
+// ProducerPrivate holds the cost parameters of a producer, which are kept in
+// its owner's private data collection instead of on the producer. Its
+// marginal cost and cost at the cleared output are kept with them, as
+// together with the public output they would give the parameters away.
+type ProducerPrivate struct {
+	ID          string       `json:"id"`
+	A           float64      `json:"a"`
+	B           float64      `json:"b"`
+	CostCurve   []CostPoint  `json:"costCurve,omitempty"`
+	OfferBlocks []OfferBlock `json:"offerBlocks,omitempty"`
+	Lambda      float64      `json:"lambda"`
+	Cost        float64      `json:"cost"`
+}
+
+// ConsumerPrivate holds the utility parameters of a consumer, which are kept
+// in its organisation's private data collection instead of on the consumer.
+// Its utility of each cleared demand is kept with them, as two of those with
+// the public demands would give the parameters away.
+type ConsumerPrivate struct {
+	ID           string         `json:"id"`
+	Beta         float64        `json:"beta"`
+	Theta        float64        `json:"theta"`
+	UtilityCurve []UtilityPoint `json:"utilityCurve,omitempty"`
+	DemandBlocks []DemandBlock  `json:"demandBlocks,omitempty"`
+	Utilities    []float64      `json:"utilities"`
+}
+
+// splitProducer returns the public part of a producer, with its cost
+// parameters blanked, and the private part holding them
+func splitProducer(producer *Producer) (Producer, ProducerPrivate) {
+	details := ProducerPrivate{
+		ID:          producer.ID,
+		A:           producer.A,
+		B:           producer.B,
+		CostCurve:   producer.CostCurve,
+		OfferBlocks: producer.OfferBlocks,
+		Lambda:      producer.Lambda,
+		Cost:        producer.Cost,
+	}
+
+	public := *producer
+	public.A = 0
+	public.B = 0
+	public.CostCurve = nil
+	public.OfferBlocks = nil
+	public.Lambda = 0
+	public.Cost = 0
+
+	return public, details
+}
+
+// applyTo puts a producer's cost parameters back on it
+func (details *ProducerPrivate) applyTo(producer *Producer) {
+	producer.A = details.A
+	producer.B = details.B
+	producer.CostCurve = details.CostCurve
+	producer.OfferBlocks = details.OfferBlocks
+	producer.Lambda = details.Lambda
+	producer.Cost = details.Cost
+}
+
+// splitConsumer returns the public part of a consumer, with its utility
+// parameters blanked, and the private part holding them
+func splitConsumer(consumer *Consumer) (Consumer, ConsumerPrivate) {
+	details := ConsumerPrivate{
+		ID:           consumer.ID,
+		Beta:         consumer.Beta,
+		Theta:        consumer.Theta,
+		UtilityCurve: consumer.UtilityCurve,
+		DemandBlocks: consumer.DemandBlocks,
+		Utilities:    consumer.Utilities,
+	}
+
+	public := *consumer
+	public.Beta = 0
+	public.Theta = 0
+	public.UtilityCurve = nil
+	public.DemandBlocks = nil
+	public.Utilities = nil
+
+	return public, details
+}
+
+// applyTo puts a consumer's utility parameters back on it. Utilities stored
+// before a producer was added no longer line up with the demands and start
+// again from zero; the next clearing fills them in.
+func (details *ConsumerPrivate) applyTo(consumer *Consumer) {
+	consumer.Beta = details.Beta
+	consumer.Theta = details.Theta
+	consumer.UtilityCurve = details.UtilityCurve
+	consumer.DemandBlocks = details.DemandBlocks
+	consumer.Utilities = details.Utilities
+	if len(consumer.Utilities) != len(consumer.Demands) {
+		consumer.Utilities = make([]float64, len(consumer.Demands))
+	}
+}
+
+// redactMarketState blanks the private details of every participant the
+// caller does not act for. Operators and auditors see everything.
+func redactMarketState(ctx contractapi.TransactionContextInterface, marketState *MarketState) {
+	if hasRole(ctx, RoleOperator) || hasRole(ctx, RoleAuditor) {
+		return
+	}
+
+	participantID := ""
+	if identity, err := callerIdentity(ctx); err == nil {
+		participantID = identity.ParticipantID
+	}
+
+	for i := range marketState.Producers {
+		producer := &marketState.Producers[i]
+		if producer.OwnerID != participantID {
+			*producer, _ = splitProducer(producer)
+		}
+	}
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		if consumer.ID != participantID {
+			*consumer, _ = splitConsumer(consumer)
+			consumer.Balance = 0
+			consumer.EscrowBalance = 0
+			consumer.LockedBalance = 0
+		}
+	}
+}
+
+// getTransient reads the JSON value passed under a transient data key
+func getTransient(ctx contractapi.TransactionContextInterface, key string, value interface{}) error {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return fmt.Errorf("failed to read transient data: %v", err)
+	}
+	valueJSON, ok := transient[key]
+	if !ok {
+		return fmt.Errorf("transient data %q is required", key)
+	}
+
+	if err := json.Unmarshal(valueJSON, value); err != nil {
+		return fmt.Errorf("failed to unmarshal transient data %q: %v", key, err)
+	}
+
+	return nil
+}
+
+// loadVisibleDetails puts the private details and balance of every
+// participant the peer can read on a market state of public profiles. The
+// others are left blank.
+func loadVisibleDetails(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	for i := range marketState.Producers {
+		err := readProducerDetails(ctx, &marketState.Producers[i])
+		if err != nil && !isPrivateUnavailable(err) {
+			return err
+		}
+	}
+	for j := range marketState.Consumers {
+		err := readConsumerDetails(ctx, &marketState.Consumers[j])
+		if err != nil && !isPrivateUnavailable(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPrivateInputs retrieves the stored private records of a participant and
+// of the producers it owns, in the form clearing and settlement transactions
+// take them as transient data under "private". Only the participant,
+// operators and auditors may read them, from a peer of the participant's
+// organisation.
+func (s *EnergyMarket) GetPrivateInputs(ctx contractapi.TransactionContextInterface, participantID string) (PrivateInputs, error) {
+	if err := assertCanRead(ctx, participantID); err != nil {
+		return nil, err
+	}
+
+	consumer, err := getConsumerProfile(ctx, participantID)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := PrivateInputs{}
+	records := []privateRecord{
+		{consumer.MSPID, consumerPrivateType, consumer.ID},
+		{consumer.MSPID, accountObjectType, consumer.ID},
+		{consumer.MSPID, bidObjectType, consumer.ID},
+	}
+	for _, producerID := range consumer.ProducerIDs {
+		producer, err := getProducerProfile(ctx, producerID)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records,
+			privateRecord{producer.MSPID, producerPrivateType, producer.ID},
+			privateRecord{producer.MSPID, offerObjectType, producer.ID})
+	}
+
+	for _, record := range records {
+		valueJSON, err := getPrivateValue(ctx, record.mspID, record.objectType, record.id)
+		if err != nil {
+			return nil, err
+		}
+		if valueJSON == nil {
+			continue
+		}
+		if inputs[record.objectType] == nil {
+			inputs[record.objectType] = map[string]string{}
+		}
+		inputs[record.objectType][record.id] = string(valueJSON)
+	}
+
+	return inputs, nil
+}
+
+// newSalt derives the salt of a new balance or allowance record from the
+// random bytes passed as transient data under "salt", so one value can salt
+// every record a transaction creates
+func newSalt(ctx contractapi.TransactionContextInterface, objectType string, id string) (string, error) {
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return "", fmt.Errorf("failed to read transient data: %v", err)
+	}
+	secret, ok := transient[saltTransientKey]
+	if !ok || len(secret) < minSaltLength {
+		return "", fmt.Errorf("transient data %q of at least %d random bytes is required", saltTransientKey, minSaltLength)
+	}
+
+	salt := sha256.Sum256([]byte(string(secret) + "\x00" + objectType + "\x00" + id))
+	return hex.EncodeToString(salt[:]), nil
+}
+
+// getPrivateValue reads the JSON stored under a composite key in an
+// organisation's collection, or nil if it does not exist. A value passed as
+// transient data under "private" is used when it matches the hash on the
+// ledger; otherwise the peer must belong to the organisation.
+func getPrivateValue(ctx contractapi.TransactionContextInterface, mspID string, objectType string, id string) ([]byte, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s key for %s: %v", objectType, id, err)
+	}
+	collection := collectionOf(mspID)
+
+	transient, err := ctx.GetStub().GetTransient()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transient data: %v", err)
+	}
+	if inputsJSON, ok := transient[privateTransientKey]; ok {
+		var inputs PrivateInputs
+		if err := json.Unmarshal(inputsJSON, &inputs); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal transient data %q: %v", privateTransientKey, err)
+		}
+		if value, ok := inputs[objectType][id]; ok {
+			hash, err := ctx.GetStub().GetPrivateDataHash(collection, key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read hash of private %s %s: %v", objectType, id, err)
+			}
+			valueHash := sha256.Sum256([]byte(value))
+			if hash == nil || !bytes.Equal(hash, valueHash[:]) {
+				return nil, fmt.Errorf("private %s %s passed as transient data does not match the ledger", objectType, id)
+			}
+			return []byte(value), nil
+		}
+	}
+
+	peerMSPID, err := shim.GetMSPID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer MSP ID: %v", err)
+	}
+	if peerMSPID != mspID {
+		return nil, &privateUnavailableError{objectType: objectType, id: id, mspID: mspID}
+	}
+
+	valueJSON, err := ctx.GetStub().GetPrivateData(collection, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private %s %s: %v", objectType, id, err)
+	}
+	return valueJSON, nil
+}
+
+// getPrivateObject reads the JSON object stored under a composite key in an
+// organisation's collection into value and reports whether it exists
+func getPrivateObject(ctx contractapi.TransactionContextInterface, mspID string, objectType string, id string, value interface{}) (bool, error) {
+	valueJSON, err := getPrivateValue(ctx, mspID, objectType, id)
+	if err != nil {
+		return false, err
+	}
+	if valueJSON == nil {
+		return false, nil
+	}
+
+	err = json.Unmarshal(valueJSON, value)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal private %s %s: %v", objectType, id, err)
+	}
+
+	return true, nil
+}
+
+// putPrivateObject stores value as JSON under a composite key in an
+// organisation's collection
+func putPrivateObject(ctx contractapi.TransactionContextInterface, mspID string, objectType string, id string, value interface{}) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return fmt.Errorf("failed to create %s key for %s: %v", objectType, id, err)
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private %s %s: %v", objectType, id, err)
+	}
+
+	err = ctx.GetStub().PutPrivateData(collectionOf(mspID), key, valueJSON)
+	if err != nil {
+		return fmt.Errorf("failed to save private %s %s: %v", objectType, id, err)
+	}
+
+	return nil
+}
+
+// deletePrivateObject removes a composite key from an organisation's collection
+func deletePrivateObject(ctx contractapi.TransactionContextInterface, mspID string, objectType string, id string) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return fmt.Errorf("failed to create %s key for %s: %v", objectType, id, err)
+	}
+
+	err = ctx.GetStub().DelPrivateData(collectionOf(mspID), key)
+	if err != nil {
+		return fmt.Errorf("failed to delete private %s %s: %v", objectType, id, err)
+	}
+
+	return nil
+}
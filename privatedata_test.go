@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// privateInputs collects the private records of every consumer and of the
+// producers it owns, read on a peer of the organisation holding them
+func (market *testMarket) privateInputs() PrivateInputs {
+	inputs := PrivateInputs{}
+	for _, consumer := range defaultMarketSeed().Consumers {
+		records, err := market.contract.GetPrivateInputs(market.operator(), consumer.ID)
+		if err != nil {
+			market.t.Fatalf("GetPrivateInputs of %s failed: %v", consumer.ID, err)
+		}
+		for objectType, values := range records {
+			if inputs[objectType] == nil {
+				inputs[objectType] = map[string]string{}
+			}
+			for id, value := range values {
+				inputs[objectType][id] = value
+			}
+		}
+	}
+	return inputs
+}
+
+// passPrivateInputs passes private records to the transaction just started
+func (market *testMarket) passPrivateInputs(inputs PrivateInputs) {
+	inputsJSON, err := json.Marshal(inputs)
+	if err != nil {
+		market.t.Fatal(err)
+	}
+	market.stub.TransientMap[privateTransientKey] = inputsJSON
+}
+
+func TestPublicProfilesHoldNoPrivateDetails(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.UpdateMarket(market.operator()); err != nil {
+		t.Fatalf("UpdateMarket failed: %v", err)
+	}
+
+	ctx := market.operator()
+	for _, seed := range defaultMarketSeed().Producers {
+		producer, err := getProducerProfile(ctx, seed.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if producer.A != 0 || producer.B != 0 || producer.Lambda != 0 || producer.Cost != 0 {
+			t.Errorf("public profile of %s has a=%v b=%v lambda=%v cost=%v", producer.ID, producer.A, producer.B, producer.Lambda, producer.Cost)
+		}
+		if private := market.producer(seed.ID); private.A != seed.A || private.Lambda == 0 || private.Cost == 0 {
+			t.Errorf("private details of %s have a=%v lambda=%v cost=%v", seed.ID, private.A, private.Lambda, private.Cost)
+		}
+	}
+	for _, seed := range defaultMarketSeed().Consumers {
+		consumer, err := getConsumerProfile(ctx, seed.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if consumer.Beta != 0 || consumer.Theta != 0 || consumer.Utilities != nil || consumer.Balance != 0 {
+			t.Errorf("public profile of %s has beta=%v theta=%v utilities=%v balance=%s", consumer.ID, consumer.Beta, consumer.Theta, consumer.Utilities, consumer.Balance)
+		}
+		account, err := getAccount(ctx, seed.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(account.Salt) != 64 {
+			t.Errorf("account of %s has salt %q, want 32 hex-encoded bytes", seed.ID, account.Salt)
+		}
+	}
+}
+
+func TestCreatingAnAccountRequiresASalt(t *testing.T) {
+	market := newTestMarket(t)
+
+	ctx := market.operator()
+	delete(market.stub.TransientMap, saltTransientKey)
+	if err := market.contract.InitMarket(ctx); err == nil || !strings.Contains(err.Error(), `"salt"`) {
+		t.Errorf("InitMarket without a salt returned %v, want the salt to be required", err)
+	}
+
+	ctx = market.operator()
+	market.stub.TransientMap[saltTransientKey] = []byte("too short")
+	if err := market.contract.InitMarket(ctx); err == nil {
+		t.Errorf("InitMarket accepted a salt of 9 bytes")
+	}
+}
+
+func TestGetMarketStateRedactsOtherParticipants(t *testing.T) {
+	market := newTestMarket(t)
+
+	tests := []struct {
+		name        string
+		identity    testIdentity
+		participant string // The only participant whose details are seen, empty for all
+	}{
+		{"participant", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer1"}, "consumer1"},
+		{"other participant", testIdentity{mspID: testMSPID, role: RoleParticipant, enrollmentID: "consumer2"}, "consumer2"},
+		{"operator", testIdentity{mspID: testMSPID, role: RoleOperator, enrollmentID: "admin"}, ""},
+		{"auditor", testIdentity{mspID: testMSPID, role: RoleAuditor, enrollmentID: "auditor"}, ""},
+	}
+	for _, test := range tests {
+		marketState, err := market.contract.GetMarketState(market.as(test.identity))
+		if err != nil {
+			t.Fatalf("GetMarketState as %s failed: %v", test.name, err)
+		}
+		for _, consumer := range marketState.Consumers {
+			want := test.participant == "" || consumer.ID == test.participant
+			if seen := consumer.Beta != 0 && consumer.Balance != 0; seen != want {
+				t.Errorf("%s sees beta %v and balance %s of %s", test.name, consumer.Beta, consumer.Balance, consumer.ID)
+			}
+		}
+		for _, producer := range marketState.Producers {
+			want := test.participant == "" || producer.OwnerID == test.participant
+			if seen := producer.A != 0 && producer.Lambda != 0; seen != want {
+				t.Errorf("%s sees a %v and lambda %v of %s", test.name, producer.A, producer.Lambda, producer.ID)
+			}
+		}
+	}
+}
+
+func TestClearingReadsOtherOrganisationsFromTransientData(t *testing.T) {
+	market := newTestMarket(t)
+	inputs := market.privateInputs()
+
+	// A peer of another organisation cannot read the records itself
+	t.Setenv("CORE_PEER_LOCALMSPID", "Org2MSP")
+	err := market.contract.UpdateMarket(market.operator())
+	if !isPrivateUnavailable(err) {
+		t.Fatalf("UpdateMarket on an Org2MSP peer returned %v, want the private records to be unavailable", err)
+	}
+
+	// A record that does not match the hash on the ledger is rejected
+	tampered := PrivateInputs{}
+	for objectType, values := range inputs {
+		tampered[objectType] = map[string]string{}
+		for id, value := range values {
+			tampered[objectType][id] = value
+		}
+	}
+	tampered[accountObjectType]["consumer1"] = `{"userId":"consumer1","balance":999999999999}`
+	ctx := market.operator()
+	market.passPrivateInputs(tampered)
+	if err := market.contract.UpdateMarket(ctx); err == nil || !strings.Contains(err.Error(), "does not match the ledger") {
+		t.Errorf("UpdateMarket with a tampered balance returned %v, want a hash mismatch", err)
+	}
+
+	// The records read on the holding organisation's peer are accepted
+	ctx = market.operator()
+	market.passPrivateInputs(inputs)
+	if err := market.contract.UpdateMarket(ctx); err != nil {
+		t.Errorf("UpdateMarket with the private inputs failed: %v", err)
+	}
+}
@@ -5,6 +5,7 @@ const http = require('http');
 const { Gateway, Wallets } = require('fabric-network');
 const path = require('path');
 const fs = require('fs');
+const crypto = require('crypto');
 const cors = require('cors');
 const socketIo = require('socket.io');
 const mongoose = require('mongoose');
@@ -24,6 +25,21 @@ app.options('*', cors());
 
 app.use(bodyParser.json());
 
+// The chaincode stores money in micro-USD and energy in Wh (millionths of a
+// MWh). Requests are sent in USD and MWh and responses are converted back.
+const FIXED_POINT_SCALE = 1000000;
+const fromFixedPoint = (value) => Number(value) / FIXED_POINT_SCALE;
+
+const formatOrderBook = (orderBook) => {
+    const formatOrders = (orders) => (orders || []).map(order => ({
+        ...order,
+        price: fromFixedPoint(order.price),
+        quantity: fromFixedPoint(order.quantity),
+        escrowAmount: fromFixedPoint(order.escrowAmount),
+    }));
+    return { buy: formatOrders(orderBook.buy), sell: formatOrders(orderBook.sell) };
+};
+
 // Routes
 app.use('/api/auth', authRoutes);
 
@@ -53,13 +69,30 @@ async function getGateway() {
     return gateway;
 }
 
+// Submits a clearing or settlement transaction. The peer cannot read the
+// private records of other organisations' participants, so the records
+// GetPrivateInputs returned for them are passed as transient data.
+async function submitWithPrivateInputs(contract, name, privateInputs, ...args) {
+    const transaction = contract.createTransaction(name);
+    if (privateInputs) {
+        transaction.setTransient({ private: Buffer.from(JSON.stringify(privateInputs)) });
+    }
+    return transaction.submit(...args);
+}
+
+// Random bytes the chaincode salts new balance and allowance records with, so
+// their hashes on the channel cannot be guessed
+const newSalt = () => crypto.randomBytes(32);
+
 app.post('/api/initLedger', async (req, res) => {
     try {
         const gateway = await getGateway();
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction('InitLedger');
+        await contract.createTransaction('InitLedger')
+            .setTransient({ salt: newSalt() })
+            .submit();
         res.send('Ledger initialized successfully');
 
         await gateway.disconnect();
@@ -71,7 +104,7 @@ app.post('/api/initLedger', async (req, res) => {
 
 app.post('/api/placeOrder', async (req, res) => {
     try {
-        const { side, price, quantity, userId, producerId } = req.body;
+        const { side, price, quantity, userId, producerId, privateInputs } = req.body;
         if (!side || !price || !quantity || !userId) {
             return res.status(400).send('Missing required parameters');
         }
@@ -85,7 +118,7 @@ app.post('/api/placeOrder', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction('PlaceOrder', side, price.toString(), quantity.toString(), userId, producerId || '');
+        await submitWithPrivateInputs(contract, 'PlaceOrder', privateInputs, side, price.toString(), quantity.toString(), userId, producerId || '');
         res.send('Order placed successfully');
         await gateway.disconnect();
     } catch (error) {
@@ -101,7 +134,7 @@ app.post('/api/matchOrders', async (req, res) => {
         const contract = network.getContract('property');
 
         // Call the MatchOrders function in the chaincode
-        await contract.submitTransaction('MatchOrders');
+        await submitWithPrivateInputs(contract, 'MatchOrders', req.body.privateInputs);
         res.send('Orders matched successfully');
 
         await gateway.disconnect();
@@ -123,7 +156,13 @@ app.get('/api/getBalance/:userId', async (req, res) => {
         const contract = network.getContract('property');
 
         const result = await contract.evaluateTransaction('GetBalance', userId.toString());
-        res.json(JSON.parse(result.toString()));
+        const balance = JSON.parse(result.toString());
+        res.json({
+            ...balance,
+            balance: fromFixedPoint(balance.balance),
+            escrowed: fromFixedPoint(balance.escrowed),
+            available: fromFixedPoint(balance.available),
+        });
 
         await gateway.disconnect();
     } catch (error) {
@@ -139,7 +178,7 @@ app.get('/api/getOrderBook', async (req, res) => {
         const contract = network.getContract('property');
 
         const result = await contract.evaluateTransaction('GetOrderBook');
-        res.json(JSON.parse(result.toString()));
+        res.json(formatOrderBook(JSON.parse(result.toString())));
 
         await gateway.disconnect();
     } catch (error) {
@@ -158,7 +197,7 @@ io.on('connection', (socket) => {
             const network = await gateway.getNetwork('testchannel');
             const contract = network.getContract('property');
             const result = await contract.evaluateTransaction('GetOrderBook');
-            const orderBook = JSON.parse(result.toString());
+            const orderBook = formatOrderBook(JSON.parse(result.toString()));
 
             // Emit the updated order book to all connected clients
             io.emit('orderBookUpdate', orderBook);
@@ -211,9 +250,9 @@ app.get('/api/getTradeHistory', async (req, res) => {
         const formattedTrades = trades.map(trade => ({
             buyerId: trade.buyerId,
             sellerId: trade.sellerId,
-            price: parseFloat(trade.price),
-            quantity: parseFloat(trade.quantity),
-            totalValue: parseFloat(trade.price) * parseFloat(trade.quantity),
+            price: fromFixedPoint(trade.price),
+            quantity: fromFixedPoint(trade.quantity),
+            totalValue: fromFixedPoint(trade.totalValue),
             timestamp: new Date(trade.timestamp).toLocaleString(),
         }));
 
@@ -243,14 +282,14 @@ app.get('/api/getCurrentPrice', async (req, res) => {
         trades.sort((a, b) => new Date(b.timestamp) - new Date(a.timestamp));
 
         // Get most recent trade price
-        const currentPrice = parseFloat(trades[0].price);
+        const currentPrice = fromFixedPoint(trades[0].price);
 
         // Calculate 24h price change
         const oneDayAgo = new Date();
         oneDayAgo.setDate(oneDayAgo.getDate() - 1);
         
         const oldTrade = trades.find(trade => new Date(trade.timestamp) < oneDayAgo);
-        const priceChange = oldTrade ? ((currentPrice - parseFloat(oldTrade.price)) / parseFloat(oldTrade.price) * 100) : 0;
+        const priceChange = oldTrade ? ((currentPrice - fromFixedPoint(oldTrade.price)) / fromFixedPoint(oldTrade.price) * 100) : 0;
 
         res.json({
             currentPrice,
@@ -272,7 +311,9 @@ app.post('/api/initMarket', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction('InitMarket');
+        await contract.createTransaction('InitMarket')
+            .setTransient({ salt: newSalt() })
+            .submit();
         res.send('Market initialized successfully');
 
         await gateway.disconnect();
@@ -289,7 +330,7 @@ app.post('/api/updateMarket', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction('UpdateMarket');
+        await submitWithPrivateInputs(contract, 'UpdateMarket', req.body.privateInputs);
         res.send('Market updated successfully');
 
         await gateway.disconnect();
@@ -302,7 +343,7 @@ app.post('/api/updateMarket', async (req, res) => {
 // Run market until convergence
 app.post('/api/runMarketUntilConvergence', async (req, res) => {
     try {
-        const { maxIterations } = req.body;
+        const { maxIterations, privateInputs } = req.body;
         if (!maxIterations) {
             return res.status(400).send('Max iterations is required');
         }
@@ -311,7 +352,7 @@ app.post('/api/runMarketUntilConvergence', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction('RunMarketUntilConvergence', maxIterations);
+        await submitWithPrivateInputs(contract, 'RunMarketUntilConvergence', privateInputs, maxIterations);
         res.send('Market run completed successfully');
 
         await gateway.disconnect();
@@ -368,7 +409,7 @@ app.get('/api/getUserBalance/:userId', async (req, res) => {
         const contract = network.getContract('property');
 
         const result = await contract.evaluateTransaction('GetUserBalance', userId);
-        res.json({ balance: parseFloat(result.toString()) });
+        res.json({ balance: fromFixedPoint(result.toString()) });
 
         await gateway.disconnect();
     } catch (error) {
@@ -446,8 +487,8 @@ app.post('/api/transferProducerOwnership', async (req, res) => {
 // Create new consumer
 app.post('/api/createConsumer', async (req, res) => {
     try {
-        const { id, beta, theta, demandMin, demandMax, initialBalance } = req.body;
-        if (!id || !beta || !theta || !demandMin || !demandMax || !initialBalance) {
+        const { id, beta, theta, demandMin, demandMax } = req.body;
+        if (!id || !beta || !theta || !demandMin || !demandMax) {
             return res.status(400).send('Missing required parameters');
         }
 
@@ -455,15 +496,12 @@ app.post('/api/createConsumer', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction(
-            'CreateConsumer',
-            id,
-            beta.toString(),
-            theta.toString(),
-            demandMin.toString(),
-            demandMax.toString(),
-            initialBalance.toString()
-        );
+        // The utility parameters go in the private data collection; the
+        // consumer starts without credits until the operator mints some
+        const consumer = { beta: Number(beta), theta: Number(theta) };
+        await contract.createTransaction('CreateConsumer')
+            .setTransient({ consumer: Buffer.from(JSON.stringify(consumer)), salt: newSalt() })
+            .submit(id, demandMin.toString(), demandMax.toString());
         res.send('Consumer created successfully');
 
         await gateway.disconnect();
@@ -485,15 +523,11 @@ app.post('/api/createProducer', async (req, res) => {
         const network = await gateway.getNetwork('testchannel');
         const contract = network.getContract('property');
 
-        await contract.submitTransaction(
-            'CreateProducer',
-            id,
-            a.toString(),
-            b.toString(),
-            productionMin.toString(),
-            productionMax.toString(),
-            ownerId
-        );
+        // The cost coefficients go in the private data collection
+        const producer = { a: Number(a), b: Number(b) };
+        await contract.createTransaction('CreateProducer')
+            .setTransient({ producer: Buffer.from(JSON.stringify(producer)) })
+            .submit(id, productionMin.toString(), productionMax.toString(), ownerId);
         res.send('Producer created successfully');
 
         await gateway.disconnect();
@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Object types of the composite keys the market is stored under. Each
+// producer, consumer and balance lives under its own key, so transactions by
+// different users touch disjoint keys and do not cause MVCC read conflicts.
+// Statistics are written as one delta record per trade and summed on read.
+// Balances, schedules and the private details of producers and consumers
+// are kept in the private data collection of the participant's organisation.
+const (
+	producerObjectType  = "Producer"
+	consumerObjectType  = "Consumer"
+	producerPrivateType = "ProducerPrivate"
+	consumerPrivateType = "ConsumerPrivate"
+	accountObjectType   = "Balance"
+	statsObjectType     = "Stats"
+	admmObjectType      = "AdmmSession"
+	admmUpdateType      = "AdmmUpdate"
+	offerObjectType     = "ProducerSchedule"
+	bidObjectType       = "ConsumerSchedule"
+	dayAheadObjectType  = "DayAhead"
+	networkObjectType   = "Network"
+	networkResultType   = "NetworkResult"
+	storageObjectType   = "Storage"
+	identityObjectType  = "Identity"
+	clearedIntervalType = "ClearedInterval"
+)
+
+// marketObjectTypes lists every composite key object type owned by the
+// market. Identity registrations bind certificates to participants and
+// outlive the market, so they are not among them.
+var marketObjectTypes = []string{
+	producerObjectType, consumerObjectType, statsObjectType,
+	admmObjectType, admmUpdateType, dayAheadObjectType,
+	networkResultType, storageObjectType, tokenSupplyType,
+	clearedIntervalType,
+}
+
+// producerPrivateTypes and consumerPrivateTypes list the object types the
+// market keeps in a participant's private data collection under the
+// participant's ID. Funds requests are the record the balances are reconciled
+// with the bank against, and allowances are grants between users rather
+// than market data, so they are not among them.
+var (
+	producerPrivateTypes = []string{producerPrivateType, offerObjectType}
+	consumerPrivateTypes = []string{consumerPrivateType, accountObjectType, bidObjectType}
+)
+
+// Account holds a consumer's funds, kept apart from the consumer profile so
+// that trading does not rewrite the clearing variables and vice versa, and
+// in the private data collection of the consumer's organisation so that only
+// its hash is public
+type Account struct {
+	UserID        string `json:"userId"`
+	Balance       Amount `json:"balance"`       // Funds available in micro-USD
+	EscrowBalance Amount `json:"escrowBalance"` // Funds locked by resting buy orders
+	LockedBalance Amount `json:"lockedBalance"` // Funds locked by pending withdrawals
+	Salt          string `json:"salt"`          // Keeps the hash of the balances from being guessed
+	mspID         string // Organisation whose collection holds the account, set when it is read
+}
+
+// held returns every credit the account holds, available or locked
+func (account *Account) held() Amount {
+	return account.Balance + account.EscrowBalance + account.LockedBalance
+}
+
+// marketHeader holds the market-wide clearing results stored under the
+// MarketState key
+type marketHeader struct {
+	TotalGeneration float64 `json:"totalGeneration"`
+	TotalDemand     float64 `json:"totalDemand"`
+	TotalLosses     float64 `json:"totalLosses"`
+	SocialWelfare   float64 `json:"socialWelfare"`
+	IterationCount  int     `json:"iterationCount"`
+	Converged       bool    `json:"converged"`
+	TradingMode     string  `json:"tradingMode"`
+	StepScale       float64 `json:"stepScale"`
+	ConfigVersion   int     `json:"configVersion"`
+}
+
+// loadMarketState assembles the full market state from the header, producer,
+// consumer, balance and statistics keys. Producers are ordered by ID, which
+// is the order Consumer.Demands and Consumer.Utilities are indexed in. Every
+// participant's private details and balance are read, so a peer must be
+// passed those of the organisations it does not belong to.
+func loadMarketState(ctx contractapi.TransactionContextInterface) (*MarketState, error) {
+	marketState, err := loadMarketProfiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range marketState.Producers {
+		if err := readProducerDetails(ctx, &marketState.Producers[i]); err != nil {
+			return nil, err
+		}
+	}
+	for j := range marketState.Consumers {
+		if err := readConsumerDetails(ctx, &marketState.Consumers[j]); err != nil {
+			return nil, err
+		}
+	}
+
+	return marketState, nil
+}
+
+// loadMarketProfiles assembles the market state from the header, producer,
+// consumer and statistics keys, leaving the private details and balances of
+// the participants blank
+func loadMarketProfiles(ctx contractapi.TransactionContextInterface) (*MarketState, error) {
+	header, err := getMarketHeader(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	marketState := &MarketState{
+		Producers:       []Producer{},
+		Consumers:       []Consumer{},
+		TotalGeneration: header.TotalGeneration,
+		TotalDemand:     header.TotalDemand,
+		TotalLosses:     header.TotalLosses,
+		SocialWelfare:   header.SocialWelfare,
+		IterationCount:  header.IterationCount,
+		Converged:       header.Converged,
+		TradingMode:     header.TradingMode,
+		StepScale:       header.StepScale,
+		ConfigVersion:   header.ConfigVersion,
+	}
+
+	err = scanObjects(ctx, producerObjectType, func(value []byte) error {
+		var producer Producer
+		if err := json.Unmarshal(value, &producer); err != nil {
+			return fmt.Errorf("failed to unmarshal producer: %v", err)
+		}
+		marketState.Producers = append(marketState.Producers, producer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanObjects(ctx, consumerObjectType, func(value []byte) error {
+		var consumer Consumer
+		if err := json.Unmarshal(value, &consumer); err != nil {
+			return fmt.Errorf("failed to unmarshal consumer: %v", err)
+		}
+		marketState.Consumers = append(marketState.Consumers, consumer)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanObjects(ctx, statsObjectType, func(value []byte) error {
+		var delta MarketStatistics
+		if err := json.Unmarshal(value, &delta); err != nil {
+			return fmt.Errorf("failed to unmarshal statistics: %v", err)
+		}
+		marketState.Statistics.TradeCount += delta.TradeCount
+		marketState.Statistics.Volume24h += delta.Volume24h
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return marketState, nil
+}
+
+// loadParticipants loads only the given consumers, with their balances, and
+// producers into a partial market state, so that trading transactions read
+// and write nothing but the keys of the users they involve. IDs that do not
+// exist are left out, empty IDs are ignored, and Statistics starts at zero.
+func loadParticipants(ctx contractapi.TransactionContextInterface, userIDs []string, producerIDs []string) (*MarketState, error) {
+	marketState := &MarketState{Producers: []Producer{}, Consumers: []Consumer{}}
+
+	for _, id := range sortedUnique(producerIDs) {
+		producer, err := readProducer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if producer != nil {
+			marketState.Producers = append(marketState.Producers, *producer)
+		}
+	}
+
+	for _, id := range sortedUnique(userIDs) {
+		consumer, err := readConsumer(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if consumer != nil {
+			marketState.Consumers = append(marketState.Consumers, *consumer)
+		}
+	}
+
+	return marketState, nil
+}
+
+// putMarketState stores every part of a full market state: the header, all
+// producers, all consumer profiles, their private details and all balances
+func putMarketState(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	if err := putMarketDetails(ctx, marketState); err != nil {
+		return err
+	}
+	return putMarketProfiles(ctx, marketState)
+}
+
+// putMarketProfiles stores a market state loaded by loadMarketProfiles with
+// the balances read by readConsumerAccount: the header, all producers, all
+// consumer profiles and all balances, but not the private details
+func putMarketProfiles(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	if err := putMarketHeader(ctx, headerOf(marketState)); err != nil {
+		return err
+	}
+
+	for i := range marketState.Consumers {
+		if err := putConsumer(ctx, &marketState.Consumers[i]); err != nil {
+			return err
+		}
+	}
+
+	return putParticipants(ctx, marketState)
+}
+
+// putParticipants stores the producers and balances of a market state loaded
+// by loadParticipants. Consumer profiles and the header are not written.
+func putParticipants(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	for i := range marketState.Producers {
+		if err := putProducer(ctx, &marketState.Producers[i]); err != nil {
+			return err
+		}
+	}
+
+	for i := range marketState.Consumers {
+		if err := putAccount(ctx, &marketState.Consumers[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getMarketHeader reads the market-wide clearing results
+func getMarketHeader(ctx contractapi.TransactionContextInterface) (*marketHeader, error) {
+	headerJSON, err := ctx.GetStub().GetState("MarketState")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read market state: %v", err)
+	}
+	if headerJSON == nil {
+		return nil, fmt.Errorf("market state does not exist")
+	}
+
+	var header marketHeader
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal market state: %v", err)
+	}
+
+	return &header, nil
+}
+
+// putMarketHeader stores the market-wide clearing results
+func putMarketHeader(ctx contractapi.TransactionContextInterface, header *marketHeader) error {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to marshal market state: %v", err)
+	}
+
+	err = ctx.GetStub().PutState("MarketState", headerJSON)
+	if err != nil {
+		return fmt.Errorf("failed to update market state: %v", err)
+	}
+
+	return nil
+}
+
+// headerOf extracts the market-wide clearing results of a market state
+func headerOf(marketState *MarketState) *marketHeader {
+	return &marketHeader{
+		TotalGeneration: marketState.TotalGeneration,
+		TotalDemand:     marketState.TotalDemand,
+		TotalLosses:     marketState.TotalLosses,
+		SocialWelfare:   marketState.SocialWelfare,
+		IterationCount:  marketState.IterationCount,
+		Converged:       marketState.Converged,
+		TradingMode:     marketState.TradingMode,
+		StepScale:       marketState.StepScale,
+		ConfigVersion:   marketState.ConfigVersion,
+	}
+}
+
+// orderParticipants returns the users and producers named by a set of orders
+func orderParticipants(orders ...[]Order) ([]string, []string) {
+	var userIDs, producerIDs []string
+	for _, side := range orders {
+		for _, order := range side {
+			userIDs = append(userIDs, order.UserID)
+			producerIDs = append(producerIDs, order.ProducerID)
+		}
+	}
+	return userIDs, producerIDs
+}
+
+// readProducer reads a producer together with its private details, returning
+// nil if it does not exist
+func readProducer(ctx contractapi.TransactionContextInterface, producerID string) (*Producer, error) {
+	producer, err := readProducerProfile(ctx, producerID)
+	if err != nil || producer == nil {
+		return nil, err
+	}
+	if err := readProducerDetails(ctx, producer); err != nil {
+		return nil, err
+	}
+	return producer, nil
+}
+
+// readProducerProfile reads the public part of a producer, returning nil if
+// it does not exist
+func readProducerProfile(ctx contractapi.TransactionContextInterface, producerID string) (*Producer, error) {
+	var producer Producer
+	found, err := getObject(ctx, producerObjectType, producerID, &producer)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &producer, nil
+}
+
+// readProducerDetails puts a producer's private details on it
+func readProducerDetails(ctx contractapi.TransactionContextInterface, producer *Producer) error {
+	var details ProducerPrivate
+	if _, err := getPrivateObject(ctx, producer.MSPID, producerPrivateType, producer.ID, &details); err != nil {
+		return err
+	}
+	details.applyTo(producer)
+	return nil
+}
+
+// getProducer reads a producer that must exist
+func getProducer(ctx contractapi.TransactionContextInterface, producerID string) (*Producer, error) {
+	producer, err := readProducer(ctx, producerID)
+	if err != nil {
+		return nil, err
+	}
+	if producer == nil {
+		return nil, fmt.Errorf("producer %s not found", producerID)
+	}
+	return producer, nil
+}
+
+// getProducerProfile reads the public part of a producer that must exist
+func getProducerProfile(ctx contractapi.TransactionContextInterface, producerID string) (*Producer, error) {
+	producer, err := readProducerProfile(ctx, producerID)
+	if err != nil {
+		return nil, err
+	}
+	if producer == nil {
+		return nil, fmt.Errorf("producer %s not found", producerID)
+	}
+	return producer, nil
+}
+
+// putProducer stores the public part of a producer under its composite key,
+// with its cost parameters blanked
+func putProducer(ctx contractapi.TransactionContextInterface, producer *Producer) error {
+	public, _ := splitProducer(producer)
+	return putObject(ctx, producerObjectType, producer.ID, public)
+}
+
+// putProducerDetails stores a producer's cost parameters in its owner's
+// private data collection
+func putProducerDetails(ctx contractapi.TransactionContextInterface, producer *Producer) error {
+	_, details := splitProducer(producer)
+	return putPrivateObject(ctx, producer.MSPID, producerPrivateType, producer.ID, details)
+}
+
+// readConsumer reads a consumer profile together with its private details
+// and balance, returning nil if the consumer does not exist
+func readConsumer(ctx contractapi.TransactionContextInterface, consumerID string) (*Consumer, error) {
+	consumer, err := readConsumerProfile(ctx, consumerID)
+	if err != nil || consumer == nil {
+		return nil, err
+	}
+	if err := readConsumerDetails(ctx, consumer); err != nil {
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// readConsumerProfile reads the public profile of a consumer, returning nil
+// if it does not exist
+func readConsumerProfile(ctx contractapi.TransactionContextInterface, consumerID string) (*Consumer, error) {
+	var consumer Consumer
+	found, err := getObject(ctx, consumerObjectType, consumerID, &consumer)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &consumer, nil
+}
+
+// readConsumerDetails puts a consumer's private details and balance on it
+func readConsumerDetails(ctx contractapi.TransactionContextInterface, consumer *Consumer) error {
+	var details ConsumerPrivate
+	if _, err := getPrivateObject(ctx, consumer.MSPID, consumerPrivateType, consumer.ID, &details); err != nil {
+		return err
+	}
+	details.applyTo(consumer)
+
+	return readConsumerAccount(ctx, consumer)
+}
+
+// readConsumerAccount puts a consumer's balance on it
+func readConsumerAccount(ctx contractapi.TransactionContextInterface, consumer *Consumer) error {
+	var account Account
+	if _, err := getPrivateObject(ctx, consumer.MSPID, accountObjectType, consumer.ID, &account); err != nil {
+		return err
+	}
+	consumer.Balance = account.Balance
+	consumer.EscrowBalance = account.EscrowBalance
+	consumer.LockedBalance = account.LockedBalance
+	consumer.accountSalt = account.Salt
+
+	return nil
+}
+
+// getConsumer reads a consumer that must exist
+func getConsumer(ctx contractapi.TransactionContextInterface, consumerID string) (*Consumer, error) {
+	consumer, err := readConsumer(ctx, consumerID)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == nil {
+		return nil, fmt.Errorf("user %s not found", consumerID)
+	}
+	return consumer, nil
+}
+
+// getConsumerProfile reads the public profile of a consumer that must exist
+func getConsumerProfile(ctx contractapi.TransactionContextInterface, consumerID string) (*Consumer, error) {
+	consumer, err := readConsumerProfile(ctx, consumerID)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == nil {
+		return nil, fmt.Errorf("user %s not found", consumerID)
+	}
+	return consumer, nil
+}
+
+// putConsumer stores the public profile of a consumer, with its utility
+// parameters blanked. The balance fields are kept under the consumer's
+// Balance key and are blanked in the profile.
+func putConsumer(ctx contractapi.TransactionContextInterface, consumer *Consumer) error {
+	profile, _ := splitConsumer(consumer)
+	profile.Balance = 0
+	profile.EscrowBalance = 0
+	profile.LockedBalance = 0
+	return putObject(ctx, consumerObjectType, consumer.ID, profile)
+}
+
+// putConsumerDetails stores a consumer's utility parameters in its
+// organisation's private data collection
+func putConsumerDetails(ctx contractapi.TransactionContextInterface, consumer *Consumer) error {
+	_, details := splitConsumer(consumer)
+	return putPrivateObject(ctx, consumer.MSPID, consumerPrivateType, consumer.ID, details)
+}
+
+// putMarketDetails stores the private details of every producer and consumer
+// of a market state
+func putMarketDetails(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	for i := range marketState.Producers {
+		if err := putProducerDetails(ctx, &marketState.Producers[i]); err != nil {
+			return err
+		}
+	}
+	for j := range marketState.Consumers {
+		if err := putConsumerDetails(ctx, &marketState.Consumers[j]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putAccount stores a consumer's balance under its composite key in its
+// organisation's private data collection
+func putAccount(ctx contractapi.TransactionContextInterface, consumer *Consumer) error {
+	account := Account{
+		UserID:        consumer.ID,
+		Balance:       consumer.Balance,
+		EscrowBalance: consumer.EscrowBalance,
+		LockedBalance: consumer.LockedBalance,
+		Salt:          consumer.accountSalt,
+	}
+	return putPrivateObject(ctx, consumer.MSPID, accountObjectType, consumer.ID, account)
+}
+
+// putStatsDelta records the statistics contributed by one trade
+func putStatsDelta(ctx contractapi.TransactionContextInterface, tradeID string, delta MarketStatistics) error {
+	return putObject(ctx, statsObjectType, tradeID, delta)
+}
+
+// deleteMarketObjects removes every producer, consumer, balance, statistics,
+// ADMM, day-ahead and network result key, public or private. It refuses
+// while a deposit or withdrawal is open, as its balance would go with them.
+func deleteMarketObjects(ctx contractapi.TransactionContextInterface) error {
+	if err := assertNoOpenFundsRequests(ctx); err != nil {
+		return err
+	}
+
+	// The private keys are found through the public profiles, as the peer
+	// cannot list the collections of other organisations
+	err := scanObjects(ctx, producerObjectType, func(value []byte) error {
+		var producer Producer
+		if err := json.Unmarshal(value, &producer); err != nil {
+			return fmt.Errorf("failed to unmarshal producer: %v", err)
+		}
+		for _, objectType := range producerPrivateTypes {
+			if err := deletePrivateObject(ctx, producer.MSPID, objectType, producer.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = scanObjects(ctx, consumerObjectType, func(value []byte) error {
+		var consumer Consumer
+		if err := json.Unmarshal(value, &consumer); err != nil {
+			return fmt.Errorf("failed to unmarshal consumer: %v", err)
+		}
+		for _, objectType := range consumerPrivateTypes {
+			if err := deletePrivateObject(ctx, consumer.MSPID, objectType, consumer.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, objectType := range marketObjectTypes {
+		if err := deleteObjects(ctx, objectType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteObjects removes every key of an object type
+func deleteObjects(ctx contractapi.TransactionContextInterface, objectType string) error {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s keys: %v", objectType, err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return fmt.Errorf("error iterating %s keys: %v", objectType, err)
+		}
+		err = ctx.GetStub().DelState(queryResponse.Key)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s key: %v", objectType, err)
+		}
+	}
+
+	return nil
+}
+
+// getObject reads the JSON object stored under a composite key into value and
+// reports whether it exists
+func getObject(ctx contractapi.TransactionContextInterface, objectType string, id string, value interface{}) (bool, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s key for %s: %v", objectType, id, err)
+	}
+
+	valueJSON, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s %s: %v", objectType, id, err)
+	}
+	if valueJSON == nil {
+		return false, nil
+	}
+
+	err = json.Unmarshal(valueJSON, value)
+	if err != nil {
+		return false, fmt.Errorf("failed to unmarshal %s %s: %v", objectType, id, err)
+	}
+
+	return true, nil
+}
+
+// putObject stores value as JSON under a composite key
+func putObject(ctx contractapi.TransactionContextInterface, objectType string, id string, value interface{}) error {
+	key, err := ctx.GetStub().CreateCompositeKey(objectType, []string{id})
+	if err != nil {
+		return fmt.Errorf("failed to create %s key for %s: %v", objectType, id, err)
+	}
+
+	valueJSON, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s %s: %v", objectType, id, err)
+	}
+
+	err = ctx.GetStub().PutState(key, valueJSON)
+	if err != nil {
+		return fmt.Errorf("failed to save %s %s: %v", objectType, id, err)
+	}
+
+	return nil
+}
+
+// scanObjects calls fn with the value of every key of an object type, in key order
+func scanObjects(ctx contractapi.TransactionContextInterface, objectType string, fn func(value []byte) error) error {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(objectType, []string{})
+	if err != nil {
+		return fmt.Errorf("failed to get %s keys: %v", objectType, err)
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		queryResponse, err := iterator.Next()
+		if err != nil {
+			return fmt.Errorf("error iterating %s keys: %v", objectType, err)
+		}
+		if err := fn(queryResponse.Value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortedUnique returns the non-empty IDs sorted and without duplicates
+func sortedUnique(ids []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
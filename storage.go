@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Storage is a battery that buys energy in some intervals of the day-ahead
+// market and sells it back in others. It charges whenever the interval price
+// is below its charge price and discharges whenever it is above its
+// discharge price, as far as its power limits and state of charge allow.
+type Storage struct {
+	ID                  string  `json:"id"`
+	OwnerID             string  `json:"ownerId"`             // Consumer who pays for charging and is paid for discharging
+	Capacity            float64 `json:"capacity"`            // Energy it can hold, in MWh
+	ChargeMax           float64 `json:"chargeMax"`           // Largest charging power, in MW
+	DischargeMax        float64 `json:"dischargeMax"`        // Largest discharging power, in MW
+	ChargeEfficiency    float64 `json:"chargeEfficiency"`    // Share of the energy bought that is stored, in (0, 1]
+	DischargeEfficiency float64 `json:"dischargeEfficiency"` // Share of the energy released that is delivered, in (0, 1]
+	StateOfCharge       float64 `json:"stateOfCharge"`       // Energy held at the end of the last cleared day, in MWh
+	ChargePrice         float64 `json:"chargePrice"`         // Highest price it charges at
+	DischargePrice      float64 `json:"dischargePrice"`      // Lowest price it discharges at
+	TradedVolume        Energy  `json:"tradedVolume"`        // Total energy it has sold
+}
+
+// StorageDispatch is the cleared charging and discharging of one storage unit
+// in one interval
+type StorageDispatch struct {
+	ID            string  `json:"id"`
+	Charge        float64 `json:"charge"`        // Power bought, in MW
+	Discharge     float64 `json:"discharge"`     // Power sold, in MW
+	StateOfCharge float64 `json:"stateOfCharge"` // Energy held at the end of the interval, in MWh
+}
+
+// storageUnit is where a storage unit takes part in a cleared interval: the
+// index of its discharging producer and of its charging consumer, each -1
+// when its state of charge leaves no room for it
+type storageUnit struct {
+	producer int
+	consumer int
+}
+
+// CreateStorage creates a new storage unit owned by a consumer, holding an
+// initial charge. The charge price must be below the discharge price, so the
+// unit never buys and sells in the same interval.
+func (s *EnergyMarket) CreateStorage(ctx contractapi.TransactionContextInterface, id string, ownerID string, capacity float64, chargeMax float64, dischargeMax float64, chargeEfficiency float64, dischargeEfficiency float64, initialCharge float64, chargePrice float64, dischargePrice float64) error {
+	if err := assertCaller(ctx, ownerID); err != nil {
+		return err
+	}
+
+	existing, err := readStorage(ctx, id)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("storage with ID %s already exists", id)
+	}
+	producer, err := readProducerProfile(ctx, id)
+	if err != nil {
+		return err
+	}
+	if producer != nil {
+		return fmt.Errorf("producer with ID %s already exists", id)
+	}
+	consumer, err := readConsumerProfile(ctx, id)
+	if err != nil {
+		return err
+	}
+	if consumer != nil {
+		return fmt.Errorf("consumer with ID %s already exists", id)
+	}
+	if _, err := getConsumerProfile(ctx, ownerID); err != nil {
+		return fmt.Errorf("owner %s not found", ownerID)
+	}
+
+	storage := Storage{
+		ID:                  id,
+		OwnerID:             ownerID,
+		Capacity:            capacity,
+		ChargeMax:           chargeMax,
+		DischargeMax:        dischargeMax,
+		ChargeEfficiency:    chargeEfficiency,
+		DischargeEfficiency: dischargeEfficiency,
+		StateOfCharge:       initialCharge,
+		ChargePrice:         chargePrice,
+		DischargePrice:      dischargePrice,
+	}
+	if err := validateStorage(&storage); err != nil {
+		return err
+	}
+
+	return putStorage(ctx, &storage)
+}
+
+// SetStoragePrices changes the prices a storage unit charges and discharges
+// at. Only the unit's owner may set them.
+func (s *EnergyMarket) SetStoragePrices(ctx contractapi.TransactionContextInterface, storageID string, ownerID string, chargePrice float64, dischargePrice float64) error {
+	if err := assertCaller(ctx, ownerID); err != nil {
+		return err
+	}
+
+	storage, err := getStorage(ctx, storageID)
+	if err != nil {
+		return err
+	}
+	if storage.OwnerID != ownerID {
+		return fmt.Errorf("user %s is not the owner of storage %s", ownerID, storageID)
+	}
+
+	storage.ChargePrice = chargePrice
+	storage.DischargePrice = dischargePrice
+	if err := validateStorage(storage); err != nil {
+		return err
+	}
+
+	return putStorage(ctx, storage)
+}
+
+// GetStorage retrieves a storage unit with its current state of charge
+func (s *EnergyMarket) GetStorage(ctx contractapi.TransactionContextInterface, storageID string) (*Storage, error) {
+	return getStorage(ctx, storageID)
+}
+
+// validateStorage checks a storage unit's limits, efficiencies, state of
+// charge and prices
+func validateStorage(storage *Storage) error {
+	for _, value := range []float64{storage.Capacity, storage.ChargeMax, storage.DischargeMax, storage.StateOfCharge} {
+		if math.IsNaN(value) || math.IsInf(value, 0) || value < 0 {
+			return fmt.Errorf("storage %s limits must be non-negative numbers", storage.ID)
+		}
+	}
+	if storage.Capacity == 0 {
+		return fmt.Errorf("storage %s must have a positive capacity", storage.ID)
+	}
+	if storage.StateOfCharge > storage.Capacity {
+		return fmt.Errorf("storage %s cannot hold more than its capacity %.2f", storage.ID, storage.Capacity)
+	}
+	if !(storage.ChargeEfficiency > 0 && storage.ChargeEfficiency <= 1) || !(storage.DischargeEfficiency > 0 && storage.DischargeEfficiency <= 1) {
+		return fmt.Errorf("storage %s efficiencies must be between 0 and 1", storage.ID)
+	}
+	if math.IsNaN(storage.ChargePrice) || math.IsInf(storage.ChargePrice, 0) || math.IsNaN(storage.DischargePrice) || math.IsInf(storage.DischargePrice, 0) {
+		return fmt.Errorf("storage %s prices must be finite numbers", storage.ID)
+	}
+	if storage.ChargePrice >= storage.DischargePrice {
+		return fmt.Errorf("storage %s must charge below the price it discharges at", storage.ID)
+	}
+	return nil
+}
+
+// addStorage adds every storage unit to an interval's market: its charging
+// as a consumer with a block bid at the charge price, and its discharging as
+// a producer with a block offer at the discharge price, each limited by the
+// power limit and by the energy the state of charge leaves room for over an
+// interval of the given hours. Both take the unit's ID; the consumer's trades
+// are settled from the owner's account, so the owner pays for the charging,
+// and the producer is owned by the owner, so the owner is paid for the
+// discharging.
+// New producers go after the existing ones, so the existing indices stay valid.
+func addStorage(marketState *MarketState, storages []Storage, hours float64) []storageUnit {
+	units := make([]storageUnit, len(storages))
+	for k, storage := range storages {
+		units[k] = storageUnit{producer: -1, consumer: -1}
+
+		discharge := math.Min(storage.DischargeMax, storage.StateOfCharge*storage.DischargeEfficiency/hours)
+		if discharge > 0 {
+			units[k].producer = len(marketState.Producers)
+			marketState.Producers = append(marketState.Producers, Producer{
+				ID:            storage.ID,
+				OwnerID:       storage.OwnerID,
+				ProductionMax: discharge,
+				OfferBlocks:   []OfferBlock{{Quantity: discharge, Price: storage.DischargePrice}},
+			})
+		}
+	}
+
+	for j := range marketState.Consumers {
+		consumer := &marketState.Consumers[j]
+		for len(consumer.Demands) < len(marketState.Producers) {
+			consumer.Demands = append(consumer.Demands, 0)
+			consumer.Utilities = append(consumer.Utilities, 0)
+		}
+	}
+
+	for k, storage := range storages {
+		charge := math.Min(storage.ChargeMax, (storage.Capacity-storage.StateOfCharge)/(storage.ChargeEfficiency*hours))
+		if charge > 0 {
+			units[k].consumer = len(marketState.Consumers)
+			marketState.Consumers = append(marketState.Consumers, Consumer{
+				ID:           storage.ID,
+				UtilityModel: UtilityBlock,
+				DemandBlocks: []DemandBlock{{Quantity: charge, Price: storage.ChargePrice}},
+				DemandMax:    charge,
+				Demands:      make([]float64, len(marketState.Producers)),
+				Utilities:    make([]float64, len(marketState.Producers)),
+				accountID:    storage.OwnerID,
+			})
+		}
+	}
+
+	return units
+}
+
+// nextStateOfCharge returns the energy a storage unit holds after charging
+// and discharging at the given powers for an interval of the given hours
+func nextStateOfCharge(storage *Storage, charge float64, discharge float64, hours float64) float64 {
+	stateOfCharge := storage.StateOfCharge + (charge*storage.ChargeEfficiency-discharge/storage.DischargeEfficiency)*hours
+	return math.Min(math.Max(stateOfCharge, 0), storage.Capacity)
+}
+
+// getAllStorage reads every storage unit, in ID order
+func getAllStorage(ctx contractapi.TransactionContextInterface) ([]Storage, error) {
+	storages := []Storage{}
+	err := scanObjects(ctx, storageObjectType, func(value []byte) error {
+		var storage Storage
+		if err := json.Unmarshal(value, &storage); err != nil {
+			return fmt.Errorf("failed to unmarshal storage: %v", err)
+		}
+		storages = append(storages, storage)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return storages, nil
+}
+
+// readStorage reads a storage unit, returning nil if it does not exist
+func readStorage(ctx contractapi.TransactionContextInterface, storageID string) (*Storage, error) {
+	var storage Storage
+	found, err := getObject(ctx, storageObjectType, storageID, &storage)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &storage, nil
+}
+
+// getStorage reads a storage unit that must exist
+func getStorage(ctx contractapi.TransactionContextInterface, storageID string) (*Storage, error) {
+	storage, err := readStorage(ctx, storageID)
+	if err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, fmt.Errorf("storage %s not found", storageID)
+	}
+	return storage, nil
+}
+
+// putStorage stores a storage unit under its composite key
+func putStorage(ctx contractapi.TransactionContextInterface, storage *Storage) error {
+	return putObject(ctx, storageObjectType, storage.ID, storage)
+}
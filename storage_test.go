@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestStorageStateOfChargeCarriesAcrossIntervals(t *testing.T) {
+	tests := []struct {
+		name           string
+		initialCharge  float64
+		chargePrice    float64
+		dischargePrice float64
+		want           []float64 // State of charge after each of the first intervals
+	}{
+		// Charges below its charge price until it is full
+		{"charging", 0, 6, 100, []float64{16, 32, 40, 40}},
+		// Discharges above its discharge price until it is empty
+		{"discharging", 40, 0.5, 1, []float64{20, 0, 0, 0}},
+		// Neither price is met
+		{"idle", 10, 1, 100, []float64{10, 10, 10, 10}},
+	}
+	for _, test := range tests {
+		market := newTestMarket(t)
+		err := market.contract.CreateStorage(market.participant("consumer4"), "battery1", "consumer4", 40, 20, 20, 0.8, 1, test.initialCharge, test.chargePrice, test.dischargePrice)
+		if err != nil {
+			t.Fatalf("%s: CreateStorage failed: %v", test.name, err)
+		}
+		before := market.consumer("consumer4").Balance
+
+		day, err := market.contract.ClearDayAhead(market.operator(), "2024-06-01")
+		if err != nil {
+			t.Fatalf("%s: ClearDayAhead failed: %v", test.name, err)
+		}
+		for interval, want := range test.want {
+			dispatch := day.Intervals[interval].Storage[0]
+			if math.Abs(dispatch.StateOfCharge-want) > 1e-6 {
+				t.Errorf("%s: after interval %d battery1 holds %.4f MWh, want %.4f", test.name, interval, dispatch.StateOfCharge, want)
+			}
+		}
+		storage, err := market.contract.GetStorage(market.operator(), "battery1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := day.Intervals[len(day.Intervals)-1].Storage[0].StateOfCharge
+		if storage.StateOfCharge != last {
+			t.Errorf("%s: battery1 is stored holding %.4f MWh, the last interval left %.4f", test.name, storage.StateOfCharge, last)
+		}
+
+		// The charging is bought under the owner's account, which is billed
+		// once for it; the battery is no participant of its own
+		trades, err := market.contract.GetTradeHistory(market.operator())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paid, received Amount
+		for _, trade := range trades {
+			if trade.BuyerID == "battery1" || trade.SellerID == "battery1" {
+				t.Errorf("%s: trade %s settles with the battery itself", test.name, trade.ID)
+			}
+			if trade.BuyerID == "consumer4" {
+				paid += trade.TotalValue
+			}
+			if trade.SellerID == "consumer4" {
+				received += trade.TotalValue - trade.NetworkFee
+			}
+		}
+		if balance := market.consumer("consumer4").Balance; balance != before-paid+received {
+			t.Errorf("%s: consumer4 has %s, want %s", test.name, balance, before-paid+received)
+		}
+		for _, interval := range day.Intervals {
+			for _, dispatch := range interval.Consumers {
+				if dispatch.ID == "battery1" {
+					t.Errorf("%s: interval %d reports the battery among the consumers", test.name, interval.Interval)
+				}
+			}
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestStorageIDsAreUniqueAcrossParticipants(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.CreateStorage(market.participant("consumer4"), "battery1", "consumer4", 40, 20, 20, 0.8, 1, 0, 6, 100); err != nil {
+		t.Fatalf("CreateStorage failed: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"consumer", "consumer2"},
+		{"producer", "producer2"},
+		{"storage", "battery1"},
+	}
+	for _, test := range tests {
+		if err := market.contract.CreateStorage(market.participant("consumer4"), test.id, "consumer4", 40, 20, 20, 0.8, 1, 0, 6, 100); err == nil {
+			t.Errorf("CreateStorage took the ID of a %s", test.name)
+		}
+	}
+	if _, err := market.contract.RegisterIdentity(market.operator(), testMSPID, "battery1", "battery1"); err != nil {
+		t.Fatalf("RegisterIdentity failed: %v", err)
+	}
+	ctx := market.participant("battery1")
+	market.stub.TransientMap[consumerTransientKey] = []byte(`{"beta": 8, "theta": 0.05}`)
+	if err := market.contract.CreateConsumer(ctx, "battery1", 10, 100); err == nil {
+		t.Errorf("CreateConsumer took the ID of a storage unit")
+	}
+}
+
+func TestStorageChargingIsCappedByTheOwnersBalance(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.CreateStorage(market.participant("consumer4"), "battery1", "consumer4", 40, 20, 20, 0.8, 1, 0, 6, 100); err != nil {
+		t.Fatalf("CreateStorage failed: %v", err)
+	}
+	if err := market.contract.Burn(market.participant("consumer4"), "consumer4", 9700); err != nil {
+		t.Fatalf("Burn failed: %v", err)
+	}
+
+	// The owner's own demand and the battery's charging share one balance
+	day, err := market.contract.ClearDayAhead(market.operator(), "2024-06-01")
+	if err != nil {
+		t.Fatalf("ClearDayAhead failed: %v", err)
+	}
+	trades, err := market.contract.GetTradeHistory(market.operator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paid Amount
+	for _, trade := range trades {
+		if trade.BuyerID == "consumer4" {
+			paid += trade.TotalValue
+		}
+	}
+	if paid > 300000000 {
+		t.Errorf("consumer4 paid %s from a balance of 300.000000", paid)
+	}
+	if balance := market.consumer("consumer4").Balance; balance != 300000000-paid {
+		t.Errorf("consumer4 has %s, want %s", balance, 300000000-paid)
+	}
+	if charged := day.Intervals[len(day.Intervals)-1].Storage[0].StateOfCharge; charged >= 40 {
+		t.Errorf("battery1 charged to %.4f MWh with its owner out of credits", charged)
+	}
+	market.assertSupplyConsistent()
+}
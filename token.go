@@ -0,0 +1,437 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Energy credits are the fungible token the market settles in, one credit
+// being one micro-USD. Every consumer's Account is its token account: credits
+// locked in escrow by resting buy orders or by pending withdrawals still
+// belong to it, so an account holds its Balance, EscrowBalance and
+// LockedBalance. Credits only enter circulation when an operator mints them,
+// the ledger is seeded or a deposit settles, and leave it when they are
+// burned or withdrawn, so the total supply always equals the sum of the
+// accounts. Network fees are paid into the DSO's own account. Accounts and
+// allowances are kept in the private data collection of their owner's
+// organisation, and the total supply is public.
+//
+// Mint, Burn, Transfer and TransferFrom emit a Transfer event and Approve an
+// Approval event, as in the Fabric ERC-20 token sample. Minted credits come
+// from and burned credits go to "0x0". Events are public, so unlike the
+// sample they name only the parties and the transaction; readers allowed to
+// see the amounts get them from BalanceOf and Allowance.
+const (
+	tokenSupplyType     = "TokenSupply"
+	allowanceObjectType = "Allowance"
+)
+
+// tokenSupplyID is the ID of the single total supply record
+const tokenSupplyID = "credits"
+
+// maxAmount is the largest balance or supply an Amount can hold
+const maxAmount = Amount(math.MaxInt64)
+
+// TokenSupply is the number of credits in circulation
+type TokenSupply struct {
+	Total Amount `json:"total"`
+}
+
+// Allowance is the number of credits a spender may still transfer out of an
+// owner's account
+type Allowance struct {
+	OwnerID   string `json:"ownerId"`
+	SpenderID string `json:"spenderId"`
+	Amount    Amount `json:"amount"`
+	Salt      string `json:"salt"` // Keeps the hash of the amount from being guessed
+	mspID     string // Organisation of the owner, whose collection holds the allowance
+}
+
+// tokenEvent is the payload of a Transfer or Approval event. An Approval is
+// from the owner to the spender.
+type tokenEvent struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	TxID string `json:"txId"` // Transaction that moved the credits or set the allowance
+}
+
+// TokenSupplyReport compares the recorded total supply with the sum of all
+// token accounts
+type TokenSupplyReport struct {
+	TotalSupply Amount `json:"totalSupply"`
+	SumBalances Amount `json:"sumBalances"` // Available and locked credits of every account
+	Accounts    int    `json:"accounts"`
+	Consistent  bool   `json:"consistent"` // Whether the supply equals the sum of the balances
+}
+
+// Mint creates credits in a consumer's account. Only a market operator may
+// call it. The amount is given in USD.
+func (s *EnergyMarket) Mint(ctx contractapi.TransactionContextInterface, accountID string, amount float64) error {
+	value, err := creditAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	supply, err := getTokenSupply(ctx)
+	if err != nil {
+		return err
+	}
+
+	if account.Balance > maxAmount-value || supply.Total > maxAmount-value {
+		return fmt.Errorf("minting %s would overflow the supply", value)
+	}
+	account.Balance += value
+	supply.Total += value
+
+	if err := putAccountObject(ctx, account); err != nil {
+		return err
+	}
+	if err := putTokenSupply(ctx, supply); err != nil {
+		return err
+	}
+	return emitTokenEvent(ctx, "Transfer", "0x0", accountID)
+}
+
+// Burn destroys available credits of the caller's own account. The amount is
+// given in USD.
+func (s *EnergyMarket) Burn(ctx contractapi.TransactionContextInterface, accountID string, amount float64) error {
+	if err := assertCaller(ctx, accountID); err != nil {
+		return err
+	}
+	value, err := creditAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccount(ctx, accountID)
+	if err != nil {
+		return err
+	}
+	supply, err := getTokenSupply(ctx)
+	if err != nil {
+		return err
+	}
+
+	if account.Balance < value {
+		return fmt.Errorf("insufficient credits: user %s has %s available, burn requires %s", accountID, account.Balance, value)
+	}
+	account.Balance -= value
+	supply.Total -= value
+
+	if err := putAccountObject(ctx, account); err != nil {
+		return err
+	}
+	if err := putTokenSupply(ctx, supply); err != nil {
+		return err
+	}
+	return emitTokenEvent(ctx, "Transfer", accountID, "0x0")
+}
+
+// Transfer moves available credits from the caller's account to another
+// consumer's. The amount is given in USD.
+func (s *EnergyMarket) Transfer(ctx contractapi.TransactionContextInterface, fromID string, toID string, amount float64) error {
+	if err := assertCaller(ctx, fromID); err != nil {
+		return err
+	}
+	value, err := creditAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	return transferAccount(ctx, fromID, toID, value)
+}
+
+// Approve lets a spender transfer up to an amount of the caller's credits,
+// replacing any earlier allowance. An amount of zero withdraws it. The amount
+// is given in USD, and the new allowance is salted with random bytes passed
+// as transient data under "salt".
+func (s *EnergyMarket) Approve(ctx contractapi.TransactionContextInterface, ownerID string, spenderID string, amount float64) error {
+	if err := assertCaller(ctx, ownerID); err != nil {
+		return err
+	}
+	if ownerID == spenderID {
+		return fmt.Errorf("user %s cannot approve itself", ownerID)
+	}
+	value, err := toAmount(amount)
+	if err != nil {
+		return fmt.Errorf("invalid allowance: %v", err)
+	}
+	if value < 0 {
+		return fmt.Errorf("allowance cannot be negative")
+	}
+	owner, err := getAccount(ctx, ownerID)
+	if err != nil {
+		return err
+	}
+	if _, err := getAccount(ctx, spenderID); err != nil {
+		return err
+	}
+
+	salt, err := newSalt(ctx, allowanceObjectType, allowanceID(ownerID, spenderID))
+	if err != nil {
+		return err
+	}
+
+	allowance := &Allowance{OwnerID: ownerID, SpenderID: spenderID, Amount: value, Salt: salt, mspID: owner.mspID}
+	if err := putAllowance(ctx, allowance); err != nil {
+		return err
+	}
+	return emitTokenEvent(ctx, "Approval", ownerID, spenderID)
+}
+
+// Allowance retrieves the credits a spender may still transfer out of an
+// owner's account. Only the owner, the spender, operators and auditors may
+// read it.
+func (s *EnergyMarket) Allowance(ctx contractapi.TransactionContextInterface, ownerID string, spenderID string) (Amount, error) {
+	if err := assertCanRead(ctx, ownerID); err != nil {
+		if err := assertCaller(ctx, spenderID); err != nil {
+			return 0, err
+		}
+	}
+
+	allowance, err := getAllowance(ctx, ownerID, spenderID)
+	if err != nil {
+		return 0, err
+	}
+	return allowance.Amount, nil
+}
+
+// TransferFrom moves credits out of an owner's account on behalf of the
+// caller, who must have been approved for at least the amount. The amount is
+// given in USD.
+func (s *EnergyMarket) TransferFrom(ctx contractapi.TransactionContextInterface, spenderID string, fromID string, toID string, amount float64) error {
+	if err := assertCaller(ctx, spenderID); err != nil {
+		return err
+	}
+	value, err := creditAmount(amount)
+	if err != nil {
+		return err
+	}
+
+	allowance, err := getAllowance(ctx, fromID, spenderID)
+	if err != nil {
+		return err
+	}
+	if allowance.Amount < value {
+		return fmt.Errorf("insufficient allowance: user %s may transfer %s of %s's credits, transfer requires %s", spenderID, allowance.Amount, fromID, value)
+	}
+	allowance.Amount -= value
+
+	if err := transferAccount(ctx, fromID, toID, value); err != nil {
+		return err
+	}
+	return putAllowance(ctx, allowance)
+}
+
+// BalanceOf retrieves the credits an account holds, available and locked
+func (s *EnergyMarket) BalanceOf(ctx contractapi.TransactionContextInterface, accountID string) (Amount, error) {
+	if err := assertCanRead(ctx, accountID); err != nil {
+		return 0, err
+	}
+
+	account, err := getAccount(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	return account.held(), nil
+}
+
+// TotalSupply retrieves the number of credits in circulation
+func (s *EnergyMarket) TotalSupply(ctx contractapi.TransactionContextInterface) (Amount, error) {
+	supply, err := getTokenSupply(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return supply.Total, nil
+}
+
+// CheckTokenSupply checks the invariant that the total supply equals the sum
+// of every account's available and locked credits. The peer must be passed
+// the balances of the organisations it does not belong to.
+func (s *EnergyMarket) CheckTokenSupply(ctx contractapi.TransactionContextInterface) (*TokenSupplyReport, error) {
+	supply, err := getTokenSupply(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &TokenSupplyReport{TotalSupply: supply.Total}
+	err = scanObjects(ctx, consumerObjectType, func(value []byte) error {
+		var consumer Consumer
+		if err := json.Unmarshal(value, &consumer); err != nil {
+			return fmt.Errorf("failed to unmarshal consumer: %v", err)
+		}
+		var account Account
+		found, err := getPrivateObject(ctx, consumer.MSPID, accountObjectType, consumer.ID, &account)
+		if err != nil || !found {
+			return err
+		}
+		report.SumBalances += account.held()
+		report.Accounts++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	report.Consistent = report.SumBalances == report.TotalSupply
+
+	return report, nil
+}
+
+// transferCredits moves available credits between two consumers of a market
+// state. The caller stores the state afterwards, so both sides of the
+// transfer are written in the same transaction or not at all.
+func transferCredits(marketState *MarketState, fromID string, toID string, amount Amount) error {
+	from := findConsumer(marketState, fromID)
+	if from < 0 {
+		return fmt.Errorf("user %s not found", fromID)
+	}
+	to := findConsumer(marketState, toID)
+	if to < 0 {
+		return fmt.Errorf("user %s not found", toID)
+	}
+	if marketState.Consumers[from].Balance < amount {
+		return fmt.Errorf("insufficient credits: user %s has %s, payment requires %s", fromID, marketState.Consumers[from].Balance, amount)
+	}
+
+	marketState.Consumers[from].Balance -= amount
+	marketState.Consumers[to].Balance += amount
+	return nil
+}
+
+// transferAccount moves available credits between two token accounts and
+// emits the Transfer event
+func transferAccount(ctx contractapi.TransactionContextInterface, fromID string, toID string, amount Amount) error {
+	if fromID == toID {
+		return fmt.Errorf("user %s cannot transfer to itself", fromID)
+	}
+	from, err := getAccount(ctx, fromID)
+	if err != nil {
+		return err
+	}
+	to, err := getAccount(ctx, toID)
+	if err != nil {
+		return err
+	}
+
+	if from.Balance < amount {
+		return fmt.Errorf("insufficient credits: user %s has %s available, transfer requires %s", fromID, from.Balance, amount)
+	}
+	from.Balance -= amount
+	to.Balance += amount
+
+	if err := putAccountObject(ctx, from); err != nil {
+		return err
+	}
+	if err := putAccountObject(ctx, to); err != nil {
+		return err
+	}
+	return emitTokenEvent(ctx, "Transfer", fromID, toID)
+}
+
+// emitTokenEvent sets the transaction's Transfer or Approval event
+func emitTokenEvent(ctx contractapi.TransactionContextInterface, name string, from string, to string) error {
+	eventJSON, err := json.Marshal(tokenEvent{From: from, To: to, TxID: ctx.GetStub().GetTxID()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s event: %v", name, err)
+	}
+	if err := ctx.GetStub().SetEvent(name, eventJSON); err != nil {
+		return fmt.Errorf("failed to set %s event: %v", name, err)
+	}
+	return nil
+}
+
+// mintSeedBalances sets the supply to the balances a new market is seeded with
+func mintSeedBalances(ctx contractapi.TransactionContextInterface, marketState *MarketState) error {
+	supply := &TokenSupply{}
+	for _, consumer := range marketState.Consumers {
+		supply.Total += consumer.Balance + consumer.EscrowBalance + consumer.LockedBalance
+	}
+	return putTokenSupply(ctx, supply)
+}
+
+// creditAmount converts a positive USD amount of credits to micro-units
+func creditAmount(amount float64) (Amount, error) {
+	value, err := toAmount(amount)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount: %v", err)
+	}
+	if value <= 0 {
+		return 0, fmt.Errorf("amount must be positive")
+	}
+	return value, nil
+}
+
+// getAccount reads the token account of a consumer that must exist, from the
+// collection of the consumer's organisation
+func getAccount(ctx contractapi.TransactionContextInterface, accountID string) (*Account, error) {
+	consumer, err := readConsumerProfile(ctx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if consumer == nil {
+		return nil, fmt.Errorf("account %s not found", accountID)
+	}
+
+	account := Account{mspID: consumer.MSPID}
+	found, err := getPrivateObject(ctx, consumer.MSPID, accountObjectType, accountID, &account)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("account %s not found", accountID)
+	}
+	return &account, nil
+}
+
+// putAccountObject stores a token account read by getAccount back in its
+// organisation's collection
+func putAccountObject(ctx contractapi.TransactionContextInterface, account *Account) error {
+	return putPrivateObject(ctx, account.mspID, accountObjectType, account.UserID, account)
+}
+
+// getAllowance reads an allowance, which is zero when none was approved, from
+// the collection of the owner's organisation
+func getAllowance(ctx contractapi.TransactionContextInterface, ownerID string, spenderID string) (*Allowance, error) {
+	owner, err := getConsumerProfile(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	allowance := Allowance{OwnerID: ownerID, SpenderID: spenderID, mspID: owner.MSPID}
+	if _, err := getPrivateObject(ctx, owner.MSPID, allowanceObjectType, allowanceID(ownerID, spenderID), &allowance); err != nil {
+		return nil, err
+	}
+	return &allowance, nil
+}
+
+// putAllowance stores an allowance in the collection of the owner's organisation
+func putAllowance(ctx contractapi.TransactionContextInterface, allowance *Allowance) error {
+	return putPrivateObject(ctx, allowance.mspID, allowanceObjectType, allowanceID(allowance.OwnerID, allowance.SpenderID), allowance)
+}
+
+// getTokenSupply reads the total supply, which is zero before the ledger is
+// seeded
+func getTokenSupply(ctx contractapi.TransactionContextInterface) (*TokenSupply, error) {
+	var supply TokenSupply
+	if _, err := getObject(ctx, tokenSupplyType, tokenSupplyID, &supply); err != nil {
+		return nil, err
+	}
+	return &supply, nil
+}
+
+// putTokenSupply stores the total supply
+func putTokenSupply(ctx contractapi.TransactionContextInterface, supply *TokenSupply) error {
+	return putObject(ctx, tokenSupplyType, tokenSupplyID, supply)
+}
+
+// allowanceID is the key of the allowance an owner gave a spender
+func allowanceID(ownerID string, spenderID string) string {
+	return ownerID + ":" + spenderID
+}
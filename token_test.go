@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// assertSupplyConsistent fails the test if the total supply is not the sum of the accounts
+func (market *testMarket) assertSupplyConsistent() {
+	report, err := market.contract.CheckTokenSupply(market.operator())
+	if err != nil {
+		market.t.Fatalf("CheckTokenSupply failed: %v", err)
+	}
+	if !report.Consistent {
+		market.t.Errorf("supply %s differs from the sum %s of %d accounts", report.TotalSupply, report.SumBalances, report.Accounts)
+	}
+}
+
+func TestTokenSupplyMatchesAccounts(t *testing.T) {
+	market := newTestMarket(t)
+	market.assertSupplyConsistent()
+
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"mint", func() error { return market.contract.Mint(market.operator(), "consumer1", 250) }},
+		{"transfer", func() error {
+			return market.contract.Transfer(market.participant("consumer1"), "consumer1", "consumer2", 100)
+		}},
+		{"burn", func() error { return market.contract.Burn(market.participant("consumer2"), "consumer2", 40) }},
+		{"escrow", func() error {
+			return market.contract.PlaceOrder(market.participant("consumer3"), "buy", 25, 4, "consumer3", "")
+		}},
+		{"trade", func() error {
+			if err := market.contract.PlaceOrder(market.participant("consumer1"), "sell", 20, 4, "consumer1", "producer1"); err != nil {
+				return err
+			}
+			_, err := market.contract.MatchOrders(market.operator())
+			return err
+		}},
+	}
+	for _, step := range steps {
+		if err := step.run(); err != nil {
+			t.Fatalf("%s failed: %v", step.name, err)
+		}
+		market.assertSupplyConsistent()
+	}
+
+	supply, err := market.contract.TotalSupply(market.operator())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := Amount(60000000000 + 250000000 - 40000000); supply != want {
+		t.Errorf("total supply is %s, want %s", supply, want)
+	}
+}
+
+func TestTransferFromSpendsTheAllowance(t *testing.T) {
+	market := newTestMarket(t)
+	if err := market.contract.Approve(market.participant("consumer1"), "consumer1", "consumer2", 100); err != nil {
+		t.Fatalf("Approve failed: %v", err)
+	}
+
+	tests := []struct {
+		amount    float64
+		ok        bool
+		allowance Amount
+	}{
+		{30, true, 70000000},
+		{80, false, 70000000}, // More than is left
+		{70, true, 0},
+		{1, false, 0},
+	}
+	for _, test := range tests {
+		err := market.contract.TransferFrom(market.participant("consumer2"), "consumer2", "consumer1", "consumer3", test.amount)
+		if (err == nil) != test.ok {
+			t.Errorf("TransferFrom of %v returned %v, want success %v", test.amount, err, test.ok)
+		}
+		allowance, err := market.contract.Allowance(market.participant("consumer1"), "consumer1", "consumer2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowance != test.allowance {
+			t.Errorf("after TransferFrom of %v the allowance is %s, want %s", test.amount, allowance, test.allowance)
+		}
+	}
+
+	if balance := market.consumer("consumer3").Balance; balance != 10100000000 {
+		t.Errorf("consumer3 has %s, want 10100.000000", balance)
+	}
+	market.assertSupplyConsistent()
+
+	// Only the approved spender may spend the allowance
+	if err := market.contract.TransferFrom(market.participant("consumer3"), "consumer2", "consumer1", "consumer3", 1); err == nil {
+		t.Errorf("consumer3 spent consumer2's allowance")
+	}
+}
+
+func TestBurnCannotExceedTheAvailableBalance(t *testing.T) {
+	tests := []struct {
+		name    string
+		escrow  float64 // Price of a 1 MWh buy order resting before the burn
+		amount  float64
+		ok      bool
+		balance Amount
+	}{
+		{"part of the balance", 0, 2500, true, 7500000000},
+		{"whole balance", 0, 10000, true, 0},
+		{"more than the balance", 0, 10000.000001, false, 10000000000},
+		{"credits in escrow", 100, 9950, false, 9900000000},
+	}
+	for _, test := range tests {
+		market := newTestMarket(t)
+		if test.escrow > 0 {
+			market.placeOrder("buy", test.escrow, 1, "consumer1", "")
+		}
+
+		err := market.contract.Burn(market.participant("consumer1"), "consumer1", test.amount)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: Burn returned %v, want success %v", test.name, err, test.ok)
+		}
+		if balance := market.consumer("consumer1").Balance; balance != test.balance {
+			t.Errorf("%s: balance is %s, want %s", test.name, balance, test.balance)
+		}
+		market.assertSupplyConsistent()
+	}
+}
+
+func TestTokenEventsCarryNoAmounts(t *testing.T) {
+	market := newTestMarket(t)
+	for len(market.stub.ChaincodeEventsChannel) > 0 {
+		<-market.stub.ChaincodeEventsChannel
+	}
+
+	ctx := market.participant("consumer1")
+	txID := ctx.GetStub().GetTxID()
+	if err := market.contract.Transfer(ctx, "consumer1", "consumer2", 12.5); err != nil {
+		t.Fatalf("Transfer failed: %v", err)
+	}
+
+	if len(market.stub.ChaincodeEventsChannel) != 1 {
+		t.Fatalf("the transfer emitted %d events, want 1", len(market.stub.ChaincodeEventsChannel))
+	}
+	event := <-market.stub.ChaincodeEventsChannel
+	var payload map[string]interface{}
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]interface{}{"from": "consumer1", "to": "consumer2", "txId": txID}
+	if event.EventName != "Transfer" || len(payload) != len(want) {
+		t.Errorf("the transfer emitted %s %v, want a Transfer event of only %v", event.EventName, payload, want)
+	}
+	for key, value := range want {
+		if payload[key] != value {
+			t.Errorf("Transfer event has %s %v, want %v", key, payload[key], value)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// Utility models supported on Consumer.UtilityModel
+const (
+	UtilityQuadratic = "quadratic" // Beta*d - Theta/2*d^2, the default
+	UtilityLog       = "log"       // Beta*ln(1 + Theta*d)
+	UtilityPiecewise = "piecewise" // Linear between the points of UtilityCurve
+	UtilityBlock     = "block"     // The blocks of DemandBlocks, each at its own price
+)
+
+// UtilityModel is a consumer's utility as a function of its demand. Utility
+// is concave, so marginal utility never rises with demand.
+type UtilityModel interface {
+	// Utility returns the utility of consuming a demand
+	Utility(demand float64) float64
+	// MarginalUtility returns the utility of the next MW above a demand
+	MarginalUtility(demand float64) float64
+	// MarginalUtilityBelow returns the utility of the last MW up to a demand,
+	// which differs from MarginalUtility at a kink
+	MarginalUtilityBelow(demand float64) float64
+	// Demand returns the demand at which marginal utility falls to a price,
+	// before the consumer's demand limits are applied. It may be +Inf.
+	Demand(price float64) float64
+}
+
+// UtilityPoint is a breakpoint of a piecewise-linear utility curve: the
+// utility of consuming Demand MW. The utility is linear between breakpoints.
+type UtilityPoint struct {
+	Demand  float64 `json:"demand"`  // Demand at the breakpoint
+	Utility float64 `json:"utility"` // Total utility at the breakpoint
+}
+
+// DemandBlock is a block of a block bid: Quantity MW wanted at up to Price
+// per MWh. Blocks are bid from zero demand upwards, in the order given.
+type DemandBlock struct {
+	Quantity float64 `json:"quantity"` // Size of the block
+	Price    float64 `json:"price"`    // Marginal utility of the block
+}
+
+// quadraticUtility is Beta*d - Theta/2*d^2
+type quadraticUtility struct {
+	beta  float64
+	theta float64
+}
+
+func (u quadraticUtility) Utility(demand float64) float64 {
+	return u.beta*demand - 0.5*u.theta*math.Pow(demand, 2)
+}
+
+func (u quadraticUtility) MarginalUtility(demand float64) float64 {
+	return u.beta - u.theta*demand
+}
+
+func (u quadraticUtility) MarginalUtilityBelow(demand float64) float64 {
+	return u.MarginalUtility(demand)
+}
+
+func (u quadraticUtility) Demand(price float64) float64 {
+	return (u.beta - price) / u.theta
+}
+
+// logUtility is Beta*ln(1 + Theta*d), whose marginal utility falls off with
+// demand but never reaches zero
+type logUtility struct {
+	beta  float64
+	theta float64
+}
+
+func (u logUtility) Utility(demand float64) float64 {
+	return u.beta * math.Log1p(u.theta*demand)
+}
+
+func (u logUtility) MarginalUtility(demand float64) float64 {
+	return u.beta * u.theta / (1 + u.theta*demand)
+}
+
+func (u logUtility) MarginalUtilityBelow(demand float64) float64 {
+	return u.MarginalUtility(demand)
+}
+
+func (u logUtility) Demand(price float64) float64 {
+	if price <= 0 {
+		return math.Inf(1)
+	}
+	return u.beta/price - 1/u.theta
+}
+
+// stepUtility is a utility with constant marginal utility over stretches of
+// demand. It serves both piecewise-linear curves and block bids.
+type stepUtility struct {
+	base  float64
+	steps []costStep
+}
+
+func (u stepUtility) Utility(demand float64) float64 {
+	utility := u.base
+	for _, step := range u.steps {
+		utility += step.price * math.Min(math.Max(demand-step.start, 0), step.end-step.start)
+	}
+	return utility
+}
+
+func (u stepUtility) MarginalUtility(demand float64) float64 {
+	for _, step := range u.steps {
+		if demand < step.end {
+			return step.price
+		}
+	}
+	return 0
+}
+
+func (u stepUtility) MarginalUtilityBelow(demand float64) float64 {
+	for _, step := range u.steps {
+		if demand <= step.end {
+			return step.price
+		}
+	}
+	return 0
+}
+
+func (u stepUtility) Demand(price float64) float64 {
+	demand := 0.0
+	for _, step := range u.steps {
+		if step.price <= price {
+			break
+		}
+		demand = step.end
+	}
+	return demand
+}
+
+// marginalUtilityBounds returns a price at or below which a consumer demands
+// its maximum and a price at or above which it demands its minimum
+func marginalUtilityBounds(consumer *Consumer) (float64, float64) {
+	utilityModel := utilityOf(consumer)
+	low := utilityModel.MarginalUtilityBelow(consumer.DemandMax)
+	high := utilityModel.MarginalUtility(consumer.DemandMin)
+	if _, stepwise := utilityModel.(stepUtility); stepwise {
+		// A step is wanted only at prices strictly below its price
+		low = math.Nextafter(low, math.Inf(-1))
+	}
+	return low, high
+}
+
+// utilityOf returns the utility model a consumer uses
+func utilityOf(consumer *Consumer) UtilityModel {
+	switch consumer.UtilityModel {
+	case UtilityLog:
+		return logUtility{beta: consumer.Beta, theta: consumer.Theta}
+	case UtilityPiecewise:
+		var steps []costStep
+		for k := 1; k < len(consumer.UtilityCurve); k++ {
+			previous, point := consumer.UtilityCurve[k-1], consumer.UtilityCurve[k]
+			price := (point.Utility - previous.Utility) / (point.Demand - previous.Demand)
+			steps = append(steps, costStep{start: previous.Demand, end: point.Demand, price: price})
+		}
+		return stepUtility{base: consumer.UtilityCurve[0].Utility, steps: steps}
+	case UtilityBlock:
+		var steps []costStep
+		demand := 0.0
+		for _, block := range consumer.DemandBlocks {
+			steps = append(steps, costStep{start: demand, end: demand + block.Quantity, price: block.Price})
+			demand += block.Quantity
+		}
+		return stepUtility{steps: steps}
+	default:
+		return quadraticUtility{beta: consumer.Beta, theta: consumer.Theta}
+	}
+}
+
+// CreateConsumerWithUtility creates a new consumer with any of the utility
+// models. The model's parameters are private and passed as transient data
+// under "consumer": beta and theta parametrise the quadratic and log models,
+// utilityCurve the piecewise model and demandBlocks the block model; the
+// parameters a model does not use must be left empty. The account is salted
+// as in CreateConsumer.
+func (s *EnergyMarket) CreateConsumerWithUtility(ctx contractapi.TransactionContextInterface, id string, utilityModel string, demandMin float64, demandMax float64) error {
+	input, err := getConsumerInput(ctx)
+	if err != nil {
+		return err
+	}
+
+	newConsumer := Consumer{
+		ID:           id,
+		UtilityModel: utilityModel,
+		Beta:         input.Beta,
+		Theta:        input.Theta,
+		UtilityCurve: input.UtilityCurve,
+		DemandBlocks: input.DemandBlocks,
+		DemandMin:    demandMin,
+		DemandMax:    demandMax,
+	}
+	if err := validateUtility(&newConsumer); err != nil {
+		return err
+	}
+
+	return s.addConsumer(ctx, newConsumer)
+}
+
+// getConsumerInput reads the private parameters of a new consumer from the
+// transient data
+func getConsumerInput(ctx contractapi.TransactionContextInterface) (*ConsumerPrivate, error) {
+	var input ConsumerPrivate
+	if err := getTransient(ctx, consumerTransientKey, &input); err != nil {
+		return nil, err
+	}
+	return &input, nil
+}
+
+// validateUtility checks a consumer's demand limits and that its utility
+// model parameters describe a concave utility over them
+func validateUtility(consumer *Consumer) error {
+	if consumer.DemandMin < 0 || consumer.DemandMax < consumer.DemandMin {
+		return fmt.Errorf("consumer %s has invalid demand limits", consumer.ID)
+	}
+
+	usesCoefficients := consumer.UtilityModel == UtilityQuadratic || consumer.UtilityModel == UtilityLog
+	if !usesCoefficients && (consumer.Beta != 0 || consumer.Theta != 0) {
+		return fmt.Errorf("the %s utility model of consumer %s takes no beta or theta", consumer.UtilityModel, consumer.ID)
+	}
+	if consumer.UtilityModel != UtilityPiecewise && len(consumer.UtilityCurve) > 0 {
+		return fmt.Errorf("only the %s utility model takes a utility curve", UtilityPiecewise)
+	}
+	if consumer.UtilityModel != UtilityBlock && len(consumer.DemandBlocks) > 0 {
+		return fmt.Errorf("only the %s utility model takes demand blocks", UtilityBlock)
+	}
+
+	switch consumer.UtilityModel {
+	case UtilityQuadratic:
+		if consumer.Theta <= 0 {
+			return fmt.Errorf("consumer %s must have a positive theta", consumer.ID)
+		}
+	case UtilityLog:
+		if consumer.Beta <= 0 || consumer.Theta <= 0 {
+			return fmt.Errorf("consumer %s must have a positive beta and theta", consumer.ID)
+		}
+	case UtilityPiecewise:
+		curve := consumer.UtilityCurve
+		if len(curve) < 2 {
+			return fmt.Errorf("utility curve of consumer %s needs at least two points", consumer.ID)
+		}
+		slope := math.Inf(1)
+		for k, point := range curve {
+			if math.IsNaN(point.Demand) || math.IsInf(point.Demand, 0) || math.IsNaN(point.Utility) || math.IsInf(point.Utility, 0) {
+				return fmt.Errorf("utility curve point %d is not a finite number", k)
+			}
+			if k == 0 {
+				continue
+			}
+			if point.Demand <= curve[k-1].Demand {
+				return fmt.Errorf("utility curve demands must increase, point %d does not", k)
+			}
+			next := (point.Utility - curve[k-1].Utility) / (point.Demand - curve[k-1].Demand)
+			if next > slope {
+				return fmt.Errorf("utility curve must be concave, its marginal utility rises at point %d", k)
+			}
+			slope = next
+		}
+		if curve[0].Demand != 0 || curve[len(curve)-1].Demand < consumer.DemandMax {
+			return fmt.Errorf("utility curve must cover demands from 0 to the maximum demand %.2f", consumer.DemandMax)
+		}
+	case UtilityBlock:
+		if len(consumer.DemandBlocks) == 0 {
+			return fmt.Errorf("consumer %s needs at least one demand block", consumer.ID)
+		}
+		total := 0.0
+		for k, block := range consumer.DemandBlocks {
+			if math.IsNaN(block.Quantity) || math.IsInf(block.Quantity, 0) || block.Quantity <= 0 {
+				return fmt.Errorf("demand block %d must have a positive quantity", k)
+			}
+			if math.IsNaN(block.Price) || math.IsInf(block.Price, 0) {
+				return fmt.Errorf("demand block %d price is not a finite number", k)
+			}
+			if k > 0 && block.Price > consumer.DemandBlocks[k-1].Price {
+				return fmt.Errorf("demand block prices must not rise, block %d does", k)
+			}
+			total += block.Quantity
+		}
+		if total < consumer.DemandMax {
+			return fmt.Errorf("demand blocks total %.2f, less than the maximum demand %.2f", total, consumer.DemandMax)
+		}
+	default:
+		return fmt.Errorf("invalid utility model %q, expected %q, %q, %q or %q", consumer.UtilityModel, UtilityQuadratic, UtilityLog, UtilityPiecewise, UtilityBlock)
+	}
+
+	return nil
+}